@@ -51,6 +51,8 @@ from src.lib.utils import (client, common, osmo_errors, paths, port_forward, pri
 
 
 INTERACTIVE_COMMANDS = ['bash', 'sh', 'zsh', 'fish', 'tcsh', 'csh', 'ksh']
+# Text message sent when stdin of an exec session is closed. The input itself is sent as bytes.
+EXEC_INPUT_EOF = 'EOF'
 
 
 class TemplateData(pydantic.BaseModel, extra=pydantic.Extra.forbid):
@@ -1221,6 +1223,21 @@ async def send_terminal_size(ws: websockets.WebSocketClientProtocol):  # type: i
     await ws.send(size_message)
 
 
+async def _send_exec_input(reader: asyncio.StreamReader,
+                           ws: websockets.WebSocketClientProtocol):  # type: ignore
+    """ Forwards stdin to the exec session, then tells it that stdin is closed. """
+    try:
+        while True:
+            data = await reader.read(port_forward.SOCKET_READ_BUFFER_SIZE)
+            if not data:
+                # Websockets can not be half-closed, so the end of stdin is sent in band
+                await ws.send(EXEC_INPUT_EOF)
+                return None
+            await ws.send(data)
+    except websockets.exceptions.ConnectionClosed as e:
+        return e
+
+
 async def _run_exec_interactive(service_client: client.ServiceClient, args: argparse.Namespace,
                                 result: Dict[str, str], keep_alive: bool = False):
     router_address = result['router_address']
@@ -1250,11 +1267,13 @@ async def _run_exec_interactive(service_client: client.ServiceClient, args: argp
         await writer.drain()
 
         loop = asyncio.get_event_loop()
-        coroutines = [
-            loop.create_task(port_forward.write_data(writer, ws)),
-            loop.create_task(port_forward.read_data(reader, ws))
-        ]
+        output_task = loop.create_task(port_forward.write_data(writer, ws))
+        input_task = loop.create_task(_send_exec_input(reader, ws))
+        coroutines = [output_task, input_task]
         done, pending = await asyncio.wait(coroutines, return_when=asyncio.FIRST_COMPLETED)
+        if output_task in pending and input_task.result() is None:
+            # Keep writing the output of the command after stdin is closed until it exits
+            done, pending = await asyncio.wait(coroutines)
         for i in pending:
             i.cancel()
         for i in done:
@@ -1357,21 +1376,23 @@ def _port_forward(service_client: client.ServiceClient, args: argparse.Namespace
     results = service_client.request(
         client.RequestMethod.POST,
         f'api/workflow/{args.workflow_id}/portforward/{args.task}',
-        params={'task_ports': remote_ports, 'use_udp': args.udp})
+        params={'task_ports': remote_ports, 'use_udp': args.udp, 'udp_address_family': True})
 
     async def _run():
         task_list = []
         for local_port, remote_port, result in zip(local_ports, remote_ports, results):
             task_list.append(_single_port_forward(
                 service_client, args, local_port, remote_port,
-                result['router_address'], result['key'], result['cookie']))
+                result['router_address'], result['key'], result['cookie'],
+                result.get('udp_address_family', False)))
         await asyncio.wait(task_list, return_when=asyncio.FIRST_COMPLETED)
     asyncio.get_event_loop().run_until_complete(_run())
 
 
 async def _single_port_forward(service_client: client.ServiceClient, args: argparse.Namespace,
                                local_port: int, remote_port: int,
-                               router_address: str, key: str, cookie: str):
+                               router_address: str, key: str, cookie: str,
+                               udp_address_family: bool):
     message = f'Starting port forwarding from {args.workflow_id}/{args.task} to {local_port}. '\
         f'Please visit http://{args.host}:{local_port} if a web application is hosted by the task.'
 
@@ -1384,9 +1405,11 @@ async def _single_port_forward(service_client: client.ServiceClient, args: argpa
         result = service_client.request(
             client.RequestMethod.POST,
             f'api/workflow/{args.workflow_id}/portforward/{args.task}',
-            params={'task_ports': remote_port, 'use_udp': args.udp},
+            params={'task_ports': remote_port, 'use_udp': args.udp, 'udp_address_family': True},
         )[0]
-        return result['router_address'], result['key'], result['cookie']
+        # Services that do not report udp_address_family run tasks that only accept IPv4 framing
+        return result['router_address'], result['key'], result['cookie'], \
+            result.get('udp_address_family', False)
 
     retry = 0
     endpoint = f'api/router/portforward/{args.workflow_id}/client'
@@ -1403,6 +1426,7 @@ async def _single_port_forward(service_client: client.ServiceClient, args: argpa
                     router_address,
                     key,
                     cookie,
+                    address_family=udp_address_family,
                 )
             else:
                 await port_forward.run_tcp(
@@ -1417,11 +1441,11 @@ async def _single_port_forward(service_client: client.ServiceClient, args: argpa
                     cookie,
                 )
             await _wait_for_reconnect(retry)
-            router_address, key, cookie = _send_port_forward_request()
+            router_address, key, cookie, udp_address_family = _send_port_forward_request()
         except osmo_errors.OSMOServerError:
             retry += 1
             await _wait_for_reconnect(retry)
-            router_address, key, cookie = _send_port_forward_request()
+            router_address, key, cookie, udp_address_family = _send_port_forward_request()
         except KeyboardInterrupt:
             break
 
@@ -107,6 +107,13 @@ async def write_data(writer: asyncio.StreamWriter,
         return e
 
 
+def _log_close_reason(result: Exception | None, app_port: int):
+    """ Logs why the task closed a connection, such as a failed readiness probe. """
+    if isinstance(result, websockets.exceptions.ConnectionClosed) and result.rcvd and \
+            result.rcvd.reason:
+        logger.error('Connection to port %d closed by the task: %s', app_port, result.rcvd.reason)
+
+
 async def run_tcp(
     service_client: client.ServiceClient,
     app_host: str,
@@ -198,7 +205,9 @@ async def run_tcp_with_sock(
                     loop.create_task(read_data(reader, ws, ws_write_rate_limiter, buffer_size)),
                 ]
 
-                await asyncio.wait(coroutines, return_when=asyncio.FIRST_COMPLETED)
+                done, _ = await asyncio.wait(coroutines, return_when=asyncio.FIRST_COMPLETED)
+                for task in done:
+                    _log_close_reason(task.result(), app_port)
                 await ws.close()
                 writer.close()
                 await writer.wait_closed()
@@ -227,22 +236,43 @@ async def run_tcp_with_sock(
                 pass
 
 
-def _encode_addr(data: bytes, addr: Tuple[str, int]) -> bytes:
-    """Encodes the address and data into a message"""
-    ip, port = addr
-    return (socket.inet_aton(ip) + struct.pack('>H', port)) + data
+# Address families of the address prefixed to UDP datagrams, mapped to their socket family
+UDP_ADDRESS_FAMILIES = {4: socket.AF_INET, 6: socket.AF_INET6}
+
+
+def _encode_addr(data: bytes, addr: Tuple, address_family: bool) -> bytes:
+    """Encodes the address and data into a message. Without address_family, which ctrl versions
+    before IPv6 support do not accept, only IPv4 addresses can be encoded."""
+    ip, port = addr[:2]
+    family = 6 if ':' in ip else 4
+    if not address_family:
+        if family != 4:
+            raise ValueError(f'Cannot forward UDP from {ip}, the task only supports IPv4')
+        return socket.inet_aton(ip) + struct.pack('>H', port) + data
+    packed_ip = socket.inet_pton(UDP_ADDRESS_FAMILIES[family], ip)
+    return struct.pack('>B', family) + packed_ip + struct.pack('>H', port) + data
 
 
-def _decode_addr(data: bytes) -> Tuple[bytes, str, int]:
+def _decode_addr(data: bytes, address_family: bool) -> Tuple[bytes, str, int]:
     """Decodes a message head into the IP address and port"""
-    ip = socket.inet_ntoa(data[:4])
-    port = struct.unpack('>H', data[4:6])[0]
-    return data[6:], ip, port
+    addr_start, socket_family = 0, socket.AF_INET
+    if address_family:
+        if not data or data[0] not in UDP_ADDRESS_FAMILIES:
+            raise ValueError('Unknown address family in UDP message')
+        addr_start, socket_family = 1, UDP_ADDRESS_FAMILIES[data[0]]
+    addr_end = addr_start + (4 if socket_family == socket.AF_INET else 16)
+    if len(data) < addr_end + 2:
+        raise ValueError('UDP message is shorter than its address')
+    ip = socket.inet_ntop(socket_family, data[addr_start:addr_end])
+    port = struct.unpack('>H', data[addr_end:addr_end + 2])[0]
+    return data[addr_end + 2:], ip, port
 
 
 async def run_udp(service_client: client.ServiceClient, app_host: str, app_port: int, message: str,
-                  endpoint: str, timeout: int, router_address: str, key: str, cookie: str):
-    """ Run UDP port forwarding. """
+                  endpoint: str, timeout: int, router_address: str, key: str, cookie: str,
+                  address_family: bool = False):
+    """ Run UDP port forwarding. address_family is set when the service reports that the task
+    accepts datagrams prefixed with the address family of the client, which supports IPv6. """
     ctrl_ws = None
     transport = None
     try:
@@ -267,7 +297,11 @@ async def run_udp(service_client: client.ServiceClient, app_host: str, app_port:
                     data = await ctrl_ws.recv()
                     if not data:
                         break
-                    data, ip, port = _decode_addr(data)
+                    try:
+                        data, ip, port = _decode_addr(data, address_family)
+                    except ValueError as err:
+                        logger.warning('Dropping UDP message: %s', err)
+                        continue
                     transport.sendto(data, (ip, port))
             except websockets.exceptions.ConnectionClosedError:
                 pass
@@ -277,7 +311,10 @@ async def run_udp(service_client: client.ServiceClient, app_host: str, app_port:
                 pass
 
             def datagram_received(self, data, addr):
-                deque.append(_encode_addr(data, addr))
+                try:
+                    deque.append(_encode_addr(data, addr, address_family))
+                except ValueError as err:
+                    logger.warning('Dropping UDP datagram: %s', err)
 
             def connection_lost(self, exc):
                 pass
@@ -0,0 +1,85 @@
+"""
+SPDX-FileCopyrightText: Copyright (c) 2025 NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+SPDX-License-Identifier: Apache-2.0
+"""
+import unittest
+
+import websockets.exceptions
+import websockets.frames
+
+from src.lib.utils import port_forward
+
+
+class UDPAddressTest(unittest.TestCase):
+    """ Tests the address prefixed to forwarded UDP datagrams. """
+
+    def test_round_trip(self):
+        cases = [
+            ('IPv4', ('127.0.0.1', 8080), True, 7),
+            ('IPv6', ('2001:db8::1', 53, 0, 0), True, 19),
+            ('IPv4 without the address family', ('10.0.0.2', 8080), False, 6),
+        ]
+        for name, addr, address_family, prefix_len in cases:
+            with self.subTest(name):
+                message = port_forward._encode_addr(b'payload', addr, address_family)
+                self.assertEqual(len(message), prefix_len + len(b'payload'))
+                data, ip, port = port_forward._decode_addr(message, address_family)
+                self.assertEqual((data, ip, port), (b'payload', addr[0], addr[1]))
+
+    def test_ipv6_without_the_address_family(self):
+        with self.assertRaises(ValueError):
+            port_forward._encode_addr(b'payload', ('::1', 53, 0, 0), False)
+
+    def test_malformed(self):
+        cases = [
+            ('empty', b'', True),
+            ('unknown address family', bytes([5, 127, 0, 0, 1, 0x1f, 0x90]), True),
+            ('short IPv4', bytes([4, 127, 0, 0, 1, 0x1f]), True),
+            ('short IPv6', bytes([6]) + bytes(8), True),
+            ('short IPv4 without the address family', bytes([127, 0, 0, 1, 0x1f]), False),
+        ]
+        for name, message, address_family in cases:
+            with self.subTest(name):
+                with self.assertRaises(ValueError):
+                    port_forward._decode_addr(message, address_family)
+
+
+class CloseReasonTest(unittest.TestCase):
+    """ Tests logging why the task closed a forwarded connection. """
+
+    def test_logs_the_reason_of_the_task(self):
+        close = websockets.frames.Close(1013, 'readiness probe failed: timeout')
+        err = websockets.exceptions.ConnectionClosedError(close, None)
+        with self.assertLogs(port_forward.logger, 'ERROR') as logs:
+            port_forward._log_close_reason(err, 8080)
+        self.assertIn('readiness probe failed: timeout', logs.output[0])
+
+    def test_ignores_closes_without_a_reason(self):
+        cases = [
+            ('EOF', EOFError('Reader closed.')),
+            ('no close frame', websockets.exceptions.ConnectionClosedError(None, None)),
+            ('empty reason',
+             websockets.exceptions.ConnectionClosedOK(websockets.frames.Close(1000, ''), None)),
+            ('none', None),
+        ]
+        for name, result in cases:
+            with self.subTest(name):
+                with self.assertNoLogs(port_forward.logger):
+                    port_forward._log_close_reason(result, 8080)
+
+
+if __name__ == '__main__':
+    unittest.main()
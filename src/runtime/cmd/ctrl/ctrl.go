@@ -20,8 +20,14 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -34,12 +40,15 @@ import (
 	"os"
 	"os/exec"
 	"os/signal"
+	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
+	"unicode/utf8"
 
 	"go.corp.nvidia.com/osmo/runtime/pkg/args"
 	"go.corp.nvidia.com/osmo/runtime/pkg/common"
@@ -57,6 +66,10 @@ const BUFFERSIZE int = 32 * 1024
 const BARRIER_TICKER_DURATION = time.Duration(5) * time.Minute
 
 var waitGoRoutines sync.WaitGroup
+
+// Goroutines running alongside the logs, such as the metric reports and the token refresh, which
+// are stopped before the logs so their metrics are still sent
+var waitBackground sync.WaitGroup
 var webConn *websocket.Conn
 var bufferMutex sync.Mutex
 var numDroppedMsg int
@@ -70,6 +83,90 @@ var barrierReq string
 
 var rsyncStatus rsync.RsyncStatus
 
+// Additional destinations for log records besides the workflow service
+var logSinks []messages.LogSink
+
+// Send user command output to the workflow service as soon as it is received instead of on
+// the logs period. Toggled by the service with the stream_logs action.
+var streamExecLogs atomic.Bool
+
+// Number of times the user command was restarted
+var restartCount atomic.Int32
+
+// Restart of the user command in progress, during which exec sessions cannot start
+type restartState struct {
+	mutex sync.Mutex
+	done  chan struct{} // Closed when the restart finishes, nil without a restart
+}
+
+var userRestart restartState
+
+// Mark a restart as started. Returns false when a restart is already in progress.
+func (r *restartState) begin() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.done != nil {
+		return false
+	}
+	r.done = make(chan struct{})
+	return true
+}
+
+func (r *restartState) end() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	close(r.done)
+	r.done = nil
+}
+
+func (r *restartState) inProgress() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.done != nil
+}
+
+// Wait up to timeout for the restart in progress to finish. Returns false on timeout.
+func (r *restartState) wait(timeout time.Duration) bool {
+	r.mutex.Lock()
+	done := r.done
+	r.mutex.Unlock()
+	if done == nil {
+		return true
+	}
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// Serializes starting exec sessions, which share the unix listener
+var execStartMutex sync.Mutex
+
+// Text message an exec client sends when its stdin is closed. The input of the session is sent
+// as binary messages.
+const execInputEOF = "EOF"
+
+// Limit on the total bytes of log records sent for the task. Zero means unlimited.
+var maxLogBytes int64
+
+// Maximum total bytes of the outputs of the task. 0 is unlimited.
+var maxOutputBytes int64
+var logBytes atomic.Int64
+var logLimitNotice string
+
+// TLS policy shared by every connection to the OSMO service
+var tlsConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+var httpClient = http.DefaultClient
+
+// Base dialer for every websocket connection. Copy it before customizing it for a connection.
+var websocketDialer = *websocket.DefaultDialer
+
+// Data credentials read from the user and service config files, reloaded on SIGHUP
+var credentialConfigs = map[string]data.ConfigInfo{}
+var credentialMutex sync.RWMutex
+
 type PortForwardType string
 
 const (
@@ -87,6 +184,7 @@ const (
 	ActionRestart     ActionType = "restart"
 	ActionLogDone     ActionType = "log_done"
 	ActionRsync       ActionType = "rsync"
+	ActionStreamLogs  ActionType = "stream_logs"
 )
 
 type Credential struct {
@@ -125,19 +223,48 @@ func (e *DialWebsocketError) Error() string {
 	return e.Message
 }
 
+// Read the refresh token from the refresh token file, or from the environment when the file is not
+// set or does not exist
+func readRefreshToken(cmdArgs args.CtrlArgs) ([]byte, error) {
+	if cmdArgs.RefreshToken != "" {
+		refreshToken, err := os.ReadFile(cmdArgs.RefreshToken)
+		if !errors.Is(err, os.ErrNotExist) {
+			return refreshToken, err
+		}
+	}
+	if refreshToken := os.Getenv(args.RefreshTokenEnv); refreshToken != "" {
+		return []byte(refreshToken), nil
+	}
+	return nil, fmt.Errorf("file %q does not exist and %s is not set", cmdArgs.RefreshToken,
+		args.RefreshTokenEnv)
+}
+
+// Refresh the JWT token, failing the task when the refresh token or the refresh url cannot be
+// used
 func refreshJWTToken(cmdArgs args.CtrlArgs) error {
-	refreshToken, err := os.ReadFile(cmdArgs.RefreshToken)
+	err := fetchJWTToken(cmdArgs)
+	var osmoError *osmo_errors.OSMOError
+	if errors.As(err, &osmoError) {
+		osmo_errors.SetExitCode(osmoError.Code)
+		panic(err.Error())
+	}
+	return err
+}
+
+// fetchJWTToken retrieves a new JWT token with the refresh token. Failures to read the refresh
+// token or parse the refresh url are returned as OSMOErrors, since retrying does not fix them.
+func fetchJWTToken(cmdArgs args.CtrlArgs) error {
+	refreshToken, err := readRefreshToken(cmdArgs)
 	if err != nil {
-		osmo_errors.SetExitCode(osmo_errors.TOKEN_INVALID_CODE)
-		panic(fmt.Sprintf("Unable to read refresh token from file %s due to error %s\n",
-			cmdArgs.RefreshToken, err))
+		return osmo_errors.Wrap(osmo_errors.TOKEN_INVALID_CODE,
+			"Unable to read refresh token from file or environment", err)
 	}
 
 	// Create a URL object from the base URL
 	u, err := url.Parse(cmdArgs.RefreshTokenUrl.String())
 	if err != nil {
-		osmo_errors.SetExitCode(osmo_errors.TOKEN_INVALID_CODE)
-		panic(fmt.Sprintf("Parsing refreshUrl failed: %v\n%s", cmdArgs.RefreshTokenUrl, err))
+		return osmo_errors.Wrap(osmo_errors.TOKEN_INVALID_CODE,
+			fmt.Sprintf("Parsing refreshUrl %v failed", cmdArgs.RefreshTokenUrl), err)
 	}
 
 	// Query parameters
@@ -151,7 +278,7 @@ func refreshJWTToken(cmdArgs args.CtrlArgs) error {
 
 	// Encode query parameters and append to the base URL
 	u.RawQuery = params.Encode()
-	resp, err := http.Get(u.String())
+	resp, err := httpClient.Get(u.String())
 	if err != nil {
 		return &DialWebsocketError{
 			ErrorType: string(FetchFailureError),
@@ -198,28 +325,59 @@ func refreshJWTToken(cmdArgs args.CtrlArgs) error {
 	return nil
 }
 
+// How long to wait before retrying a failed refresh of the JWT token ahead of its expiration
+const tokenRefreshRetry = 5 * time.Second
+
+// Refresh the JWT token refreshMargin before it expires so connections use a valid token without
+// waiting on a refresh. Failed refreshes are retried until the token expires, after which the
+// connections refresh it themselves and fail the task if it cannot be refreshed.
+func refreshJWTTokenAhead(cmdArgs args.CtrlArgs, stopChan chan bool) {
+	for {
+		jwtTokenMux.RLock()
+		refreshAt := tokenExpiration.Add(-cmdArgs.RefreshMargin)
+		jwtTokenMux.RUnlock()
+
+		timer := time.NewTimer(max(time.Until(refreshAt), tokenRefreshRetry))
+		select {
+		case <-stopChan:
+			timer.Stop()
+			defer waitBackground.Done()
+			return
+		case <-timer.C:
+		}
+		if err := fetchJWTToken(cmdArgs); err != nil {
+			log.Printf("Failed to refresh jwt token ahead of its expiration: %s", err)
+		}
+	}
+}
+
 func dialWebsocket(url string, conn **websocket.Conn, cmdArgs args.CtrlArgs, retryCount int) error {
-	// TODO: Validate ssl certs when this is moved into a sidecar
-	// container where we can add a list of certificate authorities.
-	dialer := *websocket.DefaultDialer
-	dialer.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	dialer := websocketDialer
+	dialer.TLSClientConfig = tlsConfig.Clone()
+	if tlsVerificationDisabled(cmdArgs) {
+		dialer.TLSClientConfig.InsecureSkipVerify = true
+	}
+	enableCompression(&dialer, cmdArgs)
 
 	var err error
 	var newConn *websocket.Conn
 	var resp *http.Response
 	var isRefresh bool = false
 
-	// Check if token is valid
+	// Check if token is valid. It is refreshed ahead of its expiration in the background, so it
+	// is only refreshed here before the first connection or when the background refresh failed.
 	jwtTokenMux.RLock()
 	isRefresh = time.Now().After(tokenExpiration)
 	jwtTokenMux.RUnlock()
 	if isRefresh {
 		err := refreshJWTToken(cmdArgs)
+		if e, isDialError := err.(*DialWebsocketError); isDialError &&
+			e.ErrorType == string(FinishedError) && !cmdArgs.ReconnectAfterFinished {
+			exitFinishedTask(cmdArgs)
+		}
 		if err != nil {
 			// Exponential backoff
-			exponent := common.Min(retryCount, 5)
-			delay := time.Duration(math.Pow(2, float64(exponent))) * time.Second
-			time.Sleep(delay)
+			time.Sleep(common.BackoffWithJitter(retryCount, cmdArgs.MaxReconnectBackoff))
 			return err
 		}
 	}
@@ -242,41 +400,124 @@ func dialWebsocket(url string, conn **websocket.Conn, cmdArgs args.CtrlArgs, ret
 		}
 		if !data.WebsocketConnection.ReachedTimeout() {
 			// Exponential backoff
-			exponent := common.Min(retryCount, 5)
-			delay := time.Duration(math.Pow(2, float64(exponent))) * time.Second
-			time.Sleep(delay)
+			time.Sleep(common.BackoffWithJitter(retryCount, cmdArgs.MaxReconnectBackoff))
 			return err
 		}
 
 		log.Printf("Unable to connect to websocket: Timeout")
+		data.CancelTransfers(10 * time.Second)
 		osmo_errors.SetExitCode(osmo_errors.WEBSOCKET_TIMEOUT_CODE)
 		panic(fmt.Sprintf("Failed to connect to websocket %s with error: %s", url, err))
 	}
+	setCompressionLevel(newConn, cmdArgs)
 	return nil
 }
 
+// enableCompression negotiates compressed messages on a websocket to the OSMO service or the
+// router when a compression level is set. Messages are only compressed when the other end also
+// supports it. Websocket messages are the only data ctrl compresses.
+func enableCompression(dialer *websocket.Dialer, cmdArgs args.CtrlArgs) {
+	dialer.EnableCompression = cmdArgs.CompressionLevel != flate.NoCompression
+}
+
+// setCompressionLevel applies the compression level to the messages ctrl writes to a websocket
+func setCompressionLevel(conn *websocket.Conn, cmdArgs args.CtrlArgs) {
+	if cmdArgs.CompressionLevel != flate.NoCompression {
+		conn.SetCompressionLevel(cmdArgs.CompressionLevel)
+	}
+}
+
+// Log queue of the task, flushed to the container log when the service finishes the task
+var pendingLogs *common.CircularBuffer
+
+// exitFinishedTask stops ctrl once the service reports the task as finished, since the service
+// no longer accepts its connection
+func exitFinishedTask(cmdArgs args.CtrlArgs) {
+	log.Println("Service reports the task as finished, stopping")
+	data.CancelTransfers(10 * time.Second)
+
+	// The service no longer accepts logs, so the remaining ones are written to the container log
+	if pendingLogs != nil {
+		bufferMutex.Lock()
+		for {
+			logJson, err := pendingLogs.Pop()
+			if err != nil {
+				break
+			}
+			log.Println(logJson)
+		}
+		bufferMutex.Unlock()
+	}
+
+	cleanupMounts(cmdArgs.DownloadType)
+	// The task is over rather than failed, so ctrl exits with success
+	osmo_errors.SetExitCodeWithReason(0, "The OSMO service reported the task as finished")
+	osmo_errors.SaveExitCode()
+	os.Exit(0)
+}
+
+// Log the first attempts to connect at startup, then less and less often so a long wait still
+// shows progress
+func logConnectAttempt(count int) bool {
+	return count <= 5 || count&(count-1) == 0 || count%100 == 0
+}
+
+// Fail once no jwt token could be retrieved within the startup refresh timeout. Pending errors
+// do not count, since the service answered that the task is not running yet.
+func checkStartupRefresh(err error, startTime time.Time, cmdArgs args.CtrlArgs) {
+	e, isDialError := err.(*DialWebsocketError)
+	if cmdArgs.StartupRefreshTimeout <= 0 || !isDialError ||
+		e.ErrorType == string(PendingError) ||
+		time.Since(startTime) < cmdArgs.StartupRefreshTimeout {
+		return
+	}
+	jwtTokenMux.RLock()
+	retrieved := !tokenExpiration.IsZero()
+	jwtTokenMux.RUnlock()
+	if retrieved {
+		return
+	}
+	data.CancelTransfers(10 * time.Second)
+	osmo_errors.SetExitCode(osmo_errors.TOKEN_INVALID_CODE)
+	panic(fmt.Sprintf("Failed to retrieve a jwt token within %s of startup with %s error: %s",
+		cmdArgs.StartupRefreshTimeout, e.ErrorType, e.Message))
+}
+
 func connWorkflowService(url string, cmdArgs args.CtrlArgs) {
 	// Attempt to dial the websocket
-	data.WebsocketConnection.DisconnectStartTime = time.Now()
+	startTime := time.Now()
+	data.UpdateWebsocketConnection(func(connection *data.WebsocketConnectionInfo) {
+		connection.DisconnectStartTime = startTime
+	})
 	count := 0
 
 	for {
 		err := dialWebsocket(url, &webConn, cmdArgs, count)
 		if err != nil {
 			count++
-			if count%100 == 1 {
+			if e, isDialError := err.(*DialWebsocketError); (!isDialError ||
+				e.ErrorType != string(PendingError)) && !common.TakeRetry() {
+				data.CancelTransfers(10 * time.Second)
+				osmo_errors.SetExitCode(osmo_errors.WEBSOCKET_TIMEOUT_CODE)
+				panic(fmt.Sprintf("Failed to connect to websocket %s: task retry budget "+
+					"exhausted with error: %s", url, err))
+			}
+			if logConnectAttempt(count) {
 				switch e := err.(type) {
 				case *DialWebsocketError:
 					if e.ErrorType == string(PendingError) {
-						log.Println("Waiting for task status to update to RUNNING.")
+						log.Printf("Waiting for task status to update to RUNNING (attempt %d).",
+							count)
 					} else {
-						log.Printf("Failed to connect to websocket %s with %s error: %s",
-							url, e.ErrorType, e.Message)
+						log.Printf("Failed to connect to websocket %s with %s error (attempt %d): "+
+							"%s", url, e.ErrorType, count, e.Message)
 					}
 				default:
-					log.Printf("Failed to connect to websocket %s with error: %s", url, err)
+					log.Printf("Failed to connect to websocket %s with error (attempt %d): %s",
+						url, count, err)
 				}
 			}
+			checkStartupRefresh(err, startTime, cmdArgs)
 			continue
 		}
 		break
@@ -288,14 +529,345 @@ func connWorkflowService(url string, cmdArgs args.CtrlArgs) {
 	}
 }
 
+type droppedLogs struct {
+	count     int
+	startTime time.Time
+	endTime   time.Time
+}
+
+// Metadata of the dropped log records per stream since the last report. Only tracked when
+// dropped logs are reported.
+var trackDroppedLogs bool
+var droppedLogsByStream = map[string]*droppedLogs{}
+
+// Log records dropped since ctrl started. Unlike numDroppedMsg it is never reset, so reports of
+// the total do not depend on when the dropped lines warning was sent. Must hold bufferMutex.
+var totalDroppedLogs int
+
+// Record the stream and time of the oldest record, which is evicted when the queue is full.
+// Must hold bufferMutex.
+func recordDroppedLog(logQueue *common.CircularBuffer) {
+	oldest, err := logQueue.Peek()
+	if err != nil {
+		return
+	}
+	var record struct {
+		Time   time.Time
+		IOType string
+	}
+	if err := json.Unmarshal([]byte(oldest), &record); err != nil {
+		return
+	}
+	dropped, ok := droppedLogsByStream[record.IOType]
+	if !ok {
+		dropped = &droppedLogs{startTime: record.Time}
+		droppedLogsByStream[record.IOType] = dropped
+	}
+	dropped.count++
+	dropped.endTime = record.Time
+}
+
+// Periodically emit which streams lost log records and over which time range, then the total
+// number of records lost so far. The last interval is reported when the reports are stopped.
+func reportDroppedLogs(interval time.Duration, metricChan chan metrics.Metric,
+	cmdArgs args.CtrlArgs, stopChan chan bool) {
+	report := func() {
+		bufferMutex.Lock()
+		byStream := droppedLogsByStream
+		droppedLogsByStream = map[string]*droppedLogs{}
+		total := totalDroppedLogs
+		bufferMutex.Unlock()
+
+		if len(byStream) == 0 {
+			return
+		}
+		for stream, dropped := range byStream {
+			metricChan <- metrics.DroppedLogsMetrics{
+				RetryId:   cmdArgs.RetryId,
+				GroupName: cmdArgs.GroupName,
+				TaskName:  cmdArgs.LogSource,
+				Stream:    stream,
+				Count:     dropped.count,
+				StartTime: dropped.startTime.Format("2006-01-02 15:04:05.000"),
+				EndTime:   dropped.endTime.Format("2006-01-02 15:04:05.000"),
+			}
+		}
+		metricChan <- metrics.DroppedLogsTotalMetrics{
+			RetryId:    cmdArgs.RetryId,
+			GroupName:  cmdArgs.GroupName,
+			TaskName:   cmdArgs.LogSource,
+			Time:       time.Now().Format("2006-01-02 15:04:05.000"),
+			TotalCount: total,
+		}
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopChan:
+			// Flush the drops of the last interval while the logs are still sent
+			report()
+			defer waitBackground.Done()
+			return
+		case <-ticker.C:
+			report()
+		}
+	}
+}
+
+// How often goroutines are counted between reports of the peak goroutine count
+const goroutineSampleInterval = time.Second
+
+// Report the peak number of goroutines seen in each interval. A warning is sent the first time
+// the count exceeds the threshold so goroutine leaks surface before they exhaust memory.
+func reportGoroutines(interval time.Duration, threshold int, osmoChan chan string,
+	metricChan chan metrics.Metric, cmdArgs args.CtrlArgs, stopChan chan bool) {
+	ticker := time.NewTicker(goroutineSampleInterval)
+	defer ticker.Stop()
+	startTime := time.Now()
+	peak := runtime.NumGoroutine()
+	warned := false
+	for {
+		var now time.Time
+		select {
+		case <-stopChan:
+			defer waitBackground.Done()
+			return
+		case now = <-ticker.C:
+		}
+		count := runtime.NumGoroutine()
+		peak = max(peak, count)
+		if threshold > 0 && count > threshold && !warned {
+			warned = true
+			osmoChan <- fmt.Sprintf("WARNING: ctrl is running %d goroutines, which exceeds the "+
+				"threshold of %d", count, threshold)
+		}
+		if now.Sub(startTime) < interval {
+			continue
+		}
+		metricChan <- metrics.GoroutineMetrics{
+			RetryId:        cmdArgs.RetryId,
+			GroupName:      cmdArgs.GroupName,
+			TaskName:       cmdArgs.LogSource,
+			StartTime:      startTime.Format("2006-01-02 15:04:05.000"),
+			EndTime:        now.Format("2006-01-02 15:04:05.000"),
+			PeakGoroutines: peak,
+		}
+		startTime = now
+		peak = count
+	}
+}
+
+// A high water mark re-arms once the log queue drains this many percent below it, so a queue
+// hovering around a mark does not warn repeatedly
+const logHighWaterHysteresis = 10
+
+// Fill percentages of the log queue that warn before logs are dropped. Each mark warns once when
+// reached and again only after the queue drained below it. Must hold bufferMutex.
+type logHighWaterMarks struct {
+	logSource string
+	marks     []int
+	reached   []bool
+}
+
+var logHighWater *logHighWaterMarks
+
+func newLogHighWaterMarks(logSource string, marks []int) *logHighWaterMarks {
+	if len(marks) == 0 {
+		return nil
+	}
+	return &logHighWaterMarks{logSource: logSource, marks: marks, reached: make([]bool, len(marks))}
+}
+
+// Returns the warnings for the marks the queue reached since the last check
+func (h *logHighWaterMarks) check(logQueue *common.CircularBuffer) []string {
+	if h == nil {
+		return nil
+	}
+	fill := logQueue.Len() * 100 / logQueue.Cap()
+	var warnings []string
+	for i, mark := range h.marks {
+		if h.reached[i] {
+			h.reached[i] = fill > mark-logHighWaterHysteresis
+			continue
+		}
+		if fill >= mark {
+			h.reached[i] = true
+			warnings = append(warnings, fmt.Sprintf("WARNING: Log buffer is %d%% full (%d of %d "+
+				"records), logs will be dropped once it is full. Raise the log buffer size or "+
+				"reduce logging.", mark, logQueue.Len(), logQueue.Cap()))
+		}
+	}
+	return warnings
+}
+
+// Push a log record, accounting for the record dropped when the queue is full and warning when
+// the queue reaches a high water mark. Must hold bufferMutex.
+func pushLog(logQueue *common.CircularBuffer, message string) {
+	push := func(message string) {
+		if logQueue.IsFull() {
+			numDroppedMsg++
+			totalDroppedLogs++
+			if trackDroppedLogs {
+				recordDroppedLog(logQueue)
+			}
+		}
+		logQueue.Push(message)
+	}
+	push(message)
+	for _, warning := range logHighWater.check(logQueue) {
+		log.Println(warning)
+		push(messages.CreateLog(logHighWater.logSource, warning, messages.OSMOCtrl))
+	}
+}
+
 // Enqueue log into circular queue in a threadsafe manner
 func threadsafeEnqueue(logQueue *common.CircularBuffer, message string) {
 	bufferMutex.Lock()
 	defer bufferMutex.Unlock()
-	if logQueue.IsFull() {
-		numDroppedMsg++
+	pushLog(logQueue, message)
+}
+
+// Count the log record towards the log volume limit. Returns false once the limit is exceeded,
+// after enqueuing a single notice that the logs were truncated.
+func withinLogLimit(logQueue *common.CircularBuffer, message string) bool {
+	if maxLogBytes <= 0 {
+		return true
 	}
-	logQueue.Push(message)
+	total := logBytes.Add(int64(len(message)))
+	if total <= maxLogBytes {
+		return true
+	}
+	if total-int64(len(message)) <= maxLogBytes {
+		// First record over the limit
+		log.Printf("Log limit of %d bytes reached, dropping further logs", maxLogBytes)
+		osmo_errors.SetLogsTruncated()
+		threadsafeEnqueue(logQueue, logLimitNotice)
+	}
+	return false
+}
+
+// Enqueue a log record for the workflow service and copy it to any configured log sinks
+func enqueueLog(logQueue *common.CircularBuffer, message string) {
+	if !withinLogLimit(logQueue, message) {
+		return
+	}
+	threadsafeEnqueue(logQueue, message)
+	for _, sink := range logSinks {
+		sink.Write(message)
+	}
+}
+
+// Send a log record to the workflow service immediately. Falls back to the log queue when
+// earlier records are still queued, so records are never reordered, or when the websocket is
+// unavailable.
+func sendLogNow(logQueue *common.CircularBuffer, message string) {
+	if !withinLogLimit(logQueue, message) {
+		return
+	}
+	for _, sink := range logSinks {
+		sink.Write(message)
+	}
+
+	bufferMutex.Lock()
+	defer bufferMutex.Unlock()
+	if !data.WebsocketConnection.IsBroken && logQueue.IsEmpty() && numDroppedMsg == 0 {
+		if err := messages.Put(webConn, message); err == nil {
+			return
+		}
+	}
+	pushLog(logQueue, message)
+}
+
+// Send user command output immediately when streaming is enabled, otherwise on the logs period
+func enqueueExecLog(logQueue *common.CircularBuffer, message string) {
+	if streamExecLogs.Load() {
+		sendLogNow(logQueue, message)
+	} else {
+		enqueueLog(logQueue, message)
+	}
+}
+
+// Queue the output of the user command in a response of the user binary. Returns false when the
+// response is not output.
+func enqueueExecOutput(logQueue *common.CircularBuffer, logSource string,
+	response messages.Request) bool {
+	switch response.Type {
+	case messages.MessageOut:
+		enqueueExecLog(logQueue,
+			messages.CreateLog(logSource, response.MessageOut, messages.StdOut))
+	case messages.MessageErr:
+		enqueueExecLog(logQueue,
+			messages.CreateLog(logSource, response.MessageErr, messages.StdErr))
+	case messages.MessageOps:
+		enqueueLog(logQueue,
+			messages.CreateLog(logSource, response.MessageOps, messages.OSMOCtrl))
+	default:
+		return false
+	}
+	return true
+}
+
+// How long the user binary connection can be idle before the output of the user command is
+// considered forwarded after exec finishes
+const execLogIdleTimeout = 100 * time.Millisecond
+
+// Keep forwarding the output of the user command that arrives after exec finishes, since its last
+// lines can still be in transit, until the connection is idle or gracePeriod passes. Then wait up
+// to gracePeriod until the log queue is sent, so the tail of the output is not stuck behind the
+// uploads.
+func drainExecLogs(unixConn net.Conn, decoder *json.Decoder, logQueue *common.CircularBuffer,
+	logSource string, gracePeriod time.Duration) {
+	if gracePeriod <= 0 {
+		return
+	}
+	deadline := time.Now().Add(gracePeriod)
+	defer unixConn.SetReadDeadline(time.Time{})
+
+	drained := 0
+	for {
+		readDeadline := time.Now().Add(execLogIdleTimeout)
+		if readDeadline.After(deadline) {
+			readDeadline = deadline
+		}
+		if err := unixConn.SetReadDeadline(readDeadline); err != nil {
+			log.Printf("Failed to set read deadline on the user binary connection: %v", err)
+			break
+		}
+		var response messages.Request
+		if err := decoder.Decode(&response); err != nil {
+			break
+		}
+		protocolLog.recordRequest(ProtocolReceived, response)
+		if response.Type == messages.UserRsyncStatus {
+			rsyncStatus.SetFromRequest(response)
+		} else if enqueueExecOutput(logQueue, logSource, response) {
+			drained++
+		}
+	}
+	if drained > 0 {
+		log.Printf("Forwarded %d log record(s) received after exec finished", drained)
+	}
+
+	if !waitLogQueueSent(logQueue, time.Now().Add(gracePeriod)) {
+		log.Println("Log queue was not sent within the exec log grace period")
+	}
+}
+
+// Wait until every queued log record is sent or the deadline passes. Returns whether the queue
+// was sent.
+func waitLogQueueSent(logQueue *common.CircularBuffer, deadline time.Time) bool {
+	for time.Now().Before(deadline) {
+		bufferMutex.Lock()
+		queued := logQueue.Len()
+		bufferMutex.Unlock()
+		if queued == 0 {
+			return true
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return false
 }
 
 // Reads from both channels and writes the output into the websocket
@@ -308,15 +880,15 @@ func putLogs(
 		case downloadMsg := <-downloadChan:
 			logMsg = messages.CreateLog(logSource, downloadMsg, messages.Download)
 			log.Printf("%s", downloadMsg)
-			threadsafeEnqueue(logQueue, logMsg)
+			enqueueLog(logQueue, logMsg)
 		case uploadMsg := <-uploadChan:
 			logMsg = messages.CreateLog(logSource, uploadMsg, messages.Upload)
 			log.Printf("%s", uploadMsg)
-			threadsafeEnqueue(logQueue, logMsg)
+			enqueueLog(logQueue, logMsg)
 		case osmoMsg := <-osmoChan:
 			logMsg = messages.CreateLog(logSource, osmoMsg, messages.OSMOCtrl)
 			log.Printf("%s", osmoMsg)
-			threadsafeEnqueue(logQueue, logMsg)
+			enqueueLog(logQueue, logMsg)
 		case osmoMetrics := <-metricChan:
 			logMsg = metrics.CreateMetrics(logSource, osmoMetrics, metrics.Metrics)
 			threadsafeEnqueue(logQueue, logMsg)
@@ -337,6 +909,17 @@ type ServiceRequest struct {
 	Cookie          string `json:"cookie"`
 	UseUDP          bool   `json:"use_udp"`
 	EnableTelemetry bool   `json:"enable_telemetry"`
+	Enabled         bool   `json:"enabled"`
+	User            string `json:"user"`
+	Reason          string `json:"reason"`
+	ProbeType       string `json:"probe_type"`
+	ProbePath       string `json:"probe_path"`
+	// Bytes per second in each direction of each connection of a port forward. It can only lower
+	// the ctrl limit.
+	Bandwidth int64 `json:"bandwidth"`
+	// Whether the client prefixes UDP datagrams with the address family of its address, which
+	// older clients do not send
+	UDPAddressFamily bool `json:"udp_address_family"`
 }
 
 func createWebsocketConnection(
@@ -345,13 +928,14 @@ func createWebsocketConnection(
 	var err error = nil
 	var isRefresh bool = false
 
+	// Only refresh here when the background refresh failed, see refreshJWTTokenAhead
 	jwtTokenMux.RLock()
 	isRefresh = time.Now().After(tokenExpiration)
 	jwtTokenMux.RUnlock()
 	if isRefresh {
 		err := refreshJWTToken(cmdArgs)
 		if err != nil {
-			time.Sleep(1 * time.Second)
+			time.Sleep(common.BackoffWithJitter(0, cmdArgs.MaxReconnectBackoff))
 			return nil, err
 		}
 	}
@@ -363,30 +947,441 @@ func createWebsocketConnection(
 	jwtTokenMux.RUnlock()
 	headers.Add("Cookie", cookie)
 
-	conn, _, err = websocket.DefaultDialer.Dial(address, headers)
+	dialer := websocketDialer
+	dialer.TLSClientConfig = tlsConfig.Clone()
+	enableCompression(&dialer, cmdArgs)
+	conn, _, err = dialer.Dial(address, headers)
+	if err == nil {
+		setCompressionLevel(conn, cmdArgs)
+	}
 	return conn, err
 }
 
+// printConfig writes the effective configuration of ctrl as JSON, without the refresh token
+func printConfig(cmdArgs args.CtrlArgs) {
+	if cmdArgs.RefreshToken != "" {
+		cmdArgs.RefreshToken = "<redacted>"
+	}
+	config, err := json.MarshalIndent(cmdArgs, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(string(config))
+}
+
+func configureDialer(cmdArgs args.CtrlArgs) {
+	websocketDialer.HandshakeTimeout = cmdArgs.HandshakeTimeout
+	log.Printf("Websocket handshake timeout: %s", cmdArgs.HandshakeTimeout)
+	if cmdArgs.CompressionLevel == flate.NoCompression {
+		log.Println("Websocket compression: disabled")
+	} else {
+		log.Printf("Websocket compression level: %d", cmdArgs.CompressionLevel)
+	}
+
+	if cmdArgs.SourceAddr != nil {
+		localDialer := &net.Dialer{
+			LocalAddr: &net.TCPAddr{IP: cmdArgs.SourceAddr},
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}
+		websocketDialer.NetDialContext = localDialer.DialContext
+		httpClient.Transport.(*http.Transport).DialContext = localDialer.DialContext
+		log.Printf("Connecting to the OSMO service from source address %s", cmdArgs.SourceAddr)
+	}
+}
+
+const insecureTLSWarning = "TLS certificate verification of the OSMO service websocket is " +
+	"disabled, so the connection is exposed to man-in-the-middle attacks. Set " +
+	"-pinnedCertSHA256 or -caBundle, or drop -insecureSkipVerify, to verify the service " +
+	"certificate."
+
+// The service certificate is verified when it is pinned, when a CA bundle is configured or when
+// verification is not explicitly skipped
+func tlsVerificationDisabled(cmdArgs args.CtrlArgs) bool {
+	return cmdArgs.PinnedCertSHA256 == nil && cmdArgs.CABundle == "" &&
+		cmdArgs.InsecureSkipVerify
+}
+
+// Apply the configured TLS policy to the websocket dialers and the token refresh client
+func configureTLS(cmdArgs args.CtrlArgs) {
+	tlsConfig = &tls.Config{
+		MinVersion:   cmdArgs.TLSMinVersion,
+		CipherSuites: cmdArgs.TLSCipherSuites,
+	}
+	if cmdArgs.PinnedCertSHA256 != nil {
+		// Without a CA bundle the pin replaces chain verification. With one, the chain is
+		// verified against the bundle first and the pin is checked after it.
+		pinned := cmdArgs.PinnedCertSHA256
+		tlsConfig.InsecureSkipVerify = cmdArgs.CABundle == ""
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errors.New("no certificate presented, expected the pinned certificate")
+			}
+			fingerprint := sha256.Sum256(rawCerts[0])
+			if !bytes.Equal(fingerprint[:], pinned) {
+				return fmt.Errorf("certificate fingerprint %x does not match the pinned "+
+					"fingerprint %x", fingerprint, pinned)
+			}
+			return nil
+		}
+		log.Printf("TLS certificate pinned to SHA-256 fingerprint %x", pinned)
+	}
+	if cmdArgs.CABundle != "" {
+		bundle, err := os.ReadFile(cmdArgs.CABundle)
+		if err != nil {
+			osmo_errors.SetExitCode(osmo_errors.INVALID_INPUT_CODE)
+			panic(fmt.Sprintf("Failed to read CA bundle: %s", err))
+		}
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			log.Printf("Failed to load the system roots, only trusting the CA bundle: %s", err)
+			roots = x509.NewCertPool()
+		}
+		if !roots.AppendCertsFromPEM(bundle) {
+			osmo_errors.SetExitCode(osmo_errors.INVALID_INPUT_CODE)
+			panic(fmt.Sprintf("CA bundle %s contains no PEM certificates", cmdArgs.CABundle))
+		}
+		tlsConfig.RootCAs = roots
+		log.Printf("Verifying TLS certificates against the CA bundle %s", cmdArgs.CABundle)
+	}
+
+	if tlsVerificationDisabled(cmdArgs) {
+		tlsConfig.InsecureSkipVerify = true
+		log.Printf("WARNING: %s", insecureTLSWarning)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig.Clone()
+	httpClient = &http.Client{Transport: transport}
+
+	log.Printf("TLS minimum version: %s", tls.VersionName(tlsConfig.MinVersion))
+	if len(tlsConfig.CipherSuites) > 0 {
+		names := make([]string, 0, len(tlsConfig.CipherSuites))
+		for _, id := range tlsConfig.CipherSuites {
+			names = append(names, tls.CipherSuiteName(id))
+		}
+		log.Printf("TLS cipher suites: %s", strings.Join(names, ", "))
+	}
+}
+
+type resolvedAddress struct {
+	address string
+	expiry  time.Time
+}
+
+// Host the services of the task are forwarded to. Defaults to an IP address since some services
+// like Isaac-sim can not resolve "localhost".
+var taskHost = "127.0.0.1"
+
+// Address of a port of the task
+func taskAddress(port int) string {
+	return net.JoinHostPort(taskHost, strconv.Itoa(port))
+}
+
+// Log the addresses a task host name resolves to
+func logTaskHost(host string) {
+	if net.ParseIP(host) != nil {
+		return
+	}
+	addresses, err := net.LookupHost(host)
+	if err != nil {
+		log.Printf("WARNING: Failed to resolve task host %s: %s", host, err)
+		return
+	}
+	log.Printf("Task host %s resolves to %s", host, strings.Join(addresses, ", "))
+}
+
+// Short lived cache of resolved forward targets, so rapid reconnects skip DNS resolution.
+// Disabled when the TTL is zero.
+var forwardDNSCacheTTL time.Duration
+var forwardDNSCache = map[string]resolvedAddress{}
+var forwardDNSMutex sync.Mutex
+
+// Resolver of forward targets
+var lookupForwardHost = net.LookupHost
+
+// Resolve the host of a forward target, reusing a cached resolution when possible. The cache is
+// not locked while resolving, so a slow resolution does not hold up the other forwards.
+func resolveForwardTarget(address string) string {
+	host, port, err := net.SplitHostPort(address)
+	if forwardDNSCacheTTL <= 0 || err != nil || net.ParseIP(host) != nil {
+		return address
+	}
+
+	forwardDNSMutex.Lock()
+	cached, ok := forwardDNSCache[address]
+	forwardDNSMutex.Unlock()
+	if ok && time.Now().Before(cached.expiry) {
+		return cached.address
+	}
+	ips, err := lookupForwardHost(host)
+	if err != nil || len(ips) == 0 {
+		// Let the dial surface the resolution failure
+		return address
+	}
+	resolved := net.JoinHostPort(ips[0], port)
+	forwardDNSMutex.Lock()
+	forwardDNSCache[address] = resolvedAddress{resolved, time.Now().Add(forwardDNSCacheTTL)}
+	forwardDNSMutex.Unlock()
+	return resolved
+}
+
+func invalidateForwardTarget(address string) {
+	forwardDNSMutex.Lock()
+	defer forwardDNSMutex.Unlock()
+	delete(forwardDNSCache, address)
+}
+
 func createConnection(address string, retryMax int, protocal string) (net.Conn, error) {
 	var conn net.Conn = nil
 	var err error = nil
 	for i := 0; i < retryMax; i++ {
-		conn, err = net.Dial(protocal, address)
+		conn, err = net.Dial(protocal, resolveForwardTarget(address))
 		if err == nil {
 			break
 		}
+		invalidateForwardTarget(address)
 		time.Sleep(time.Second)
 	}
 	return conn, err
 }
 
 func sendUserExecStart(unixConn net.Conn, entryCommand string) error {
-	return json.NewEncoder(unixConn).Encode(
-		messages.UserExecStartRequest(entryCommand))
+	return sendUnixRequest(unixConn, messages.UserExecStartRequest(entryCommand))
+}
+
+type execRecordHeader struct {
+	Command string `json:"command"`
+	User    string `json:"user"`
+	Key     string `json:"key"`
+	Time    string `json:"time"`
+}
+
+type execRecordFrame struct {
+	Time      string `json:"time"`
+	Direction string `json:"direction"`
+	Data      []byte `json:"data"`
+}
+
+// Records the terminal I/O of an exec session as JSON lines: a header followed by one frame
+// per chunk in either direction. The transcript may contain sensitive data typed or printed in
+// the terminal.
+type execRecorder struct {
+	mutex   sync.Mutex
+	file    *os.File
+	writer  *bufio.Writer
+	encoder *json.Encoder
+}
+
+func newExecRecorder(recordDir string, key string, command string,
+	user string) (*execRecorder, error) {
+	// The key comes from the router, so it must not reach outside of the record directory
+	if key == "" || strings.ContainsAny(key, `/\`) || strings.Contains(key, "..") {
+		return nil, fmt.Errorf("invalid exec session key %q for a record file name", key)
+	}
+	if err := os.MkdirAll(recordDir, 0700); err != nil {
+		return nil, err
+	}
+	recordPath := filepath.Join(recordDir,
+		fmt.Sprintf("exec_%s_%d.jsonl", key, time.Now().UnixMilli()))
+	file, err := os.OpenFile(recordPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	writer := bufio.NewWriter(file)
+	recorder := &execRecorder{file: file, writer: writer, encoder: json.NewEncoder(writer)}
+	recorder.encoder.Encode(execRecordHeader{
+		Command: command,
+		User:    user,
+		Key:     key,
+		Time:    time.Now().Format("2006-01-02 15:04:05.000"),
+	})
+	log.Printf("Recording exec session %s to %s", key, recordPath)
+	return recorder, nil
+}
+
+func (r *execRecorder) record(direction string, data []byte) {
+	if r == nil {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.encoder.Encode(execRecordFrame{
+		Time:      time.Now().Format("2006-01-02 15:04:05.000"),
+		Direction: direction,
+		Data:      data,
+	})
+}
+
+func (r *execRecorder) close() {
+	if r == nil {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.writer.Flush()
+	r.file.Close()
+}
+
+// Channels and directions of the entries written by protocolRecorder
+const (
+	ProtocolWebsocket string = "websocket"
+	ProtocolUnix      string = "unix"
+	ProtocolSent      string = "sent"
+	ProtocolReceived  string = "received"
+)
+
+type protocolRecordEntry struct {
+	Time      string          `json:"time"`
+	Channel   string          `json:"channel"`
+	Direction string          `json:"direction"`
+	Message   json.RawMessage `json:"message"`
+}
+
+// Records the messages exchanged with the service and the user container as JSON lines, one
+// entry per message with the message as it was sent or received, so a session can be replayed
+// in order. Credentials in the messages, such as router session cookies, are redacted. Each entry
+// is flushed as it is written so the record survives a crash.
+type protocolRecorder struct {
+	mutex   sync.Mutex
+	file    *os.File
+	writer  *bufio.Writer
+	encoder *json.Encoder
+}
+
+// Recorder of the protocol messages. Nil unless recording is enabled.
+var protocolLog *protocolRecorder
+
+func newProtocolRecorder(recordPath string) (*protocolRecorder, error) {
+	file, err := os.OpenFile(recordPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	writer := bufio.NewWriter(file)
+	log.Printf("Recording protocol messages to %s", recordPath)
+	return &protocolRecorder{file: file, writer: writer, encoder: json.NewEncoder(writer)}, nil
+}
+
+// configureProtocolRecord opens the record of the protocol messages when -recordProtocol is set
+func configureProtocolRecord(cmdArgs args.CtrlArgs) {
+	if cmdArgs.RecordProtocol == "" {
+		return
+	}
+	recorder, err := newProtocolRecorder(cmdArgs.RecordProtocol)
+	if err != nil {
+		osmo_errors.SetExitCode(osmo_errors.FILE_FAILED_CODE)
+		panic(fmt.Sprintf("Failed to open protocol record: %v", err))
+	}
+	protocolLog = recorder
+}
+
+const redactedValue = "<redacted>"
+
+// Whether a field of a recorded message carries a credential, such as a cookie or a token
+func isCredentialField(name string) bool {
+	name = strings.ToLower(name)
+	return strings.Contains(name, "cookie") || strings.Contains(name, "token") ||
+		strings.Contains(name, "secret") || strings.Contains(name, "password") ||
+		name == "access_key"
+}
+
+// redactMessage replaces the values of the credential fields at any depth of a JSON message. The
+// message is returned as is when it has none.
+func redactMessage(message []byte) []byte {
+	decoder := json.NewDecoder(bytes.NewReader(message))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil || !redactValue(value) {
+		return message
+	}
+	redacted, err := json.Marshal(value)
+	if err != nil {
+		return message
+	}
+	return redacted
+}
+
+func redactValue(value interface{}) bool {
+	redacted := false
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for field, inner := range v {
+			if isCredentialField(field) {
+				v[field] = redactedValue
+				redacted = true
+			} else if redactValue(inner) {
+				redacted = true
+			}
+		}
+	case []interface{}:
+		for _, inner := range v {
+			if redactValue(inner) {
+				redacted = true
+			}
+		}
+	}
+	return redacted
+}
+
+func (r *protocolRecorder) record(channel string, direction string, message []byte) {
+	if r == nil {
+		return
+	}
+	if json.Valid(message) {
+		message = redactMessage(message)
+	} else {
+		// Keep messages that failed to parse as a JSON string
+		message, _ = json.Marshal(string(message))
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.encoder.Encode(protocolRecordEntry{
+		Time:      time.Now().Format("2006-01-02 15:04:05.000"),
+		Channel:   channel,
+		Direction: direction,
+		Message:   message,
+	})
+	r.writer.Flush()
+}
+
+func (r *protocolRecorder) recordRequest(direction string, request messages.Request) {
+	if r == nil {
+		return
+	}
+	message, err := json.Marshal(request)
+	if err != nil {
+		log.Println("Failed to record unix request:", err)
+		return
+	}
+	r.record(ProtocolUnix, direction, message)
+}
+
+func (r *protocolRecorder) close() {
+	if r == nil {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.writer.Flush()
+	r.file.Close()
+}
+
+// sendUnixRequest sends a request to the user container over the unix socket
+func sendUnixRequest(unixConn net.Conn, request messages.Request) error {
+	protocolLog.recordRequest(ProtocolSent, request)
+	return json.NewEncoder(unixConn).Encode(request)
+}
+
+// Logger that tags each line with the forward or exec session it belongs to, so the lines of
+// concurrent sessions can be told apart
+func sessionLogger(session string, key string) *log.Logger {
+	return log.New(log.Writer(), fmt.Sprintf("[%s %s] ", session, key),
+		log.Flags()|log.Lmsgprefix)
 }
 
 func ctrlUserExec(unixConn net.Conn, routerAddress string, key string, cookie string,
-	cmdArgs args.CtrlArgs) {
+	entryCommand string, user string, cmdArgs args.CtrlArgs) {
+	logger := sessionLogger("exec", key)
 	defer unixConn.Close()
 	url := fmt.Sprintf("%s/api/router/exec/%s/backend/%s", routerAddress, cmdArgs.Workflow, key)
 	var conn *websocket.Conn
@@ -398,58 +1393,196 @@ func ctrlUserExec(unixConn net.Conn, routerAddress string, key string, cookie st
 		if err == nil {
 			break
 		}
-		time.Sleep(time.Second)
+		time.Sleep(common.BackoffWithJitter(i, cmdArgs.MaxReconnectBackoff))
 	}
 	if err != nil {
-		log.Println("User Exec: error connecting to the router:", err)
+		logger.Println("User Exec: error connecting to the router:", err)
 		return
 	}
 	defer conn.Close()
 
+	var recorder *execRecorder
+	if cmdArgs.RecordExecDir != "" {
+		recorder, err = newExecRecorder(cmdArgs.RecordExecDir, key, entryCommand, user)
+		if err != nil {
+			logger.Println("User Exec: Failed to start recording:", err)
+		}
+		defer recorder.close()
+	}
+
 	var waitGroup sync.WaitGroup
 	waitGroup.Add(1)
 
 	go func() {
 		for {
-			_, data, err := conn.ReadMessage()
-			if err != nil && err != io.EOF {
-				log.Println(
+			messageType, data, err := conn.ReadMessage()
+			if err != nil {
+				logger.Println(
 					"User Exec: Error from connection to exec instance. ", err)
 				break
 			}
+			// Websockets can not be half-closed, so the client sends the end of its input in band
+			if messageType == websocket.TextMessage && string(data) == execInputEOF {
+				logger.Println("User Exec: Connection closed its input")
+				if cmdArgs.ExecCloseStdin {
+					closeExecInput(unixConn, logger)
+				}
+				continue
+			}
+			recorder.record("input", data)
 			_, err = unixConn.Write(data)
 			if err != nil {
-				log.Println("User Exec: Error write to exec instance", err)
+				logger.Println("User Exec: Error write to exec instance", err)
+				break
+			}
+		}
+	}()
+
+	go func() {
+		defer waitGroup.Done()
+		data := make([]byte, 1024)
+		for {
+			n, err := unixConn.Read(data)
+			if err != nil {
+				logger.Println("User Exec: Error from exec instance to connection.", err)
+				break
+			}
+			recorder.record("output", data[:n])
+			err = conn.WriteMessage(websocket.BinaryMessage, data[:n])
+			if err != nil {
+				logger.Println("User Exec: Error writing to connection.", err)
 				break
 			}
 		}
 	}()
+	waitGroup.Wait()
+}
+
+// Shut down the write side of the unix connection so the user command reads EOF on stdin while
+// its output is still forwarded
+func closeExecInput(unixConn net.Conn, logger *log.Logger) {
+	halfCloser, ok := unixConn.(interface{ CloseWrite() error })
+	if !ok {
+		logger.Println("User Exec: Connection to exec instance does not support closing its input")
+		return
+	}
+	if err := halfCloser.CloseWrite(); err != nil {
+		logger.Println("User Exec: Error closing the input of exec instance.", err)
+	}
+}
+
+// Ask the user container to start a terminal and connect the exec session to it
+func startUserExec(unixConn net.Conn, listener net.Listener, clientInfo ServiceRequest,
+	cmdArgs args.CtrlArgs) {
+	execStartMutex.Lock()
+	defer execStartMutex.Unlock()
+	err := sendUserExecStart(unixConn, clientInfo.EntryCommand)
+	if err != nil {
+		log.Println("Error sending user exec start request", err)
+		return
+	}
+	unixListener := listener.(*net.UnixListener)
+	unixListener.SetDeadline(time.Now().Add(cmdArgs.ExecTimeout))
+	execConn, err := listener.Accept()
+	if err != nil {
+		var reason string
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			log.Printf("Timed out after %s waiting for user terminal", cmdArgs.ExecTimeout)
+			reason = fmt.Sprintf("Exec session timed out after %s waiting for the "+
+				"task to start the terminal, please retry.", cmdArgs.ExecTimeout)
+		} else {
+			log.Println("Error connect to user terminal", err)
+			reason = fmt.Sprintf("Exec session failed to start: %s", err)
+		}
+		go rejectUserExec(clientInfo.RouterAddress, clientInfo.Key, clientInfo.Cookie,
+			reason, cmdArgs)
+		return
+	}
+	go ctrlUserExec(execConn, clientInfo.RouterAddress, clientInfo.Key,
+		clientInfo.Cookie, clientInfo.EntryCommand, clientInfo.User, cmdArgs)
+}
+
+// Tell the exec client why the session could not be started
+func rejectUserExec(routerAddress string, key string, cookie string, reason string,
+	cmdArgs args.CtrlArgs) {
+	url := fmt.Sprintf("%s/api/router/exec/%s/backend/%s", routerAddress, cmdArgs.Workflow, key)
+	conn, err := createWebsocketConnection(url, cookie, cmdArgs)
+	if err != nil {
+		log.Println("User Exec: error connecting to the router:", err)
+		return
+	}
+	defer conn.Close()
+
+	if err := conn.WriteMessage(websocket.BinaryMessage, []byte(reason+"\r\n")); err != nil {
+		log.Println("User Exec: Error writing to connection.", err)
+	}
+	conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+}
+
+// Port forwards in flight, drained on shutdown so transfers end with their connections closed
+// and their telemetry sent
+type activePortForwards struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+var portForwards = newActivePortForwards()
+
+func newActivePortForwards() *activePortForwards {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &activePortForwards{ctx: ctx, cancel: cancel}
+}
+
+// Run a forward in a goroutine with a context that is cancelled on shutdown
+func (p *activePortForwards) run(forward func(ctx context.Context)) {
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		forward(p.ctx)
+	}()
+}
 
+// Cancel all forwards and wait up to timeout for them to close their connections
+func (p *activePortForwards) drain(timeout time.Duration) {
+	p.cancel()
+	drained := make(chan struct{})
 	go func() {
-		defer waitGroup.Done()
-		data := make([]byte, 1024)
-		for {
-			n, err := unixConn.Read(data)
-			if err != nil {
-				log.Println("User Exec: Error from exec instance to connection.", err)
-				break
-			}
-			err = conn.WriteMessage(websocket.BinaryMessage, data[:n])
-			if err != nil {
-				log.Println("User Exec: Error writing to connection.", err)
-				break
+		p.wg.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		log.Println("Port forwards drained")
+	case <-time.After(timeout):
+		log.Printf("Port forwards not drained after %s, exiting", timeout)
+	}
+}
+
+// Close the connections once ctx is cancelled, which stops the loops blocked on them. Websockets
+// are told the task is going away first. The returned function stops watching ctx.
+func closeOnShutdown(ctx context.Context, conns ...io.Closer) func() bool {
+	return context.AfterFunc(ctx, func() {
+		for _, conn := range conns {
+			if wsConn, ok := conn.(*websocket.Conn); ok {
+				wsConn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseGoingAway, "task is shutting down"),
+					time.Now().Add(time.Second))
 			}
+			conn.Close()
 		}
-	}()
-	waitGroup.Wait()
+	})
 }
 
 func userPortForwardTCP(
+	ctx context.Context,
 	routerAddress string,
 	clientInfo ServiceRequest,
 	cmdArgs args.CtrlArgs,
 	metricChan chan metrics.Metric,
 ) {
+	logger := sessionLogger("forward", clientInfo.Key)
 	url := fmt.Sprintf(
 		"%s/api/router/%s/%s/backend/%s",
 		routerAddress, clientInfo.Action, cmdArgs.Workflow, clientInfo.Key)
@@ -462,22 +1595,32 @@ func userPortForwardTCP(
 		if err == nil {
 			break
 		}
-		time.Sleep(time.Second)
+		time.Sleep(common.BackoffWithJitter(i, cmdArgs.MaxReconnectBackoff))
 	}
 	if err != nil {
-		log.Println("userPortForwardTCP: error connecting to the router:", err)
+		logger.Println("userPortForwardTCP: error connecting to the router:", err)
 		return
 	}
 	defer conn.Close()
+	defer closeOnShutdown(ctx, conn)()
+	if cmdArgs.ForwardListenCheck {
+		if err := checkLocalListening(clientInfo.TaskPort); err != nil {
+			reason := fmt.Sprintf("local service not listening on port %d", clientInfo.TaskPort)
+			logger.Printf("userPortForwardTCP: %s: %v", reason, err)
+			rejectPortForward(conn, reason)
+			return
+		}
+	}
+	bandwidth := forwardBandwidth(clientInfo, cmdArgs)
 
 	for {
 		_, data, err := conn.ReadMessage()
 		if err != nil {
 			if err == io.EOF {
-				log.Println("userPortForwardTCP: EOF reached.")
+				logger.Println("userPortForwardTCP: EOF reached.")
 				break
 			}
-			log.Println("userPortForwardTCP: Error reading websocket connection:", err)
+			logger.Println("userPortForwardTCP: Error reading websocket connection:", err)
 			break
 		}
 
@@ -485,50 +1628,71 @@ func userPortForwardTCP(
 		var message PortForwardMessage
 		err = json.Unmarshal(data, &message)
 		if err != nil {
-			log.Println("userPortForwardTCP: Error parsing json:", err)
+			logger.Println("userPortForwardTCP: Error parsing json:", err)
 			break
 		}
 
 		if message.Type == PortForwardWS {
-			go portforwardConnectWS(
-				routerAddress, message, clientInfo.TaskPort, cmdArgs)
+			portForwards.run(func(ctx context.Context) {
+				portforwardConnectWS(
+					ctx,
+					clientInfo.Action,
+					routerAddress,
+					message,
+					clientInfo.TaskPort,
+					cmdArgs,
+					bandwidth,
+					clientInfo.EnableTelemetry,
+					metricChan,
+				)
+			})
 		} else {
-			go portforwardConnectTCP(
-				clientInfo.Action,
-				routerAddress,
-				message.Key,
-				message.Cookie,
-				clientInfo.TaskPort,
-				cmdArgs,
-				clientInfo.EnableTelemetry,
-				metricChan,
-			)
+			portForwards.run(func(ctx context.Context) {
+				portforwardConnectTCP(
+					ctx,
+					clientInfo.Action,
+					routerAddress,
+					message.Key,
+					message.Cookie,
+					clientInfo.TaskPort,
+					cmdArgs,
+					bandwidth,
+					clientInfo.EnableTelemetry,
+					metricChan,
+					newForwardProbe(clientInfo, cmdArgs),
+				)
+			})
 		}
 	}
 }
 
-func copyWebsocket(dst, src *websocket.Conn, closeConn chan bool) {
-	defer func() { closeConn <- true }()
+// copyWebsocket copies messages from src to dst until either fails, counting the payload bytes
+// copied in bytesCopied
+func copyWebsocket(dst, src *websocket.Conn, logger *log.Logger,
+	limiter *common.RateLimiter, bytesCopied *atomic.Int64) {
 	for {
 		messageType, data, err := src.ReadMessage()
 		if err != nil {
-			log.Printf("Error reading from websocket: %v", err)
+			logger.Printf("Error reading from websocket: %v", err)
 			return
 		}
+		limiter.Wait(len(data))
 		err = dst.WriteMessage(messageType, data)
 		if err != nil {
-			log.Printf("Error writing to websocket: %v", err)
+			logger.Printf("Error writing to websocket: %v", err)
 			return
 		}
+		bytesCopied.Add(int64(len(data)))
 	}
 }
 
-func putPortforwardTCPTelemetry(
+func putPortforwardTelemetry(
 	metricChan chan metrics.Metric,
 	metricsType string,
 	cmdArgs args.CtrlArgs,
 	startTime string,
 	sizeInBytes int64,
+	rateLimit int64,
 	timeout time.Duration,
 ) {
 	metric := metrics.TaskIOMetrics{
@@ -540,6 +1704,7 @@ func putPortforwardTCPTelemetry(
 		EndTime:      time.Now().Format("2006-01-02 15:04:05.000"),
 		SizeInBytes:  sizeInBytes,
 		DownloadType: data.NotApplicable,
+		RateLimit:    rateLimit,
 	}
 
 	select {
@@ -550,16 +1715,130 @@ func putPortforwardTCPTelemetry(
 	}
 }
 
+// Bandwidth limit of the connections of a port forward in bytes per second, 0 for unlimited. The
+// session may ask for a lower limit than the ctrl limit, but not a higher one.
+func forwardBandwidth(clientInfo ServiceRequest, cmdArgs args.CtrlArgs) int64 {
+	bandwidth := cmdArgs.PerForwardBandwidth
+	if clientInfo.Bandwidth > 0 && (bandwidth <= 0 || clientInfo.Bandwidth < bandwidth) {
+		bandwidth = clientInfo.Bandwidth
+	}
+	return max(bandwidth, 0)
+}
+
+// Check once that a local server accepts connections on the port, so a forward to a service that
+// is down can be told apart from a network problem
+func checkLocalListening(localPort int) error {
+	conn, err := net.DialTimeout("tcp", taskAddress(localPort), time.Second)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// Readiness probe run against a local server before forwarding traffic to it
+type forwardProbe struct {
+	probeType string // none, tcp or http
+	path      string
+	timeout   time.Duration
+}
+
+// Probe settings of a port forward session, falling back to the ctrl defaults
+func newForwardProbe(clientInfo ServiceRequest, cmdArgs args.CtrlArgs) forwardProbe {
+	probe := forwardProbe{cmdArgs.ForwardProbe, cmdArgs.ForwardProbePath,
+		cmdArgs.ForwardProbeTimeout}
+	if clientInfo.ProbeType != "" {
+		probe.probeType = clientInfo.ProbeType
+	}
+	if clientInfo.ProbePath != "" {
+		probe.path = clientInfo.ProbePath
+	}
+	return probe
+}
+
+// Wait until the local server accepts connections, and for http probes returns 200 for the
+// probe path, or the probe times out
+func (p forwardProbe) wait(localPort int) error {
+	if p.probeType == "" || p.probeType == "none" {
+		return nil
+	}
+	localAddr := taskAddress(localPort)
+	client := http.Client{Timeout: time.Second}
+	deadline := time.Now().Add(p.timeout)
+	var err error
+	for {
+		switch p.probeType {
+		case "tcp":
+			var conn net.Conn
+			conn, err = net.DialTimeout("tcp", localAddr, time.Second)
+			if err == nil {
+				conn.Close()
+				return nil
+			}
+		case "http":
+			var resp *http.Response
+			resp, err = client.Get("http://" + localAddr + "/" + strings.TrimPrefix(p.path, "/"))
+			if err == nil {
+				resp.Body.Close()
+				if resp.StatusCode == http.StatusOK {
+					return nil
+				}
+				err = fmt.Errorf("probe returned status %d", resp.StatusCode)
+			}
+		default:
+			return fmt.Errorf("unknown probe type %s", p.probeType)
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("local server at port %d not ready after %s: %w",
+				localPort, p.timeout, err)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+// Longest reason of a websocket close frame, which holds 125 bytes including the close code
+const maxCloseReasonLength = 123
+
+// rejectPortForward closes a port forward connection, telling the client why it was not forwarded
+func rejectPortForward(conn *websocket.Conn, reason string) {
+	if len(reason) > maxCloseReasonLength {
+		// Cut on a rune boundary, since the reason of a close frame must be valid UTF-8
+		cut := maxCloseReasonLength - 3
+		for cut > 0 && !utf8.RuneStart(reason[cut]) {
+			cut--
+		}
+		reason = reason[:cut] + "..."
+	}
+	conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseTryAgainLater, reason),
+		time.Now().Add(time.Second))
+}
+
 func portforwardConnectTCP(
+	ctx context.Context,
 	actionType ActionType,
 	routerAddress string,
 	key string,
 	cookie string,
 	localPort int,
 	cmdArgs args.CtrlArgs,
+	bandwidth int64,
 	enableTelemetry bool,
 	metricChan chan metrics.Metric,
+	probe forwardProbe,
 ) {
+	logger := sessionLogger("forward", key)
+	url := fmt.Sprintf(
+		"%s/api/router/portforward/%s/backend/%s", routerAddress, cmdArgs.Workflow, key)
+	if probeErr := probe.wait(localPort); probeErr != nil {
+		logger.Println("portforwardConnectTCP: readiness probe failed:", probeErr)
+		// Connect to the router only to tell the client why the connection is not forwarded
+		if remoteConn, err := createWebsocketConnection(url, cookie, cmdArgs); err == nil {
+			rejectPortForward(remoteConn, "readiness probe failed: "+probeErr.Error())
+			remoteConn.Close()
+		}
+		return
+	}
+
 	var remoteConn *websocket.Conn
 	var localConn net.Conn
 	var err error
@@ -571,63 +1850,69 @@ func portforwardConnectTCP(
 		<-closeConn
 	}()
 
-	url := fmt.Sprintf(
-		"%s/api/router/portforward/%s/backend/%s", routerAddress, cmdArgs.Workflow, key)
 	for i := 0; i < retryMax; i++ {
 		remoteConn, err = createWebsocketConnection(url, cookie, cmdArgs)
 		if err == nil {
 			break
 		}
-		time.Sleep(time.Second)
+		time.Sleep(common.BackoffWithJitter(i, cmdArgs.MaxReconnectBackoff))
 	}
 	if err != nil {
-		log.Println("portforwardConnectTCP: error connecting to the router:", err)
+		logger.Println("portforwardConnectTCP: error connecting to the router:", err)
 		return
 	}
 
 	defer remoteConn.Close()
 
-	localAddr := fmt.Sprintf("127.0.0.1:%d", localPort)
+	localAddr := taskAddress(localPort)
 	localConn, err = createConnection(localAddr, retryMax, "tcp")
 	if err != nil {
-		log.Println("portforwardConnectTCP: error connecting to local server listening at port: ",
+		logger.Println("portforwardConnectTCP: error connecting to local server listening at port: ",
 			localPort, err)
 		return
 	}
 	defer localConn.Close()
-	defer log.Println("Closing local and remote connections. key: ",
+	defer logger.Println("Closing local and remote connections. key: ",
 		key, localConn.LocalAddr(), remoteConn.LocalAddr())
+	// Stop both copy loops on shutdown so they report their telemetry
+	defer closeOnShutdown(ctx, remoteConn, localConn)()
 
 	go func() {
+		// Signalled after the telemetry is sent, so a drained forward has reported it
+		defer func() { closeConn <- true }()
 		// Optional telemetry for portforward output
 		var bytesSent atomic.Int64
 		if enableTelemetry {
 			startTime := time.Now().Format("2006-01-02 15:04:05.000")
 			defer func() {
-				go putPortforwardTCPTelemetry(
+				putPortforwardTelemetry(
 					metricChan,
 					strings.ToUpper(string(actionType))+"_OUTPUT",
 					cmdArgs,
 					startTime,
 					bytesSent.Load(),
+					bandwidth,
 					250*time.Millisecond,
 				)
 			}()
 		}
 
+		// Each direction of each connection has its own limiter
+		limiter := common.NewRateLimiter(bandwidth)
 		buffer := make([]byte, BUFFERSIZE)
 		for {
 			n, err := localConn.Read(buffer)
 			if err != nil {
-				log.Println("portforwardConnectTCP: Error reading for localConn: ", err)
-				log.Println("Address for local and remote: ",
+				logger.Println("portforwardConnectTCP: Error reading for localConn: ", err)
+				logger.Println("Address for local and remote: ",
 					localConn.LocalAddr(), localConn.RemoteAddr())
 				break
 			}
+			limiter.Wait(n)
 			err = remoteConn.WriteMessage(websocket.BinaryMessage, buffer[:n])
 			if err != nil {
-				log.Println("portforwardConnectTCP: Error writing for remoteConn: ", err)
-				log.Println("Address for local and remote: ",
+				logger.Println("portforwardConnectTCP: Error writing for remoteConn: ", err)
+				logger.Println("Address for local and remote: ",
 					remoteConn.LocalAddr(), remoteConn.RemoteAddr())
 				break
 			}
@@ -636,40 +1921,43 @@ func portforwardConnectTCP(
 				bytesSent.Add(int64(n))
 			}
 		}
-		log.Println("portforwardConnectTCP: local to remote for loop is done. key: ", key)
-		closeConn <- true
+		logger.Println("portforwardConnectTCP: local to remote for loop is done. key: ", key)
 	}()
 
 	go func() {
+		defer func() { closeConn <- true }()
 		// Optional telemetry for portforward input
 		var bytesReceived atomic.Int64
 		if enableTelemetry {
 			startTime := time.Now().Format("2006-01-02 15:04:05.000")
 			defer func() {
-				go putPortforwardTCPTelemetry(
+				putPortforwardTelemetry(
 					metricChan,
 					strings.ToUpper(string(actionType))+"_INPUT",
 					cmdArgs,
 					startTime,
 					bytesReceived.Load(),
+					bandwidth,
 					250*time.Millisecond,
 				)
 			}()
 		}
 
+		limiter := common.NewRateLimiter(bandwidth)
 		for {
 			_, data, err := remoteConn.ReadMessage()
 			if err != nil {
-				log.Println("portforwardConnectTCP: Error reading for remoteConn: ", err)
-				log.Println("Address for local and remote: ",
+				logger.Println("portforwardConnectTCP: Error reading for remoteConn: ", err)
+				logger.Println("Address for local and remote: ",
 					remoteConn.LocalAddr(), remoteConn.RemoteAddr())
 				break
 			}
 
+			limiter.Wait(len(data))
 			_, err = localConn.Write(data)
 			if err != nil {
-				log.Println("portforwardConnectTCP: Error writing for localConn: ", err)
-				log.Println("Address for local and remote: ",
+				logger.Println("portforwardConnectTCP: Error writing for localConn: ", err)
+				logger.Println("Address for local and remote: ",
 					localConn.LocalAddr(), localConn.RemoteAddr())
 				break
 			}
@@ -678,16 +1966,25 @@ func portforwardConnectTCP(
 				bytesReceived.Add(int64(len(data)))
 			}
 		}
-		log.Println("portforwardConnectTCP: remote to local for loop is done. key: ", key)
-		closeConn <- true
+		logger.Println("portforwardConnectTCP: remote to local for loop is done. key: ", key)
 	}()
 
 	// If one connection breaks, close both
 	<-closeConn
 }
 
-func portforwardConnectWS(routerAddress string, message PortForwardMessage, localPort int,
-	cmdArgs args.CtrlArgs) {
+func portforwardConnectWS(
+	ctx context.Context,
+	actionType ActionType,
+	routerAddress string,
+	message PortForwardMessage,
+	localPort int,
+	cmdArgs args.CtrlArgs,
+	bandwidth int64,
+	enableTelemetry bool,
+	metricChan chan metrics.Metric,
+) {
+	logger := sessionLogger("forward", message.Key)
 	var remoteConn *websocket.Conn
 	var localConn *websocket.Conn
 	var err error
@@ -706,17 +2003,17 @@ func portforwardConnectWS(routerAddress string, message PortForwardMessage, loca
 		if err == nil {
 			break
 		}
-		time.Sleep(time.Second)
+		time.Sleep(common.BackoffWithJitter(i, cmdArgs.MaxReconnectBackoff))
 	}
 	if err != nil {
-		log.Println("portforwardConnectWS: error connecting to the router:", err)
+		logger.Println("portforwardConnectWS: error connecting to the router:", err)
 		return
 	}
 
 	defer remoteConn.Close()
 
-	localAddr := fmt.Sprintf("ws://127.0.0.1:%d%s", localPort, message.Payload["path"])
-	log.Println("portforwardConnectWS: localAddr", localAddr)
+	localAddr := fmt.Sprintf("ws://%s%s", taskAddress(localPort), message.Payload["path"])
+	logger.Println("portforwardConnectWS: localAddr", localAddr)
 	headers := http.Header{}
 	if headerMap, ok := message.Payload["headers"].(map[string]interface{}); ok {
 		for key, value := range headerMap {
@@ -725,33 +2022,71 @@ func portforwardConnectWS(routerAddress string, message PortForwardMessage, loca
 			}
 		}
 	}
+	// Services routing on the virtual host expect the local target instead of the address the
+	// client connected to. Headers are passed through unless the payload asks for a rewrite.
+	localHost := taskAddress(localPort)
+	if rewriteHost, _ := message.Payload["rewrite_host"].(bool); rewriteHost {
+		headers.Set("Host", localHost)
+	}
+	if rewriteOrigin, _ := message.Payload["rewrite_origin"].(bool); rewriteOrigin &&
+		headers.Get("Origin") != "" {
+		headers.Set("Origin", "http://"+localHost)
+	}
 
 	for i := 0; i < retryMax; i++ {
-		localConn, _, err = websocket.DefaultDialer.Dial(localAddr, headers)
+		localConn, _, err = websocketDialer.Dial(localAddr, headers)
 		if err == nil {
 			break
 		}
 		time.Sleep(time.Second)
 	}
 	if err != nil {
-		log.Println("portforwardConnectWS: error connecting to local server listening at port: ",
+		logger.Println("portforwardConnectWS: error connecting to local server listening at port: ",
 			localPort, err)
 		return
 	}
 	defer localConn.Close()
-	defer log.Println("Closing local and remote connections. key: ",
+	defer logger.Println("Closing local and remote connections. key: ",
 		message.Key, localConn.LocalAddr(), remoteConn.LocalAddr())
+	// Stop both copy loops on shutdown so they report their telemetry
+	defer closeOnShutdown(ctx, remoteConn, localConn)()
+
+	// Optional telemetry for each direction, typed <ACTION>_WS_OUTPUT and <ACTION>_WS_INPUT to
+	// tell websocket forwards apart from TCP forwards
+	copyWithTelemetry := func(dst, src *websocket.Conn, direction string) {
+		// Signalled after the telemetry is sent, so a drained forward has reported it
+		defer func() { closeConn <- true }()
+		var bytesCopied atomic.Int64
+		if enableTelemetry {
+			startTime := time.Now().Format("2006-01-02 15:04:05.000")
+			defer func() {
+				putPortforwardTelemetry(
+					metricChan,
+					strings.ToUpper(string(actionType))+"_WS_"+direction,
+					cmdArgs,
+					startTime,
+					bytesCopied.Load(),
+					bandwidth,
+					250*time.Millisecond,
+				)
+			}()
+		}
+		// Each direction has its own limiter
+		limiter := common.NewRateLimiter(bandwidth)
+		copyWebsocket(dst, src, logger, limiter, &bytesCopied)
+	}
 
-	log.Println("start coroutine")
-	go copyWebsocket(remoteConn, localConn, closeConn)
-	go copyWebsocket(localConn, remoteConn, closeConn)
+	logger.Println("start coroutine")
+	go copyWithTelemetry(remoteConn, localConn, "OUTPUT")
+	go copyWithTelemetry(localConn, remoteConn, "INPUT")
 
 	// If one connection breaks, close both
 	<-closeConn
 }
 
-func userPortForwardUDP(
-	routerAddress string, key string, cookie string, taskPort int, cmdArgs args.CtrlArgs) {
+func userPortForwardUDP(ctx context.Context, routerAddress string, key string, cookie string,
+	taskPort int, addressFamily bool, cmdArgs args.CtrlArgs) {
+	logger := sessionLogger("forward", key)
 	url := fmt.Sprintf(
 		"%s/api/router/portforward/%s/backend/%s", routerAddress, cmdArgs.Workflow, key)
 
@@ -764,71 +2099,213 @@ func userPortForwardUDP(
 		if err == nil {
 			break
 		}
-		time.Sleep(time.Second)
+		time.Sleep(common.BackoffWithJitter(i, cmdArgs.MaxReconnectBackoff))
 	}
 	if err != nil {
-		log.Println("userPortForwardUDP: error connecting to the router:", err)
+		logger.Println("userPortForwardUDP: error connecting to the router:", err)
 		return
 	}
 	defer conn.Close()
-
-	map_addr := make(map[string]net.Conn)
-	// Some services like Isaac-sim can not resolve "localhost"
-	localAddr := fmt.Sprintf("127.0.0.1:%d", taskPort)
+	// The flows are closed once the read loop stops
+	defer closeOnShutdown(ctx, conn)()
+
+	flows := &udpFlows{flows: make(map[string]*udpFlow), maxFlows: cmdArgs.MaxUDPFlows}
+	localAddr := taskAddress(taskPort)
+	if cmdArgs.UDPIdleTimeout > 0 {
+		stopEviction := make(chan bool)
+		defer close(stopEviction)
+		go func() {
+			ticker := time.NewTicker(cmdArgs.UDPIdleTimeout / 2)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-stopEviction:
+					return
+				case <-ticker.C:
+					flows.evictIdle(cmdArgs.UDPIdleTimeout, logger)
+				}
+			}
+		}()
+	}
 	for {
 		_, data, err := conn.ReadMessage()
 		if err != nil {
 			if err == io.EOF {
-				log.Println("userPortForwardUDP: EOF reached. for port ", taskPort)
+				logger.Println("userPortForwardUDP: EOF reached. for port ", taskPort)
 			} else {
-				log.Println(
+				logger.Println(
 					"userPortForwardUDP: Error reading remote connection with port", taskPort, err)
 			}
 			break
 		}
 
-		srcAddr := getSrcAddr(data)
-		if map_addr[srcAddr] == nil {
+		srcAddr, prefixLen, err := getSrcAddr(data, addressFamily)
+		if err != nil {
+			logger.Println("userPortForwardUDP: dropping datagram for port", taskPort, err)
+			continue
+		}
+		localConn := flows.get(srcAddr)
+		if localConn == nil {
 			// Create UDP transport
-			localConn, err := createConnection(localAddr, retryMax, "udp")
+			localConn, err = createConnection(localAddr, retryMax, "udp")
 			if err != nil {
-				log.Println("userPortForwardUDP: error connecting to local port:", taskPort, err)
+				logger.Println("userPortForwardUDP: error connecting to local port:", taskPort, err)
 				continue
 			}
-			map_addr[srcAddr] = localConn
+			flows.add(srcAddr, localConn, taskPort)
 			// Read from UDP transport
-			go readUDP(conn, &mutex, localConn, data[:6])
+			go func(srcAddr string, localConn net.Conn, header []byte) {
+				readUDP(conn, &mutex, localConn, header, func() {
+					flows.touch(srcAddr, localConn)
+				})
+				flows.remove(srcAddr, localConn)
+			}(srcAddr, localConn, data[:prefixLen])
 		}
 
 		// Write to UDP transport
-		_, err = map_addr[srcAddr].Write(data[6:])
+		_, err = localConn.Write(data[prefixLen:])
 		if err != nil {
-			log.Println("userPortForwardUDP: Error local write to local port: ", taskPort, err)
+			logger.Println("userPortForwardUDP: Error local write to local port: ", taskPort, err)
 			continue
 		}
 	}
 
 	// Close all transports
-	for _, localConn := range map_addr {
-		localConn.Close()
+	flows.closeAll()
+}
+
+// UDP flows of a port forward keyed by client source address. Once maxFlows flows are open, the
+// least recently used one is closed for each new flow. A maxFlows of 0 or less is unlimited.
+type udpFlows struct {
+	mutex    sync.Mutex
+	flows    map[string]*udpFlow
+	maxFlows int
+}
+
+type udpFlow struct {
+	conn     net.Conn
+	lastUsed time.Time
+}
+
+func (f *udpFlows) get(srcAddr string) net.Conn {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	flow, ok := f.flows[srcAddr]
+	if !ok {
+		return nil
+	}
+	flow.lastUsed = time.Now()
+	return flow.conn
+}
+
+func (f *udpFlows) add(srcAddr string, conn net.Conn, taskPort int) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.maxFlows > 0 && len(f.flows) >= f.maxFlows {
+		oldestAddr := ""
+		var oldest *udpFlow
+		for addr, flow := range f.flows {
+			if oldest == nil || flow.lastUsed.Before(oldest.lastUsed) {
+				oldestAddr, oldest = addr, flow
+			}
+		}
+		log.Printf("userPortForwardUDP: WARNING: %d flows to port %d are open, closing the "+
+			"least recently used flow from %s", len(f.flows), taskPort, oldestAddr)
+		// Closing the connection also stops its reader
+		oldest.conn.Close()
+		delete(f.flows, oldestAddr)
+	}
+	f.flows[srcAddr] = &udpFlow{conn: conn, lastUsed: time.Now()}
+}
+
+// touch marks the flow as used by a datagram from the task
+func (f *udpFlows) touch(srcAddr string, conn net.Conn) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if flow, ok := f.flows[srcAddr]; ok && flow.conn == conn {
+		flow.lastUsed = time.Now()
+	}
+}
+
+// evictIdle closes the flows no datagram went through in either direction for idleTimeout
+func (f *udpFlows) evictIdle(idleTimeout time.Duration, logger *log.Logger) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for srcAddr, flow := range f.flows {
+		if time.Since(flow.lastUsed) < idleTimeout {
+			continue
+		}
+		logger.Printf("userPortForwardUDP: closing flow from %s idle for %s", srcAddr,
+			idleTimeout)
+		// Closing the connection also stops its reader
+		flow.conn.Close()
+		delete(f.flows, srcAddr)
+	}
+}
+
+// remove forgets the flow when its reader stops, unless it was already replaced by a new flow
+func (f *udpFlows) remove(srcAddr string, conn net.Conn) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if flow, ok := f.flows[srcAddr]; ok && flow.conn == conn {
+		delete(f.flows, srcAddr)
+	}
+}
+
+func (f *udpFlows) closeAll() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for srcAddr, flow := range f.flows {
+		flow.conn.Close()
+		delete(f.flows, srcAddr)
 	}
 }
 
-func getSrcAddr(data []byte) string {
-	host := (net.IP)(data[:4])
-	var portData = []byte{0, 0, data[4], data[5]}
-	port := binary.BigEndian.Uint32(portData)
-	srcAddr := fmt.Sprintf("%s:%d", host.String(), port)
-	return srcAddr
+// Address families of the client address prefixed to forwarded UDP datagrams
+const (
+	udpFamilyIPv4 byte = 4
+	udpFamilyIPv6 byte = 6
+)
+
+// getSrcAddr decodes the client address prefixed to a forwarded UDP datagram. With
+// addressFamily, the prefix is the address family, the 4 or 16 byte address and the 2 byte port.
+// Clients that do not send the address family prefix a 4 byte IPv4 address and the port. It
+// returns the address as the flow key and the length of the prefix, which replies carry unchanged.
+func getSrcAddr(data []byte, addressFamily bool) (string, int, error) {
+	addrStart, addrLen := 0, net.IPv4len
+	if addressFamily {
+		if len(data) == 0 {
+			return "", 0, fmt.Errorf("empty datagram")
+		}
+		addrStart = 1
+		switch data[0] {
+		case udpFamilyIPv4:
+			addrLen = net.IPv4len
+		case udpFamilyIPv6:
+			addrLen = net.IPv6len
+		default:
+			return "", 0, fmt.Errorf("unknown address family %d", data[0])
+		}
+	}
+	prefixLen := addrStart + addrLen + 2
+	if len(data) < prefixLen {
+		return "", 0, fmt.Errorf("datagram of %d bytes is shorter than its address", len(data))
+	}
+	host := net.IP(data[addrStart : addrStart+addrLen])
+	port := binary.BigEndian.Uint16(data[addrStart+addrLen : prefixLen])
+	srcAddr := net.JoinHostPort(host.String(), strconv.Itoa(int(port)))
+	return srcAddr, prefixLen, nil
 }
 
+// readUDP forwards the datagrams from the task to the client, each prefixed with the address
+// prefix of the client's datagrams
 func readUDP(remoteConn *websocket.Conn, mutex *sync.Mutex,
-	localConn net.Conn, data []byte) {
+	localConn net.Conn, prefix []byte, onRead func()) {
 	buffer := make([]byte, BUFFERSIZE)
-	copy(buffer[:6], data[:6])
+	prefixLen := copy(buffer, prefix)
 
 	for {
-		n, err := localConn.Read(buffer[6:])
+		n, err := localConn.Read(buffer[prefixLen:])
 		if err != nil {
 			if err != io.EOF {
 				log.Println("readUDP: Error reading: ", err)
@@ -840,9 +2317,10 @@ func readUDP(remoteConn *websocket.Conn, mutex *sync.Mutex,
 			}
 			break
 		}
+		onRead()
 
 		mutex.Lock()
-		err = remoteConn.WriteMessage(websocket.BinaryMessage, buffer[:n+6])
+		err = remoteConn.WriteMessage(websocket.BinaryMessage, buffer[:n+prefixLen])
 		mutex.Unlock()
 		if err != nil {
 			log.Println("readUDP: Error write to websocket", err)
@@ -893,6 +2371,96 @@ func sendLogs(logSource string, logQueue *common.CircularBuffer, logsPeriodMs in
 	}
 }
 
+// How often the progress of each input and output is sent to the service. 0 disables it.
+var progressInterval time.Duration
+
+// Whether inputs mounted from a storage backend without a data credential fail before mounting
+var failOnMissingCredential bool
+
+// Latest progress message of each input and output that has not been sent yet
+var pendingProgress = map[string]string{}
+var progressMutex sync.Mutex
+
+// trackProgress records the progress of an input or output every progressInterval until the
+// returned function is called, which records the final progress
+func trackProgress(isInput bool, index int, identifier string, bytesTotal int64,
+	groupName string, taskName string) func() {
+	if progressInterval <= 0 {
+		return func() {}
+	}
+	id := fmt.Sprintf("output-%d", index)
+	if isInput {
+		id = fmt.Sprintf("input-%d", index)
+	}
+	record := func() {
+		bytesDone := data.TransferredBytes(isInput, index, groupName, taskName)
+		progressMutex.Lock()
+		pendingProgress[id] = messages.CreateProgress(id, identifier, bytesDone, bytesTotal)
+		progressMutex.Unlock()
+	}
+
+	stopChan := make(chan bool)
+	doneChan := make(chan bool)
+	go func() {
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopChan:
+				record()
+				close(doneChan)
+				return
+			case <-ticker.C:
+				record()
+			}
+		}
+	}()
+	return func() {
+		stopChan <- true
+		<-doneChan
+	}
+}
+
+// flushProgress sends the pending progress messages. Progress does not go through the log queue,
+// so updates never displace logs and only the latest update of each input and output is sent.
+func flushProgress() {
+	if data.GetWebsocketConnection().IsBroken {
+		return
+	}
+	progressMutex.Lock()
+	updates := pendingProgress
+	pendingProgress = map[string]string{}
+	progressMutex.Unlock()
+
+	// Websocket writes are serialized with the log sender
+	bufferMutex.Lock()
+	defer bufferMutex.Unlock()
+	for id, update := range updates {
+		if err := messages.Put(webConn, update); err != nil {
+			log.Println("Failed to send progress message:", err)
+			progressMutex.Lock()
+			if _, hasNewer := pendingProgress[id]; !hasNewer {
+				pendingProgress[id] = update
+			}
+			progressMutex.Unlock()
+		}
+	}
+}
+
+func sendProgress() {
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		flushProgress()
+	}
+}
+
+func setWebsocketBroken(isBroken bool) {
+	data.UpdateWebsocketConnection(func(connection *data.WebsocketConnectionInfo) {
+		connection.IsBroken = isBroken
+	})
+}
+
 // Keeps websocket connection alive and catch any errors from the server
 func pingPang(timeout time.Duration, url string, osmoChan chan string, startExecChan chan bool,
 	restartChan chan bool, metricChan chan metrics.Metric,
@@ -908,7 +2476,9 @@ func pingPang(timeout time.Duration, url string, osmoChan chan string, startExec
 				webConn.WriteControl(websocket.CloseMessage, nil, time.Now().Add(time.Second))
 				webConn.Close()
 				log.Println("Connection lost, trying to reconnect...")
-				data.WebsocketConnection.DisconnectStartTime = time.Now()
+				data.UpdateWebsocketConnection(func(connection *data.WebsocketConnectionInfo) {
+					connection.DisconnectStartTime = time.Now()
+				})
 			}
 
 			count++
@@ -927,22 +2497,23 @@ func pingPang(timeout time.Duration, url string, osmoChan chan string, startExec
 			osmoChan <- "Websocket Connection: " + strconv.Itoa(count)
 			count = 0
 
-			data.WebsocketConnection.IsBroken = false
+			setWebsocketBroken(false)
 		}
 
 		err := webConn.WriteControl(websocket.PingMessage, nil, time.Now().Add(timeout))
 		if err != nil {
 			log.Println("Failed to send ping:", err)
-			data.WebsocketConnection.IsBroken = true
+			setWebsocketBroken(true)
 			continue
 		}
 
 		messageType, message, err := webConn.ReadMessage()
 		if err != nil {
 			log.Println("Failed to get message:", err)
-			data.WebsocketConnection.IsBroken = true
+			setWebsocketBroken(true)
 			continue
 		}
+		protocolLog.record(ProtocolWebsocket, ProtocolReceived, message)
 		switch messageType {
 		case websocket.TextMessage:
 			var serviceInfo ServiceRequest
@@ -965,40 +2536,47 @@ func pingPang(timeout time.Duration, url string, osmoChan chan string, startExec
 			}
 			if clientInfo.Action == ActionExec {
 				log.Printf("Receive exec action")
-				err := sendUserExecStart(unixConn, clientInfo.EntryCommand)
-				if err != nil {
-					log.Println("Error sending user exec start request", err)
-					continue
-				}
-				unixListener := listener.(*net.UnixListener)
-				unixListener.SetDeadline(time.Now().Add(cmdArgs.ExecTimeout))
-				execConn, err := listener.Accept()
-				if err != nil {
-					log.Println("Error connect to user terminal", err)
-					continue
+				if !userRestart.inProgress() {
+					startUserExec(unixConn, listener, clientInfo, cmdArgs)
+				} else if cmdArgs.ExecDuringRestart == args.ExecDuringRestartWait {
+					log.Println("Exec session waits for the restart of the user command")
+					go func() {
+						if !userRestart.wait(cmdArgs.ExecTimeout) {
+							rejectUserExec(clientInfo.RouterAddress, clientInfo.Key,
+								clientInfo.Cookie, fmt.Sprintf("Exec session timed out after %s "+
+									"waiting for the task command to restart, please retry.",
+									cmdArgs.ExecTimeout), cmdArgs)
+							return
+						}
+						startUserExec(unixConn, listener, clientInfo, cmdArgs)
+					}()
+				} else {
+					log.Println("Reject exec action during the restart of the user command")
+					go rejectUserExec(clientInfo.RouterAddress, clientInfo.Key, clientInfo.Cookie,
+						"The task command is restarting, please try again shortly.", cmdArgs)
 				}
-				go ctrlUserExec(execConn, clientInfo.RouterAddress, clientInfo.Key,
-					clientInfo.Cookie, cmdArgs)
 			} else if clientInfo.Action == ActionPortForward {
 				log.Printf("Receive portforward action")
 				if clientInfo.UseUDP {
-					go userPortForwardUDP(
-						clientInfo.RouterAddress, clientInfo.Key,
-						clientInfo.Cookie, clientInfo.TaskPort, cmdArgs)
+					portForwards.run(func(ctx context.Context) {
+						userPortForwardUDP(ctx, clientInfo.RouterAddress, clientInfo.Key,
+							clientInfo.Cookie, clientInfo.TaskPort, clientInfo.UDPAddressFamily,
+							cmdArgs)
+					})
 				} else {
-					go userPortForwardTCP(clientInfo.RouterAddress, clientInfo, cmdArgs, metricChan)
+					portForwards.run(func(ctx context.Context) {
+						userPortForwardTCP(ctx, clientInfo.RouterAddress, clientInfo, cmdArgs,
+							metricChan)
+					})
 				}
 			} else if clientInfo.Action == ActionWebServer {
-				go userPortForwardTCP(clientInfo.RouterAddress, clientInfo, cmdArgs, metricChan)
+				portForwards.run(func(ctx context.Context) {
+					userPortForwardTCP(ctx, clientInfo.RouterAddress, clientInfo, cmdArgs,
+						metricChan)
+				})
 			} else if clientInfo.Action == ActionBarrier {
 				log.Printf("Receive barrier action")
-				barrierMutex.Lock()
-				localBarrierReq := barrierReq
-				barrierReq = ""
-				barrierMutex.Unlock()
-				if localBarrierReq != "" {
-					startExecChan <- true
-				}
+				releaseBarrier(startExecChan)
 			} else if clientInfo.Action == ActionRestart {
 				osmoChan <- "Receive restart action"
 				barrierMutex.Lock()
@@ -1008,19 +2586,33 @@ func pingPang(timeout time.Duration, url string, osmoChan chan string, startExec
 					log.Println("Skip restart action")
 					continue
 				}
-				go restartExec(osmoChan, startExecChan, restartChan, unixConn, cmdArgs, logQueue)
+				if !userRestart.begin() {
+					log.Println("Skip restart action, a restart is in progress")
+					continue
+				}
+				go func() {
+					defer userRestart.end()
+					restartExec(osmoChan, startExecChan, restartChan, unixConn, cmdArgs, logQueue,
+						metricChan, clientInfo.Reason)
+				}()
 			} else if clientInfo.Action == ActionRsync {
 				osmoChan <- "Receive rsync action"
 				if !rsyncStatus.IsRunning() {
-					log.Println("User Rsync is not running/ready for connection")
+					osmoChan <- "User Rsync is not ready for connection: " +
+						rsyncStatus.Describe()
 					continue
 				}
 
-				if clientInfo.TaskPort != int(common.RsyncPort) {
-					clientInfo.TaskPort = int(common.RsyncPort)
-				}
+				// Forward to the port rsync reported, which may have been selected at startup
+				clientInfo.TaskPort = rsyncStatus.Port()
 
-				go userPortForwardTCP(clientInfo.RouterAddress, clientInfo, cmdArgs, metricChan)
+				portForwards.run(func(ctx context.Context) {
+					userPortForwardTCP(ctx, clientInfo.RouterAddress, clientInfo, cmdArgs,
+						metricChan)
+				})
+			} else if clientInfo.Action == ActionStreamLogs {
+				log.Printf("Receive stream logs action: %t", clientInfo.Enabled)
+				streamExecLogs.Store(clientInfo.Enabled)
 			}
 		}
 	}
@@ -1028,24 +2620,43 @@ func pingPang(timeout time.Duration, url string, osmoChan chan string, startExec
 
 // Wait until barrier has been met to restart user command
 func restartExec(osmoChan chan string, startExecChan chan bool, restartChan chan bool,
-	unixConn net.Conn, cmdArgs args.CtrlArgs, logQueue *common.CircularBuffer) {
+	unixConn net.Conn, cmdArgs args.CtrlArgs, logQueue *common.CircularBuffer,
+	metricChan chan metrics.Metric, reason string) {
 
-	err := json.NewEncoder(unixConn).Encode(messages.UserStopRequest())
+	err := sendUnixRequest(unixConn, messages.UserStopRequest())
 	if err != nil {
 		osmoChan <- "Failed to send stop request"
 		return
 	}
 	<-restartChan
 
+	barrierStartTime := time.Now()
 	if cmdArgs.Barrier != "" {
-		barrier(osmoChan, startExecChan, cmdArgs.Barrier, logQueue)
+		barrier(osmoChan, startExecChan, cmdArgs.Barrier, logQueue, metricChan,
+			cmdArgs.RetryId, cmdArgs.GroupName, cmdArgs.LogSource)
 	}
+	barrierWait := time.Since(barrierStartTime)
 
-	err = json.NewEncoder(unixConn).Encode(messages.UserStartRequest())
+	err = sendUnixRequest(unixConn, messages.UserStartRequest())
 	if err != nil {
 		osmo_errors.SetExitCode(osmo_errors.UNIX_MESSAGE_FAILED_CODE)
 		panic(fmt.Sprintf("Failed to send request: %v\n", err))
 	}
+
+	if reason == "" {
+		reason = "requested by the service"
+	}
+	count := int(restartCount.Add(1))
+	osmoChan <- fmt.Sprintf("Restart #%d: %s", count, reason)
+	metricChan <- metrics.TaskRestartEvent{
+		RetryId:            cmdArgs.RetryId,
+		GroupName:          cmdArgs.GroupName,
+		TaskName:           cmdArgs.LogSource,
+		RestartCount:       count,
+		Reason:             reason,
+		Time:               time.Now().Format("2006-01-02 15:04:05.000"),
+		BarrierWaitSeconds: barrierWait.Seconds(),
+	}
 }
 
 func copyFile(src string, dest string) {
@@ -1060,17 +2671,242 @@ func copyFile(src string, dest string) {
 		osmo_errors.SetExitCode(osmo_errors.FILE_FAILED_CODE)
 		panic(fmt.Sprintf("Failed to create file %s: %s", dest, err))
 	}
-	defer destFile.Close()
-	if _, err = io.Copy(destFile, srcFile); err != nil {
-		osmo_errors.SetExitCode(osmo_errors.FILE_FAILED_CODE)
-		panic(fmt.Sprintf("Copy from %s to %s failed: %s", src, dest, err))
+	defer destFile.Close()
+	if _, err = io.Copy(destFile, srcFile); err != nil {
+		osmo_errors.SetExitCode(osmo_errors.FILE_FAILED_CODE)
+		panic(fmt.Sprintf("Copy from %s to %s failed: %s", src, dest, err))
+	}
+}
+
+// Emit a structured event for an input/output state transition
+func putTaskIOEvent(metricChan chan metrics.Metric, event string, identifier string, index int,
+	startTime time.Time, retryId string, groupName string, taskName string, reason string) {
+	metricChan <- metrics.TaskIOEvent{
+		RetryId:         retryId,
+		GroupName:       groupName,
+		TaskName:        taskName,
+		Event:           event,
+		Identifier:      identifier,
+		Index:           index,
+		Time:            time.Now().Format("2006-01-02 15:04:05.000"),
+		DurationSeconds: time.Since(startTime).Seconds(),
+		Reason:          reason,
+	}
+}
+
+// Report benchmark files of an input or output that could not be parsed, since its transfer
+// metrics undercount what was transferred
+func reportBenchmarkFailures(osmoChan chan string, metricChan chan metrics.Metric,
+	failures []string, identifier string, retryId string, groupName string, taskName string) {
+	if len(failures) == 0 {
+		return
+	}
+	osmoChan <- fmt.Sprintf("WARNING: %d benchmark file(s) for %s could not be parsed, "+
+		"transfer metrics are incomplete", len(failures), identifier)
+	metricChan <- metrics.BenchmarkFailureMetrics{
+		RetryId:    retryId,
+		GroupName:  groupName,
+		TaskName:   taskName,
+		Identifier: identifier,
+		Files:      failures,
+	}
+}
+
+func readCredentialConfig(configPath string) (data.ConfigInfo, error) {
+	var configFile data.ConfigInfo
+	yfile, err := os.ReadFile(configPath)
+	if err != nil {
+		return configFile, fmt.Errorf("Cannot open config file: %s", err.Error())
+	}
+	err = yaml.Unmarshal(yfile, &configFile)
+	if err != nil {
+		return configFile, fmt.Errorf("Cannot read config file: %s", err.Error())
+	}
+	return configFile, nil
+}
+
+// Returns the data credentials of a config file, reading the file on first use
+func getCredentialConfig(configPath string) (data.ConfigInfo, error) {
+	credentialMutex.RLock()
+	configFile, ok := credentialConfigs[configPath]
+	credentialMutex.RUnlock()
+	if ok {
+		return configFile, nil
+	}
+
+	configFile, err := readCredentialConfig(configPath)
+	if err != nil {
+		return configFile, err
+	}
+	credentialMutex.Lock()
+	credentialConfigs[configPath] = configFile
+	credentialMutex.Unlock()
+	return configFile, nil
+}
+
+// Re-read every config file already in use. Transfers in flight keep the credentials they
+// started with, and a config file that fails to load keeps its previous credentials.
+func reloadCredentialConfigs(osmoChan chan string) {
+	credentialMutex.Lock()
+	for configPath := range credentialConfigs {
+		configFile, err := readCredentialConfig(configPath)
+		if err != nil {
+			log.Printf("Failed to reload credentials from %s: %s", configPath, err)
+			continue
+		}
+		credentialConfigs[configPath] = configFile
+		log.Printf("Reloaded credentials from %s", configPath)
+	}
+	credentialMutex.Unlock()
+	osmoChan <- "Reloaded data credentials"
+}
+
+// Create a config directory for a single input or output, so transfers running at the same time
+// do not overwrite each other's config. The other files of the config directory, such as the
+// login, are linked so they stay shared with ctrl.
+func createTransferConfigDir(configSource string, configLoc string) string {
+	configDir, err := os.MkdirTemp("", "osmo-transfer-config-")
+	if err != nil {
+		osmo_errors.SetExitCode(osmo_errors.FILE_FAILED_CODE)
+		panic(fmt.Sprintf("Failed to create transfer config directory: %s", err))
+	}
+	sharedDir := filepath.Dir(configLoc)
+	entries, err := os.ReadDir(sharedDir)
+	if err != nil {
+		log.Printf("Failed to read config directory %s: %s", sharedDir, err)
+	}
+	for _, entry := range entries {
+		if entry.Name() == filepath.Base(configLoc) {
+			continue
+		}
+		if err := os.Symlink(filepath.Join(sharedDir, entry.Name()),
+			filepath.Join(configDir, entry.Name())); err != nil {
+			log.Printf("Failed to link %s into transfer config directory: %s", entry.Name(), err)
+		}
+	}
+	copyFile(configSource, filepath.Join(configDir, filepath.Base(configLoc)))
+	return configDir
+}
+
+// transferLog holds the logs of an input or output transferred at the same time as others, so
+// that they can be forwarded in order
+type transferLog struct {
+	mutex  sync.Mutex
+	lines  []string
+	closed bool
+	notify chan struct{}
+}
+
+// Collect the logs sent to logChan until it is closed
+func newTransferLog(logChan chan string) *transferLog {
+	transferLog := &transferLog{notify: make(chan struct{}, 1)}
+	go func() {
+		for line := range logChan {
+			transferLog.mutex.Lock()
+			transferLog.lines = append(transferLog.lines, line)
+			transferLog.mutex.Unlock()
+			transferLog.signal()
+		}
+		transferLog.mutex.Lock()
+		transferLog.closed = true
+		transferLog.mutex.Unlock()
+		transferLog.signal()
+	}()
+	return transferLog
+}
+
+func (l *transferLog) signal() {
+	select {
+	case l.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Send the held logs to osmoChan, then the new ones as they arrive until the transfer is finished
+func (l *transferLog) forward(osmoChan chan string) {
+	for {
+		l.mutex.Lock()
+		lines, closed := l.lines, l.closed
+		l.lines = nil
+		l.mutex.Unlock()
+		for _, line := range lines {
+			osmoChan <- line
+		}
+		if closed {
+			return
+		}
+		<-l.notify
+	}
+}
+
+// Run transfer for positions 0 to count-1 with the given number of workers. The logs of each
+// transfer are forwarded to osmoChan in position order. The first failure stops new transfers
+// from starting and is raised once the transfers already started have finished.
+func runTransfers(count int, workers int, osmoChan chan string,
+	transfer func(position int, osmoChan chan string)) {
+	if workers <= 1 {
+		for position := range count {
+			transfer(position, osmoChan)
+		}
+		return
+	}
+
+	logChans := make([]chan string, count)
+	transferLogs := make([]*transferLog, count)
+	for position := range count {
+		logChans[position] = make(chan string)
+		transferLogs[position] = newTransferLog(logChans[position])
+	}
+
+	var failure any
+	var failureOnce sync.Once
+	var failed atomic.Bool
+	positions := make(chan int)
+	var workersDone sync.WaitGroup
+	for range workers {
+		workersDone.Add(1)
+		go func() {
+			defer workersDone.Done()
+			for position := range positions {
+				func() {
+					defer close(logChans[position])
+					defer func() {
+						if r := recover(); r != nil {
+							failureOnce.Do(func() { failure = r })
+							failed.Store(true)
+						}
+					}()
+					transfer(position, logChans[position])
+				}()
+			}
+		}()
+	}
+	go func() {
+		defer close(positions)
+		for position := range count {
+			if failed.Load() {
+				for _, logChan := range logChans[position:] {
+					close(logChan)
+				}
+				return
+			}
+			positions <- position
+		}
+	}()
+
+	for _, transferLog := range transferLogs {
+		transferLog.forward(osmoChan)
+	}
+	workersDone.Wait()
+	if failure != nil {
+		panic(failure)
 	}
 }
 
 func downloadInputs(c net.Conn, inputs common.ArrayFlags, inputPath string,
 	downloadType string, osmoChan chan string, metricChan chan metrics.Metric, retryId string,
 	groupName string, taskName string, userConfig string, serviceConfig string, configLoc string,
-	cacheSize int) {
+	cacheSize int, parallelism int) {
 
 	inputType := "Mounting"
 	if downloadType == data.Download {
@@ -1085,9 +2921,20 @@ func downloadInputs(c net.Conn, inputs common.ArrayFlags, inputPath string,
 		}
 	}
 	osmoChan <- inputType + " Start"
+	startTime := time.Now()
 
-	numInputs := len(inputs)
+	var pending []int
 	for inputIndex, line := range inputs {
+		if data.IsInputCompleted(inputIndex, line) {
+			log.Printf("Skipping completed input %s", line)
+			continue
+		}
+		pending = append(pending, inputIndex)
+	}
+	workers := min(parallelism, len(pending))
+
+	mountInput := func(inputIndex int, osmoChan chan string) {
+		line := inputs[inputIndex]
 		log.Printf("%s %s", inputType, line)
 		osmoChan <- inputType + " " + data.ParseInputOutput(line).GetLogInfo()
 		inputType := data.ParseInputOutput(line)
@@ -1096,41 +2943,207 @@ func downloadInputs(c net.Conn, inputs common.ArrayFlags, inputPath string,
 			osmo_errors.SetExitCode(osmo_errors.INVALID_INPUT_CODE)
 			panic("Incorrect Input: Output Received")
 		}
+		configSource := userConfig
 		if _, isTypeTask := inputInfo.(data.TaskInput); isTypeTask {
-			copyFile(serviceConfig, configLoc)
-		} else {
-			copyFile(userConfig, configLoc)
+			configSource = serviceConfig
 		}
 
 		// Open data config file
-		yfile, err := os.ReadFile(configLoc)
+		configFile, err := getCredentialConfig(configSource)
 		if err != nil {
 			osmo_errors.SetExitCode(osmo_errors.DOWNLOAD_FAILED_CODE)
-			panic(fmt.Sprintf("Cannot open config file: %s", err.Error()))
+			panic(err.Error())
+		}
+		if workers > 1 {
+			configFile.ConfigDir = createTransferConfigDir(configSource, configLoc)
+			defer os.RemoveAll(configFile.ConfigDir)
+		} else {
+			copyFile(configSource, configLoc)
 		}
 
-		var configFile data.ConfigInfo
-		err = yaml.Unmarshal(yfile, &configFile)
-		if err != nil {
-			osmo_errors.SetExitCode(osmo_errors.DOWNLOAD_FAILED_CODE)
-			panic(fmt.Sprintf("Cannot read config file: %s", err.Error()))
+		identifier := inputType.GetLogInfo()
+		ioStartTime := time.Now()
+		putTaskIOEvent(metricChan, metrics.InputStarted, identifier, inputIndex, ioStartTime,
+			retryId, groupName, taskName, "")
+		var benchmarkFailures []string
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					putTaskIOEvent(metricChan, metrics.InputFailed, identifier, inputIndex,
+						ioStartTime, retryId, groupName, taskName, fmt.Sprint(r))
+					panic(r)
+				}
+			}()
+			defer trackProgress(true, inputIndex, identifier, 0, groupName, taskName)()
+			benchmarkFailures = inputInfo.CreateMount(c, inputPath, configFile, osmoChan,
+				metricChan, retryId, groupName, taskName, downloadType, inputIndex,
+				cacheSize/max(workers, 1))
+		}()
+		completedEvent := metrics.InputMounted
+		if downloadType == data.Download {
+			completedEvent = metrics.InputDownloaded
 		}
+		putTaskIOEvent(metricChan, completedEvent, identifier, inputIndex, ioStartTime,
+			retryId, groupName, taskName, "")
+		reportBenchmarkFailures(osmoChan, metricChan, benchmarkFailures, identifier, retryId,
+			groupName, taskName)
+		data.MarkInputCompleted(inputIndex, line)
+	}
 
-		inputInfo.CreateMount(c, inputPath, configFile, osmoChan,
-			metricChan, retryId, groupName, taskName, downloadType, inputIndex,
-			cacheSize/numInputs)
+	if workers > 1 {
+		osmoChan <- fmt.Sprintf("%s %d inputs, %d at a time", inputType, len(pending), workers)
 	}
+	runTransfers(len(pending), workers, osmoChan, func(position int, osmoChan chan string) {
+		mountInput(pending[position], osmoChan)
+	})
 	log.Println("All Inputs Gathered")
+	osmoChan <- fmt.Sprintf("%s finished for %d inputs in %s", inputType, len(pending),
+		time.Since(startTime).Round(time.Millisecond))
 	osmoChan <- "All Inputs Gathered"
 }
 
+// Failures that may affect every input at once, such as a network partition or credentials that
+// are briefly invalid, rather than a problem with a single input spec
+func isPhaseRetryable(code osmo_errors.ExitCode) bool {
+	switch code {
+	case osmo_errors.DOWNLOAD_FAILED_CODE, osmo_errors.MOUNT_FAILED_CODE,
+		osmo_errors.DATA_AUTH_CHECK_FAILED_CODE, osmo_errors.DATA_UNAUTHORIZED_CODE:
+		return true
+	}
+	return false
+}
+
+// checkInputFolders finds inputs that are written to the same folder, which would merge their
+// contents. The task fails unless warnOnly is set, in which case the collision is only reported.
+func checkInputFolders(inputs common.ArrayFlags, warnOnly bool, osmoChan chan string) {
+	folderInputs := make(map[string][]string)
+	var folders []string
+	for _, line := range inputs {
+		inputInfo, isTypeInput := data.ParseInputOutput(line).(data.InputType)
+		if !isTypeInput {
+			continue
+		}
+		folder := filepath.Clean(inputInfo.GetFolder())
+		if _, exists := folderInputs[folder]; !exists {
+			folders = append(folders, folder)
+		}
+		folderInputs[folder] = append(folderInputs[folder], line)
+	}
+
+	var collisions []string
+	for _, folder := range folders {
+		if len(folderInputs[folder]) > 1 {
+			collisions = append(collisions, fmt.Sprintf("%s: %s", folder,
+				strings.Join(folderInputs[folder], ", ")))
+		}
+	}
+	if len(collisions) == 0 {
+		return
+	}
+
+	errorMsg := "Multiple inputs are written to the same folder: " + strings.Join(collisions, "; ")
+	if !warnOnly {
+		osmo_errors.SetExitCode(osmo_errors.INVALID_INPUT_CODE)
+		panic(errorMsg)
+	}
+	log.Println(errorMsg)
+	osmoChan <- "WARNING: " + errorMsg
+}
+
+// checkMountCredentials fails the task when an input to be mounted has no credential in its data
+// config. The check runs once before the download phase, since retrying cannot fix the config.
+func checkMountCredentials(inputs common.ArrayFlags, downloadType string, userConfig string,
+	serviceConfig string) {
+	if downloadType == data.Download || !failOnMissingCredential {
+		return
+	}
+	for _, line := range inputs {
+		input := data.ParseInputOutput(line)
+		inputInfo, isTypeInput := input.(data.InputType)
+		if !isTypeInput {
+			continue
+		}
+		configSource := userConfig
+		if _, isTypeTask := inputInfo.(data.TaskInput); isTypeTask {
+			configSource = serviceConfig
+		}
+		// A config file that cannot be read fails the mount itself
+		configFile, err := getCredentialConfig(configSource)
+		if err != nil {
+			continue
+		}
+		if err := data.CheckMountCredential(inputInfo, configFile); err != nil {
+			osmo_errors.SetExitCode(osmo_errors.DATA_AUTH_CHECK_FAILED_CODE)
+			panic(fmt.Sprintf("Cannot mount %s from %s: %s", input.GetLogInfo(),
+				configSource, err))
+		}
+	}
+}
+
+// Run the download phase, retrying the whole phase with exponential backoff on systemic
+// failures. Inputs completed by an earlier attempt are not downloaded again.
+func downloadInputsWithRetry(c net.Conn, cmdArgs args.CtrlArgs, osmoChan chan string,
+	metricChan chan metrics.Metric) {
+	checkInputFolders(cmdArgs.Inputs, cmdArgs.AllowDuplicateInputFolders, osmoChan)
+	checkMountCredentials(cmdArgs.Inputs, cmdArgs.DownloadType, cmdArgs.UserConfig,
+		cmdArgs.ServiceConfig)
+	data.ClearInputMarkers()
+	defer data.ClearInputMarkers()
+
+	backoff := cmdArgs.DownloadBackoff
+	for attempt := 0; ; attempt++ {
+		previousCode := osmo_errors.GetExitCode()
+		retry := func() (retry bool) {
+			defer func() {
+				if r := recover(); r != nil {
+					if attempt >= cmdArgs.DownloadRetries ||
+						!isPhaseRetryable(osmo_errors.GetExitCode()) || !common.TakeRetry() {
+						panic(r)
+					}
+					log.Printf("Download phase failed: %v", r)
+					osmoChan <- fmt.Sprintf("Download phase failed, retrying in %s (%d/%d)",
+						backoff, attempt+1, cmdArgs.DownloadRetries)
+					retry = true
+				}
+			}()
+			downloadInputs(c, cmdArgs.Inputs, cmdArgs.InputPath,
+				cmdArgs.DownloadType, osmoChan, metricChan, cmdArgs.RetryId, cmdArgs.GroupName,
+				cmdArgs.LogSource, cmdArgs.UserConfig, cmdArgs.ServiceConfig, cmdArgs.ConfigLoc,
+				cmdArgs.CacheSize, cmdArgs.InputParallelism)
+			return false
+		}()
+		if !retry {
+			return
+		}
+
+		// The failure is being retried, so it should not be reported on exit
+		osmo_errors.SetExitCode(previousCode)
+		osmo_errors.SetFailureDetails(nil)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
 func uploadOutputs(c net.Conn, outputs common.ArrayFlags,
 	outputPath string, metadataFile string, osmoChan chan string,
 	metricChan chan metrics.Metric, retryId string, groupName string,
-	taskName string, userConfig string, serviceConfig string, configLoc string) {
+	taskName string, userConfig string, serviceConfig string, configLoc string,
+	strictOutputs bool, parallelism int) {
 
 	osmoChan <- "Upload Start"
 
+	if _, err := os.Stat(outputPath); errors.Is(err, os.ErrNotExist) && len(outputs) > 0 {
+		errorMsg := fmt.Sprintf("Output folder %s does not exist, the task may have deleted "+
+			"it or never created it", outputPath)
+		if strictOutputs {
+			osmo_errors.SetExitCode(osmo_errors.UPLOAD_FAILED_CODE)
+			panic(errorMsg)
+		}
+		log.Println(errorMsg)
+		osmoChan <- "ERROR: " + errorMsg
+		return
+	}
+
 	isEmpty, err := common.IsDirEmpty(outputPath)
 	if err != nil {
 		log.Println(err)
@@ -1141,7 +3154,39 @@ func uploadOutputs(c net.Conn, outputs common.ArrayFlags,
 		return
 	}
 
-	for outputIndex, line := range outputs {
+	parsedOutputs := make([]data.InputOutput, 0, len(outputs))
+	for _, line := range outputs {
+		output := data.ParseInputOutput(line)
+		if err := data.ValidateOutputFiles(output, outputPath, metadataFile); err != nil {
+			osmo_errors.SetExitCode(osmo_errors.UPLOAD_FAILED_CODE)
+			panic(err.Error())
+		}
+		parsedOutputs = append(parsedOutputs, output)
+	}
+	outputBytes, outputSizes := data.OutputsSize(parsedOutputs, outputPath, osmoChan)
+	metricChan <- metrics.OutputSizeMetrics{
+		RetryId:     retryId,
+		GroupName:   groupName,
+		TaskName:    taskName,
+		Time:        time.Now().Format("2006-01-02 15:04:05.000"),
+		SizeInBytes: outputBytes,
+		MaxBytes:    maxOutputBytes,
+	}
+	if maxOutputBytes > 0 && outputBytes > maxOutputBytes {
+		errorMsg := fmt.Sprintf("Outputs are %d bytes, which exceeds the limit of %d bytes",
+			outputBytes, maxOutputBytes)
+		osmoChan <- "ERROR: " + errorMsg
+		osmo_errors.SetExitCode(osmo_errors.OUTPUT_SIZE_EXCEEDED_CODE)
+		panic(errorMsg)
+	}
+
+	startTime := time.Now()
+	workers := min(parallelism, len(outputs))
+	if workers > 1 {
+		osmoChan <- fmt.Sprintf("Uploading %d outputs, %d at a time", len(outputs), workers)
+	}
+	runTransfers(len(outputs), workers, osmoChan, func(outputIndex int, osmoChan chan string) {
+		line := outputs[outputIndex]
 		outputType := data.ParseInputOutput(line)
 		log.Printf("Uploading %s", line)
 		osmoChan <- "Uploading " + outputType.GetLogInfo()
@@ -1152,45 +3197,85 @@ func uploadOutputs(c net.Conn, outputs common.ArrayFlags,
 			panic("Incorrect Output: Input Received")
 		}
 
+		configSource := userConfig
 		_, isTypeTask := outputInfo.(*data.TaskOutput)
 		_, isTypeKpi := outputInfo.(*data.KpiOutput)
 		if isTypeTask || isTypeKpi {
-			copyFile(serviceConfig, configLoc)
+			configSource = serviceConfig
+		}
+		configDir := ""
+		if workers > 1 {
+			configDir = createTransferConfigDir(configSource, configLoc)
+			defer os.RemoveAll(configDir)
 		} else {
-			copyFile(userConfig, configLoc)
+			copyFile(configSource, configLoc)
 		}
 
-		// TODO: Make each if statement a generalized function in outputInfo
-		// Set the metadata file for datasets
-		if datasetInfo, isTypeDataset := outputInfo.(*data.DatasetOutput); isTypeDataset {
-			datasetInfo.MetadataFile = metadataFile
-			datasetInfo.UploadFolder(c, outputPath, osmoChan, metricChan, retryId, groupName,
-				taskName, outputType.GetUrlIdentifier(), outputIndex)
-
-		} else if updateDatasetInfo, isTypeUpdateDataset :=
-			outputInfo.(*data.UpdateDatasetOutput); isTypeUpdateDataset {
-
-			updateDatasetInfo.MetadataFile = metadataFile
-			updateDatasetInfo.UploadFolder(c, outputPath, osmoChan, metricChan, retryId, groupName,
-				taskName, outputType.GetUrlIdentifier(), outputIndex)
-
-		} else if kpiInfo, isTypeKpi := outputInfo.(*data.KpiOutput); isTypeKpi {
-			kpiPath := outputPath + kpiInfo.Path
-			if _, err := os.Stat(kpiPath); errors.Is(err, os.ErrNotExist) {
-				osmoChan <- fmt.Sprintf("KPI file: %s does not exist", kpiPath)
-			} else {
-				// kpi file exists
-				outputInfo.UploadFolder(c, outputPath, osmoChan, metricChan, retryId, groupName,
-					taskName, outputType.GetUrlIdentifier(), outputIndex)
-			}
+		identifier := outputType.GetLogInfo()
+		ioStartTime := time.Now()
+		putTaskIOEvent(metricChan, metrics.OutputStarted, identifier, outputIndex, ioStartTime,
+			retryId, groupName, taskName, "")
+		var benchmarkFailures []string
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					putTaskIOEvent(metricChan, metrics.OutputFailed, identifier, outputIndex,
+						ioStartTime, retryId, groupName, taskName, fmt.Sprint(r))
+					panic(r)
+				}
+			}()
+			defer trackProgress(false, outputIndex, identifier, outputSizes[outputIndex],
+				groupName, taskName)()
+			benchmarkFailures = uploadOutput(c, outputInfo, outputType, outputPath,
+				metadataFile, osmoChan, metricChan, retryId, groupName, taskName, outputIndex,
+				configDir)
+		}()
+		putTaskIOEvent(metricChan, metrics.OutputUploaded, identifier, outputIndex, ioStartTime,
+			retryId, groupName, taskName, "")
+		reportBenchmarkFailures(osmoChan, metricChan, benchmarkFailures, identifier, retryId,
+			groupName, taskName)
+	})
+
+	osmoChan <- fmt.Sprintf("Upload finished for %d outputs in %s", len(outputs),
+		time.Since(startTime).Round(time.Millisecond))
+	osmoChan <- "All Outputs Uploaded"
+}
 
+func uploadOutput(c net.Conn, outputInfo data.OutputType, outputType data.InputOutput,
+	outputPath string, metadataFile string, osmoChan chan string,
+	metricChan chan metrics.Metric, retryId string, groupName string, taskName string,
+	outputIndex int, configDir string) (benchmarkFailures []string) {
+
+	// TODO: Make each if statement a generalized function in outputInfo
+	// Set the metadata file for datasets
+	if datasetInfo, isTypeDataset := outputInfo.(*data.DatasetOutput); isTypeDataset {
+		datasetInfo.MetadataFile = metadataFile
+		benchmarkFailures = datasetInfo.UploadFolder(c, outputPath, osmoChan, metricChan,
+			retryId, groupName, taskName, outputType.GetUrlIdentifier(), outputIndex, configDir)
+
+	} else if updateDatasetInfo, isTypeUpdateDataset :=
+		outputInfo.(*data.UpdateDatasetOutput); isTypeUpdateDataset {
+
+		updateDatasetInfo.MetadataFile = metadataFile
+		benchmarkFailures = updateDatasetInfo.UploadFolder(c, outputPath, osmoChan, metricChan,
+			retryId, groupName, taskName, outputType.GetUrlIdentifier(), outputIndex, configDir)
+
+	} else if kpiInfo, isTypeKpi := outputInfo.(*data.KpiOutput); isTypeKpi {
+		kpiPath := outputPath + kpiInfo.Path
+		if _, err := os.Stat(kpiPath); errors.Is(err, os.ErrNotExist) {
+			osmoChan <- fmt.Sprintf("KPI file: %s does not exist", kpiPath)
 		} else {
-			outputInfo.UploadFolder(c, outputPath, osmoChan, metricChan, retryId, groupName,
-				taskName, outputType.GetUrlIdentifier(), outputIndex)
+			// kpi file exists
+			benchmarkFailures = outputInfo.UploadFolder(c, outputPath, osmoChan, metricChan,
+				retryId, groupName, taskName, outputType.GetUrlIdentifier(), outputIndex,
+				configDir)
 		}
-	}
 
-	osmoChan <- "All Outputs Uploaded"
+	} else {
+		benchmarkFailures = outputInfo.UploadFolder(c, outputPath, osmoChan, metricChan,
+			retryId, groupName, taskName, outputType.GetUrlIdentifier(), outputIndex, configDir)
+	}
+	return benchmarkFailures
 }
 
 func cleanupMounts(downloadType string) {
@@ -1261,10 +3346,27 @@ func unescapeMountField(s string) string {
 	return s
 }
 
+// Signal the pending barrier request as met. Duplicate barrier actions find no pending request and
+// are ignored, so the buffered startExecChan never holds more than one signal and the send never
+// blocks pingPang, even before barrier waits on it.
+func releaseBarrier(startExecChan chan bool) {
+	barrierMutex.Lock()
+	localBarrierReq := barrierReq
+	barrierReq = ""
+	barrierMutex.Unlock()
+	if localBarrierReq == "" {
+		log.Println("Ignore barrier action without a pending barrier request")
+		return
+	}
+	startExecChan <- true
+}
+
 // Block until barrier has been met
 func barrier(osmoChan chan string, startExecChan chan bool,
-	barrierName string, logQueue *common.CircularBuffer) {
+	barrierName string, logQueue *common.CircularBuffer, metricChan chan metrics.Metric,
+	retryId string, groupName string, taskName string) {
 
+	startTime := time.Now()
 	osmoChan <- "Waiting for group ready ..."
 	barrierMutex.Lock()
 	barrierReq = messages.CreateBarrier(barrierName, -1)
@@ -1277,7 +3379,17 @@ func barrier(osmoChan chan string, startExecChan chan bool,
 	for {
 		select {
 		case <-startExecChan:
+			endTime := time.Now()
 			osmoChan <- "Group ready"
+			metricChan <- metrics.BarrierWaitMetrics{
+				RetryId:     retryId,
+				GroupName:   groupName,
+				TaskName:    taskName,
+				Barrier:     barrierName,
+				StartTime:   startTime.Format("2006-01-02 15:04:05.000"),
+				EndTime:     endTime.Format("2006-01-02 15:04:05.000"),
+				WaitSeconds: endTime.Sub(startTime).Seconds(),
+			}
 			return
 		case <-ticker.C:
 			barrierMutex.Lock()
@@ -1298,6 +3410,7 @@ func sendCtrlFailed(unixConn net.Conn, failed *bool) {
 			osmo_errors.SetExitCode(osmo_errors.UNIX_MESSAGE_FAILED_CODE)
 			panic(fmt.Sprintf("Failed to marshal request: %v\n", err))
 		}
+		protocolLog.record(ProtocolUnix, ProtocolSent, ctrlFailed)
 
 		if _, err := unixConn.Write(ctrlFailed); err != nil {
 			osmo_errors.SetExitCode(osmo_errors.UNIX_MESSAGE_FAILED_CODE)
@@ -1306,38 +3419,436 @@ func sendCtrlFailed(unixConn net.Conn, failed *bool) {
 	}
 }
 
-func init() {
-	data.CpuCount = os.Getenv("CPU_COUNT")
-	// In case variable is not set
-	if data.CpuCount == "" {
-		data.CpuCount = "1"
+// Stable hash of the settings that determine what a task reads and writes. Run specific values,
+// such as the workflow and retry ids, and credentials are excluded.
+func configFingerprint(cmdArgs args.CtrlArgs) string {
+	canonical := []string{
+		"downloadType=" + cmdArgs.DownloadType,
+		"inputPath=" + cmdArgs.InputPath,
+		"outputPath=" + cmdArgs.OutputPath,
+		"metadataFile=" + cmdArgs.MetadataFile,
+		"cacheSize=" + strconv.Itoa(cmdArgs.CacheSize),
+		"specFormat=" + cmdArgs.SpecFormat,
+	}
+	for _, input := range cmdArgs.Inputs {
+		canonical = append(canonical, "input="+strings.TrimSpace(input))
+	}
+	for _, output := range cmdArgs.Outputs {
+		canonical = append(canonical, "output="+strings.TrimSpace(output))
+	}
+	hash := sha256.Sum256([]byte(strings.Join(canonical, "\n")))
+	return hex.EncodeToString(hash[:])
+}
+
+// Serve runtime commands on a unix socket, see messages.RPCServer for the protocol
+func serveControlSocket(socketPath string, osmoChan chan string) net.Listener {
+	startTime := time.Now()
+	server := messages.NewRPCServer()
+	server.Register("methods", func(params json.RawMessage) (interface{}, error) {
+		return server.Methods(), nil
+	})
+	server.Register("health", func(params json.RawMessage) (interface{}, error) {
+		bufferMutex.Lock()
+		droppedLogs := numDroppedMsg
+		bufferMutex.Unlock()
+		rsyncState, rsyncReason := rsyncStatus.State()
+		return map[string]interface{}{
+			"websocket_connected": !data.GetWebsocketConnection().IsBroken,
+			"uptime_seconds":      time.Since(startTime).Seconds(),
+			"dropped_logs":        droppedLogs,
+			"stream_exec_logs":    streamExecLogs.Load(),
+			"restart_count":       restartCount.Load(),
+			"rsync_state":         rsyncState,
+			"rsync_reason":        rsyncReason,
+			"rsync_port":          rsyncStatus.Port(),
+		}, nil
+	})
+	server.Register("connection_budget", func(params json.RawMessage) (interface{}, error) {
+		// The whole budget is available again once the connection is restored
+		connection := data.GetWebsocketConnection()
+		remaining := connection.Timeout
+		disconnected := time.Duration(0)
+		if connection.IsBroken {
+			remaining = max(connection.TimeLeft(), 0)
+			disconnected = time.Since(connection.DisconnectStartTime)
+		}
+		return map[string]interface{}{
+			"websocket_connected":  !connection.IsBroken,
+			"disconnected_seconds": disconnected.Seconds(),
+			"remaining_seconds":    remaining.Seconds(),
+			"timeout_seconds":      connection.Timeout.Seconds(),
+		}, nil
+	})
+	server.Register("reload_credentials", func(params json.RawMessage) (interface{}, error) {
+		reloadCredentialConfigs(osmoChan)
+		return true, nil
+	})
+	server.Register("set_stream_logs", func(params json.RawMessage) (interface{}, error) {
+		var request struct {
+			Enabled bool `json:"enabled"`
+		}
+		if err := json.Unmarshal(params, &request); err != nil {
+			return nil, fmt.Errorf("invalid params: %w", err)
+		}
+		streamExecLogs.Store(request.Enabled)
+		return request.Enabled, nil
+	})
+
+	if err := os.RemoveAll(socketPath); err != nil {
+		osmo_errors.SetExitCode(osmo_errors.UNIX_MESSAGE_FAILED_CODE)
+		panic(err)
+	}
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		osmo_errors.SetExitCode(osmo_errors.UNIX_MESSAGE_FAILED_CODE)
+		panic(fmt.Sprintf("control socket listen error: %s", err))
+	}
+	go server.Serve(listener)
+	log.Printf("Serving runtime commands on %s", socketPath)
+	return listener
+}
+
+type selfCheckFailure struct {
+	Category string `json:"category"`
+	Detail   string `json:"detail"`
+}
+
+// checkFolderReadable lists the first entry of a folder, so large folders are not read in full
+func checkFolderReadable(folder string) error {
+	dir, err := os.Open(folder)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	if _, err := dir.Readdirnames(1); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// Verify the environment ctrl depends on before starting, so problems are reported up front
+// instead of halfway through a run
+func selfCheck(cmdArgs args.CtrlArgs) {
+	var failures []selfCheckFailure
+
+	osmoPath, err := exec.LookPath("osmo")
+	if err != nil {
+		failures = append(failures, selfCheckFailure{"binary", err.Error()})
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		output, err := exec.CommandContext(ctx, osmoPath, "--help").CombinedOutput()
+		cancel()
+		if err != nil {
+			failures = append(failures, selfCheckFailure{"binary",
+				fmt.Sprintf("%s is not invocable: %v: %s", osmoPath, err, output)})
+		}
+	}
+
+	if cmdArgs.DownloadType != data.Download {
+		fuserMountPath := common.ResolveCommandPath("FUSERMOUNT_PATH", "fusermount",
+			"/usr/bin/fusermount")
+		if _, err := os.Stat(fuserMountPath); err != nil {
+			failures = append(failures, selfCheckFailure{"fuse",
+				fmt.Sprintf("FUSE helper %s: %v", fuserMountPath, err)})
+		}
+	}
+
+	// The folders are mounted into the pod, so a missing folder is reported rather than created.
+	// The output folder is only read by ctrl and may be mounted read-only.
+	if cmdArgs.OutputPath != "/" {
+		if err := checkFolderReadable(cmdArgs.OutputPath); err != nil {
+			failures = append(failures, selfCheckFailure{"path",
+				fmt.Sprintf("%s is not readable: %v", cmdArgs.OutputPath, err)})
+		}
+	}
+	for _, folder := range []string{cmdArgs.InputPath, data.BenchmarkPath} {
+		if folder == "/" {
+			// Folder not configured
+			continue
+		}
+		info, err := os.Stat(folder)
+		if err != nil {
+			failures = append(failures, selfCheckFailure{"path", err.Error()})
+			continue
+		}
+		if !info.IsDir() {
+			failures = append(failures, selfCheckFailure{"path",
+				fmt.Sprintf("%s is not a directory", folder)})
+			continue
+		}
+		file, err := os.CreateTemp(folder, ".osmo_self_check")
+		if err != nil {
+			failures = append(failures, selfCheckFailure{"path",
+				fmt.Sprintf("%s is not writable: %v", folder, err)})
+			continue
+		}
+		file.Close()
+		os.Remove(file.Name())
+	}
+
+	if len(failures) > 0 {
+		for _, failure := range failures {
+			log.Printf("Self check failed [%s]: %s", failure.Category, failure.Detail)
+		}
+		osmo_errors.SetFailureDetails(map[string]interface{}{"self_check": failures})
+		osmo_errors.SetExitCode(osmo_errors.ENV_FAILED_CODE)
+		panic(fmt.Sprintf("Self check failed with %d problem(s)", len(failures)))
+	}
+	log.Println("Self check passed")
+}
+
+// Phases of the task recorded in the phase timeline
+const (
+	PhaseValidation string = "validation"
+	PhaseDownload   string = "download"
+	PhaseBarrier    string = "barrier"
+	PhaseExec       string = "exec"
+	PhaseUpload     string = "upload"
+	PhaseLogDone    string = "logdone"
+)
+
+type phaseRecord struct {
+	Phase           string  `json:"phase"`
+	StartTime       string  `json:"start_time"`
+	EndTime         string  `json:"end_time,omitempty"`
+	DurationSeconds float64 `json:"duration_seconds"`
+}
+
+// Start and end time of each phase of the task, in the order the phases started
+type phaseTimeline struct {
+	mutex       sync.Mutex
+	phases      []*phaseRecord
+	emitMetrics bool
+	metricChan  chan metrics.Metric
+	cmdArgs     args.CtrlArgs
+}
+
+// Start a phase. Returns a function that ends it.
+func (t *phaseTimeline) start(phase string) func() {
+	startTime := time.Now()
+	record := &phaseRecord{Phase: phase, StartTime: startTime.Format("2006-01-02 15:04:05.000")}
+	t.mutex.Lock()
+	t.phases = append(t.phases, record)
+	t.mutex.Unlock()
+
+	return func() {
+		endTime := time.Now()
+		t.mutex.Lock()
+		record.EndTime = endTime.Format("2006-01-02 15:04:05.000")
+		record.DurationSeconds = endTime.Sub(startTime).Seconds()
+		t.mutex.Unlock()
+		if t.emitMetrics {
+			t.metricChan <- metrics.TaskPhaseMetrics{
+				RetryId:         t.cmdArgs.RetryId,
+				GroupName:       t.cmdArgs.GroupName,
+				TaskName:        t.cmdArgs.LogSource,
+				Phase:           phase,
+				StartTime:       record.StartTime,
+				EndTime:         record.EndTime,
+				DurationSeconds: record.DurationSeconds,
+			}
+		}
+	}
+}
+
+// Write the timeline as JSON. Phases that did not end, because the task failed during them,
+// have no end time.
+func (t *phaseTimeline) write(path string) {
+	t.mutex.Lock()
+	timelineJson, err := json.MarshalIndent(t.phases, "", "  ")
+	t.mutex.Unlock()
+	if err != nil {
+		log.Printf("Failed to marshal phase timeline: %v", err)
+		return
+	}
+	if err := os.WriteFile(path, timelineJson, 0644); err != nil {
+		log.Printf("Failed to write phase timeline: %v", err)
+		return
+	}
+	log.Printf("Wrote phase timeline to %s", path)
+}
+
+// Start emitting windowed throughput for a data phase if enabled. Returns a function that stops
+// the sampling.
+func sampleThroughput(cmdArgs args.CtrlArgs, phase string,
+	metricChan chan metrics.Metric) func() {
+	if cmdArgs.ThroughputWindow <= 0 {
+		return func() {}
+	}
+	stopChan := data.SampleThroughput(cmdArgs.ThroughputWindow, phase, metricChan,
+		cmdArgs.RetryId, cmdArgs.GroupName, cmdArgs.LogSource)
+	return func() { stopChan <- true }
+}
+
+// Run only the download or upload phase, logging locally instead of to the workflow service.
+// This shortens the debug loop for data issues since the task does not need to be rerun.
+func runDataPhaseOnly(cmdArgs args.CtrlArgs) {
+	logChan := make(chan string)
+	metricChan := make(chan metrics.Metric)
+	stopChan := make(chan bool)
+	go func() {
+		for {
+			select {
+			case logMsg := <-logChan:
+				log.Println(logMsg)
+			case metric := <-metricChan:
+				log.Println(metrics.CreateMetrics(cmdArgs.LogSource, metric, metrics.Metrics))
+			case <-stopChan:
+				return
+			}
+		}
+	}()
+
+	if cmdArgs.DownloadOnly {
+		downloadInputsWithRetry(nil, cmdArgs, logChan, metricChan)
+	} else {
+		uploadOutputs(nil, cmdArgs.Outputs, cmdArgs.OutputPath, cmdArgs.MetadataFile,
+			logChan, metricChan, cmdArgs.RetryId, cmdArgs.GroupName, cmdArgs.LogSource,
+			cmdArgs.UserConfig, cmdArgs.ServiceConfig, cmdArgs.ConfigLoc, cmdArgs.StrictOutputs,
+			cmdArgs.OutputParallelism)
+	}
+	stopChan <- true
+}
+
+// configureTerminationLog applies the settings of the termination log the exit code is written to
+func configureTerminationLog(cmdArgs args.CtrlArgs) {
+	osmo_errors.FollowTerminationSymlink = cmdArgs.FollowTerminationSymlink
+	if cmdArgs.TerminationLog != "" {
+		osmo_errors.TerminationLogPath = cmdArgs.TerminationLog
+	}
+}
+
+// saveExitCode saves the exit code to the termination log when ctrl exits. In case of panic, the
+// panic is the reason unless a reason was set with the exit code. It recovers the panic, so it
+// must be deferred directly.
+func saveExitCode() {
+	if r := recover(); r != nil {
+		osmo_errors.SetDefaultExitReason(fmt.Sprint(r))
+		osmo_errors.SaveExitCode()
+		panic(r)
+	}
+	osmo_errors.SaveExitCode()
+}
+
+// configureOSMOCommands adds the osmo subcommands allowed by -allowOSMOCommand to the allowlist
+func configureOSMOCommands(cmdArgs args.CtrlArgs) {
+	for _, command := range cmdArgs.AllowOSMOCommands {
+		if err := data.AllowOSMOCommand(command); err != nil {
+			osmo_errors.SetExitCode(osmo_errors.INVALID_INPUT_CODE)
+			panic(err)
+		}
+	}
+}
+
+// configureCpuCount validates CPU_COUNT before it is passed to the OSMO commands as --processes
+func configureCpuCount(cmdArgs args.CtrlArgs) {
+	cpuCount, err := data.ParseCpuCount(os.Getenv("CPU_COUNT"))
+	if err != nil {
+		if !cmdArgs.ClampCpuCount {
+			osmo_errors.SetExitCode(osmo_errors.INVALID_INPUT_CODE)
+			panic(fmt.Sprintf("CPU_COUNT: %v", err))
+		}
+		log.Printf("WARNING: CPU_COUNT: %v, using 1 process", err)
+		cpuCount = "1"
 	}
+	data.CpuCount = cpuCount
 }
 
 func main() {
 	cmdArgs := args.CtrlParse()
+	if cmdArgs.PrintConfig {
+		printConfig(cmdArgs)
+		return
+	}
+	// Write the exit code to the termination log from here on, so a task failing the startup
+	// validation reports why
+	configureTerminationLog(cmdArgs)
+	defer saveExitCode()
+	configureCpuCount(cmdArgs)
+	configureTLS(cmdArgs)
+	configureDialer(cmdArgs)
+	configureOSMOCommands(cmdArgs)
+	configureProtocolRecord(cmdArgs)
+	defer protocolLog.close()
 	logQueue := common.NewCircularBuffer(cmdArgs.LogsBufferSize)
+	pendingLogs = logQueue
 	restartChan := make(chan bool)
 	osmoChan := make(chan string)
 	downloadChan := make(chan string)
 	uploadChan := make(chan string)
-	startExecChan := make(chan bool)
+	// Buffered so pingPang signals the barrier without waiting for it
+	startExecChan := make(chan bool, 1)
 	metricChan := make(chan metrics.Metric)
 	logsFinished := false
 	stopPutLogs := make(chan bool)
 	stopSendLogs := make(chan bool)
+	stopBackground := make(chan bool)
+	// Stop the background goroutines first so their metrics are put with the logs, then wait
+	// until all logs are put
+	stopLogs := func() {
+		close(stopBackground)
+		waitBackground.Wait()
+		stopPutLogs <- true
+		stopSendLogs <- true
+		waitGoRoutines.Wait()
+	}
 	data.DataTimeout = cmdArgs.DataTimeout
+	data.ReadWriteDatasetMounts = cmdArgs.ReadWriteDatasetMounts
+	data.DirListingWorkers = cmdArgs.DirListingWorkers
+	data.DirListingTimeout = cmdArgs.DirListingTimeout
+	common.OutputScanWorkers = cmdArgs.OutputScanWorkers
+	data.SpecFormat = cmdArgs.SpecFormat
+	data.UploadShards = cmdArgs.UploadShards
+	data.EmptyMountFailPercent = cmdArgs.EmptyMountFailPercent
+	data.DataAuthWorkers = cmdArgs.DataAuthWorkers
+	data.MetadataPathMode = cmdArgs.MetadataPathMode
+	data.DownloadStagingPath = cmdArgs.DownloadStagingPath
+	data.LogCommands = cmdArgs.LogCommands
+	data.MountTimeout = cmdArgs.MountTimeout
+	data.OutputResultsFile = cmdArgs.OutputResultsFile
+	data.StrictUpdatePaths = cmdArgs.StrictUpdatePaths
+	progressInterval = cmdArgs.ProgressInterval
+	failOnMissingCredential = cmdArgs.MissingMountCredential == args.MissingCredentialFail
+	common.SetRetryBudget(cmdArgs.MaxTotalRetries)
+	streamExecLogs.Store(cmdArgs.StreamExecLogs)
+	messages.SetIdentity(cmdArgs.Hostname, cmdArgs.NodeLabel)
+	metrics.SetIdentity(cmdArgs.Hostname, cmdArgs.NodeLabel)
+	maxLogBytes = cmdArgs.MaxLogBytes
+	maxOutputBytes = cmdArgs.MaxOutputBytes
+	forwardDNSCacheTTL = cmdArgs.ForwardDNSCacheTTL
+	taskHost = cmdArgs.TaskHost
+	logTaskHost(taskHost)
+	trackDroppedLogs = cmdArgs.DroppedLogsInterval > 0
+	logHighWater = newLogHighWaterMarks(cmdArgs.LogSource, cmdArgs.LogHighWaterMarks)
+	logLimitNotice = messages.CreateLog(cmdArgs.LogSource, fmt.Sprintf("WARNING: Log limit "+
+		"of %d bytes reached, further logs are dropped!", cmdArgs.MaxLogBytes), messages.StdErr)
 	failedCtrl := true
-	data.WebsocketConnection = data.WebsocketConnectionInfo{
-		IsBroken: false, DisconnectStartTime: time.Now(), Timeout: cmdArgs.Timeout}
+	data.UpdateWebsocketConnection(func(connection *data.WebsocketConnectionInfo) {
+		*connection = data.WebsocketConnectionInfo{
+			IsBroken: false, DisconnectStartTime: time.Now(), Timeout: cmdArgs.Timeout}
+	})
 	logsPeriodMs := cmdArgs.LogsPeriod
 	barrierReq = ""
 
 	// Oldest possible time to trigger a fetch for refresh token
 	tokenExpiration = time.Date(1, 1, 1, 0, 0, 0, 0, time.UTC)
 
-	// Save the exit code to the termination file in case of panic
-	defer osmo_errors.SaveExitCode()
+	if cmdArgs.MetricsSigningKey != "" {
+		if err := metrics.LoadSigningKey(cmdArgs.MetricsSigningKey); err != nil {
+			osmo_errors.SetExitCode(osmo_errors.INVALID_INPUT_CODE)
+			panic(err)
+		}
+	}
+
+	if !cmdArgs.SkipSelfCheck {
+		selfCheck(cmdArgs)
+	}
+
+	if cmdArgs.UploadOnly || cmdArgs.DownloadOnly {
+		runDataPhaseOnly(cmdArgs)
+		log.Printf("OSMO ctrl is done")
+		return
+	}
 
 	if err := os.RemoveAll(cmdArgs.SocketPath); err != nil {
 		osmo_errors.SetExitCode(osmo_errors.UNIX_MESSAGE_FAILED_CODE)
@@ -1372,9 +3883,21 @@ func main() {
 
 	log.Printf("Client connected [%s]", unixConn.RemoteAddr().Network())
 
+	if cmdArgs.LogSinkAddress != "" {
+		sink, err := messages.NewNDJSONSink(cmdArgs.LogSinkAddress, cmdArgs.LogSinkBufferSize)
+		if err != nil {
+			osmo_errors.SetExitCode(osmo_errors.INVALID_INPUT_CODE)
+			panic(fmt.Sprintf("Failed to create log sink: %s", err))
+		}
+		logSinks = append(logSinks, sink)
+		defer sink.Close()
+	}
+
 	// Start a websocket connection to Workflow Service
 	connWorkflowService(cmdArgs.WorkflowServiceUrl.String(), cmdArgs)
 	defer webConn.Close() // Conn should stay alive until the process exits
+	waitBackground.Add(1)
+	go refreshJWTTokenAhead(cmdArgs, stopBackground)
 
 	waitGoRoutines.Add(2)
 	go putLogs(cmdArgs.LogSource, osmoChan, downloadChan,
@@ -1385,35 +3908,117 @@ func main() {
 
 	go sendLogs(cmdArgs.LogSource, logQueue, logsPeriodMs, stopSendLogs)
 
+	fingerprint := configFingerprint(cmdArgs)
+	osmoChan <- "Task started with configuration fingerprint " + fingerprint
+	metricChan <- metrics.TaskStartedEvent{
+		RetryId:     cmdArgs.RetryId,
+		GroupName:   cmdArgs.GroupName,
+		TaskName:    cmdArgs.LogSource,
+		Time:        time.Now().Format("2006-01-02 15:04:05.000"),
+		Fingerprint: fingerprint,
+		NumInputs:   len(cmdArgs.Inputs),
+		NumOutputs:  len(cmdArgs.Outputs),
+	}
+	if tlsVerificationDisabled(cmdArgs) {
+		osmoChan <- "WARNING: " + insecureTLSWarning
+		metricChan <- metrics.SecurityWarningEvent{
+			RetryId:   cmdArgs.RetryId,
+			GroupName: cmdArgs.GroupName,
+			TaskName:  cmdArgs.LogSource,
+			Time:      time.Now().Format("2006-01-02 15:04:05.000"),
+			Warning:   metrics.InsecureTLSWarning,
+		}
+	}
+
+	timeline := &phaseTimeline{
+		emitMetrics: cmdArgs.PhaseMetrics,
+		metricChan:  metricChan,
+		cmdArgs:     cmdArgs,
+	}
+	if cmdArgs.PhasesFile != "" {
+		defer timeline.write(cmdArgs.PhasesFile)
+	}
+
+	succeeded := false
+	if cmdArgs.CleanupScratch {
+		// Deferred first so it runs after the mounts that use the caches are cleaned up
+		defer func() {
+			if succeeded {
+				data.CleanupScratch()
+			} else {
+				log.Println("Keeping benchmark and cache directories for debugging")
+			}
+		}()
+	}
 	defer cleanupMounts(cmdArgs.DownloadType)
 	sigintCatch := make(chan os.Signal, 1)
 	signal.Notify(sigintCatch, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
 		<-sigintCatch
+		deadline := time.Now().Add(cmdArgs.ForwardDrainTimeout)
+		portForwards.drain(cmdArgs.ForwardDrainTimeout)
+		// The telemetry of the drained forwards is queued with the logs, which are sent within
+		// what is left of the grace period
+		if !waitLogQueueSent(logQueue, deadline) {
+			log.Println("Log queue was not sent before exiting")
+		}
 		cleanupMounts(cmdArgs.DownloadType)
 		os.Exit(1)
 	}()
 
+	sighupCatch := make(chan os.Signal, 1)
+	signal.Notify(sighupCatch, syscall.SIGHUP)
+	go func() {
+		for range sighupCatch {
+			reloadCredentialConfigs(osmoChan)
+		}
+	}()
+
+	if trackDroppedLogs {
+		waitBackground.Add(1)
+		go reportDroppedLogs(cmdArgs.DroppedLogsInterval, metricChan, cmdArgs, stopBackground)
+	}
+	if progressInterval > 0 {
+		go sendProgress()
+	}
+	if cmdArgs.ResourceMetricsInterval > 0 {
+		waitBackground.Add(1)
+		go reportGoroutines(cmdArgs.ResourceMetricsInterval, cmdArgs.GoroutineWarnThreshold,
+			osmoChan, metricChan, cmdArgs, stopBackground)
+	}
+
+	if cmdArgs.ControlSocket != "" {
+		controlListener := serveControlSocket(cmdArgs.ControlSocket, osmoChan)
+		defer controlListener.Close()
+	}
+
 	// Validate data auth access before starting downloads/uploads
+	endValidation := timeline.start(PhaseValidation)
 	if err := data.ValidateInputsOutputsAccess(
 		cmdArgs.Inputs,
 		cmdArgs.Outputs,
 		cmdArgs.UserConfig,
 		osmoChan,
 	); err != nil {
-		osmo_errors.SetExitCode(osmo_errors.DATA_UNAUTHORIZED_CODE)
-		stopPutLogs <- true
-		stopSendLogs <- true
-		waitGoRoutines.Wait()
+		// The errors of all items are joined, so an unauthorized item fails the task as such even
+		// when another item failed first
+		code := osmo_errors.CodeOf(err)
+		if osmo_errors.HasCode(err, osmo_errors.DATA_UNAUTHORIZED_CODE) {
+			code = osmo_errors.DATA_UNAUTHORIZED_CODE
+		}
+		osmo_errors.SetExitCode(code)
+		stopLogs()
 		panic(fmt.Sprintf("Data unauthorized: %v", err))
 	}
+	endValidation()
 
 	// Send files to be downloaded
 	inputStartTime := time.Now().Format("2006-01-02 15:04:05.000")
-	downloadInputs(unixConn, cmdArgs.Inputs, cmdArgs.InputPath,
-		cmdArgs.DownloadType, downloadChan, metricChan, cmdArgs.RetryId, cmdArgs.GroupName,
-		cmdArgs.LogSource, cmdArgs.UserConfig, cmdArgs.ServiceConfig, cmdArgs.ConfigLoc,
-		cmdArgs.CacheSize)
+	stopSampling := sampleThroughput(cmdArgs, "input_download", metricChan)
+	endDownload := timeline.start(PhaseDownload)
+	downloadInputsWithRetry(unixConn, cmdArgs, downloadChan, metricChan)
+	endDownload()
+	stopSampling()
 	inputEndTime := time.Now().Format("2006-01-02 15:04:05.000")
 	downloadTimes := metrics.GroupMetrics{
 		RetryId:    cmdArgs.RetryId,
@@ -1425,10 +4030,13 @@ func main() {
 
 	// Synchronize tasks if in a group
 	if cmdArgs.Barrier != "" {
-		barrier(osmoChan, startExecChan, cmdArgs.Barrier, logQueue)
+		endBarrier := timeline.start(PhaseBarrier)
+		barrier(osmoChan, startExecChan, cmdArgs.Barrier, logQueue, metricChan,
+			cmdArgs.RetryId, cmdArgs.GroupName, cmdArgs.LogSource)
+		endBarrier()
 	}
 
-	err = json.NewEncoder(unixConn).Encode(messages.ExecStartRequest(cmdArgs.OutputPath))
+	err = sendUnixRequest(unixConn, messages.ExecStartRequest(cmdArgs.OutputPath))
 	if err != nil {
 		osmo_errors.SetExitCode(osmo_errors.UNIX_MESSAGE_FAILED_CODE)
 		panic(fmt.Sprintf("Failed to send request: %v\n", err))
@@ -1439,7 +4047,9 @@ func main() {
 
 	// Get Message that Exec has finished
 	log.Println("Exec start")
+	endExec := timeline.start(PhaseExec)
 	decoder := json.NewDecoder(unixConn)
+	execSucceeded := false
 execLogs:
 	for {
 		// Decode the response
@@ -1448,54 +4058,84 @@ execLogs:
 			osmoChan <- fmt.Sprintf("Failed to parse response: %v\n", err)
 			break execLogs
 		}
+		protocolLog.recordRequest(ProtocolReceived, response)
 
 		switch response.Type {
 		case messages.ExecFailed:
-			threadsafeEnqueue(logQueue,
+			enqueueLog(logQueue,
 				messages.CreateLog(cmdArgs.LogSource, response.MessageErr, messages.StdErr))
 			break execLogs
 		case messages.ExecFinished:
+			execSucceeded = true
 			break execLogs
 		case messages.UserRsyncStatus:
-			rsyncStatus.SetRunning(response.RsyncRunning)
+			rsyncStatus.SetFromRequest(response)
 		case messages.UserStopFinished:
 			restartChan <- true
-		case messages.MessageOut:
-			threadsafeEnqueue(logQueue,
-				messages.CreateLog(cmdArgs.LogSource, response.MessageOut, messages.StdOut))
-		case messages.MessageErr:
-			threadsafeEnqueue(logQueue,
-				messages.CreateLog(cmdArgs.LogSource, response.MessageErr, messages.StdErr))
-		case messages.MessageOps:
-			threadsafeEnqueue(logQueue,
-				messages.CreateLog(cmdArgs.LogSource, response.MessageOps, messages.OSMOCtrl))
+		default:
+			enqueueExecOutput(logQueue, cmdArgs.LogSource, response)
 		}
 	}
+	drainExecLogs(unixConn, decoder, logQueue, cmdArgs.LogSource, cmdArgs.ExecLogGracePeriod)
 	log.Println("Exec finished")
+	endExec()
+	if count := restartCount.Load(); count > 0 {
+		osmoChan <- fmt.Sprintf("User command was restarted %d time(s)", count)
+	}
 
 	// Send files to be uploaded
-	outputStartTime := time.Now().Format("2006-01-02 15:04:05.000")
-	uploadOutputs(unixConn, cmdArgs.Outputs, cmdArgs.OutputPath, cmdArgs.MetadataFile,
-		uploadChan, metricChan, cmdArgs.RetryId, cmdArgs.GroupName, cmdArgs.LogSource,
-		cmdArgs.UserConfig, cmdArgs.ServiceConfig, cmdArgs.ConfigLoc)
-	outputEndTime := time.Now().Format("2006-01-02 15:04:05.000")
-	uploadTimes := metrics.GroupMetrics{
-		RetryId:    cmdArgs.RetryId,
-		StartTime:  outputStartTime,
-		EndTime:    outputEndTime,
-		MetricType: "output_upload"}
-	metricChan <- uploadTimes
+	upload := func() {
+		outputStartTime := time.Now().Format("2006-01-02 15:04:05.000")
+		stopSampling := sampleThroughput(cmdArgs, "output_upload", metricChan)
+		endUpload := timeline.start(PhaseUpload)
+		// Changes to read-write dataset mounts are only uploaded when the user command succeeds
+		if execSucceeded {
+			copyFile(cmdArgs.UserConfig, cmdArgs.ConfigLoc)
+			data.FlushWriteBackMounts(uploadChan)
+		}
+		uploadOutputs(unixConn, cmdArgs.Outputs, cmdArgs.OutputPath, cmdArgs.MetadataFile,
+			uploadChan, metricChan, cmdArgs.RetryId, cmdArgs.GroupName, cmdArgs.LogSource,
+			cmdArgs.UserConfig, cmdArgs.ServiceConfig, cmdArgs.ConfigLoc, cmdArgs.StrictOutputs,
+			cmdArgs.OutputParallelism)
+		endUpload()
+		stopSampling()
+		outputEndTime := time.Now().Format("2006-01-02 15:04:05.000")
+		uploadTimes := metrics.GroupMetrics{
+			RetryId:    cmdArgs.RetryId,
+			StartTime:  outputStartTime,
+			EndTime:    outputEndTime,
+			MetricType: "output_upload"}
+		metricChan <- uploadTimes
+	}
+
+	// Tell the service the logs are done and wait for it to acknowledge
+	logDone := func() {
+		endLogDone := timeline.start(PhaseLogDone)
+		defer endLogDone()
+		logMsg := messages.CreateLog(cmdArgs.LogSource, "", messages.LogDone)
+		for !logsFinished {
+			threadsafeEnqueue(logQueue, logMsg)
+			time.Sleep(5 * time.Second)
+		}
+	}
 
-	logMsg := messages.CreateLog(cmdArgs.LogSource, "", messages.LogDone)
-	for !logsFinished {
-		threadsafeEnqueue(logQueue, logMsg)
-		time.Sleep(5 * time.Second)
+	// By default log done means the artifacts are persisted. With logDoneBeforeUpload it means
+	// the user command logs are flushed, so a slow upload does not delay it, and upload logs
+	// are sent on a best effort basis afterwards.
+	if cmdArgs.LogDoneBeforeUpload {
+		logDone()
+		upload()
+	} else {
+		upload()
+		logDone()
 	}
 
+	if progressInterval > 0 {
+		flushProgress()
+	}
 	log.Println("Stopping logs")
-	stopPutLogs <- true
-	stopSendLogs <- true
-	waitGoRoutines.Wait() // Wait until all logs are put before exit
+	stopLogs() // Wait until all logs are put before exit
 
+	succeeded = true
 	log.Printf("OSMO ctrl is done")
 }
@@ -0,0 +1,780 @@
+/*
+SPDX-FileCopyrightText: Copyright (c) 2025 NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+
+	"go.corp.nvidia.com/osmo/runtime/pkg/args"
+	"go.corp.nvidia.com/osmo/runtime/pkg/common"
+	"go.corp.nvidia.com/osmo/runtime/pkg/data"
+	"go.corp.nvidia.com/osmo/runtime/pkg/metrics"
+	"go.corp.nvidia.com/osmo/runtime/pkg/osmo_errors"
+)
+
+// newCertificate returns a self-signed certificate for 127.0.0.1, different from the one of the
+// httptest servers
+func newCertificate(t *testing.T) []byte {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "other"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// writeCABundle writes a certificate as a PEM CA bundle
+func writeCABundle(t *testing.T, cert []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	block := &pem.Block{Type: "CERTIFICATE", Bytes: cert}
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestConfigureTLS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	serverCert := server.Certificate().Raw
+	otherCert := newCertificate(t)
+
+	fingerprint := sha256.Sum256(serverCert)
+	otherFingerprint := sha256.Sum256(otherCert)
+
+	tests := []struct {
+		name    string
+		cmdArgs args.CtrlArgs
+		wantErr bool
+	}{
+		{
+			name:    "system roots do not trust the server",
+			cmdArgs: args.CtrlArgs{},
+			wantErr: true,
+		},
+		{
+			name:    "explicitly insecure",
+			cmdArgs: args.CtrlArgs{InsecureSkipVerify: true},
+		},
+		{
+			name:    "CA bundle with the server certificate",
+			cmdArgs: args.CtrlArgs{CABundle: writeCABundle(t, serverCert)},
+		},
+		{
+			name:    "CA bundle without the server certificate",
+			cmdArgs: args.CtrlArgs{CABundle: writeCABundle(t, otherCert)},
+			wantErr: true,
+		},
+		{
+			name:    "matching pin",
+			cmdArgs: args.CtrlArgs{PinnedCertSHA256: fingerprint[:]},
+		},
+		{
+			name:    "mismatching pin",
+			cmdArgs: args.CtrlArgs{PinnedCertSHA256: otherFingerprint[:]},
+			wantErr: true,
+		},
+		{
+			name: "matching pin and CA bundle with the server certificate",
+			cmdArgs: args.CtrlArgs{
+				PinnedCertSHA256: fingerprint[:],
+				CABundle:         writeCABundle(t, serverCert),
+			},
+		},
+		{
+			name: "matching pin and CA bundle without the server certificate",
+			cmdArgs: args.CtrlArgs{
+				PinnedCertSHA256: fingerprint[:],
+				CABundle:         writeCABundle(t, otherCert),
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.cmdArgs.TLSMinVersion = tls.VersionTLS12
+			configureTLS(test.cmdArgs)
+			resp, err := httpClient.Get(server.URL)
+			if err == nil {
+				resp.Body.Close()
+			}
+			if test.wantErr && err == nil {
+				t.Fatal("expected the certificate to be rejected")
+			}
+			if !test.wantErr && err != nil {
+				t.Fatalf("expected the certificate to be accepted: %v", err)
+			}
+		})
+	}
+}
+
+// A stand-in for the OSMO CLI that writes one benchmark to the --benchmark-out folder
+const fakeOSMOScript = `#!/bin/sh
+while [ $# -gt 0 ]; do
+	if [ "$1" = "--benchmark-out" ]; then
+		mkdir -p "$2"
+		cat > "$2/upload_benchmark.json" <<EOF
+{"start_time_ms": 1, "end_time_ms": 2, "total_bytes_transferred": 10,
+ "total_number_of_files": 1}
+EOF
+	fi
+	shift
+done
+`
+
+func TestUploadOutputsEmitsBenchmarksOnce(t *testing.T) {
+	binDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(binDir, "osmo"), []byte(fakeOSMOScript),
+		0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", binDir+":"+os.Getenv("PATH"))
+
+	benchmarkPath := data.BenchmarkPath
+	data.BenchmarkPath = t.TempDir() + "/"
+	defer func() { data.BenchmarkPath = benchmarkPath }()
+
+	outputPath := t.TempDir() + "/"
+	if err := os.WriteFile(outputPath+"file", []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	configDir := t.TempDir()
+	userConfig := filepath.Join(configDir, "user.yaml")
+	if err := os.WriteFile(userConfig, []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	configLoc := filepath.Join(configDir, "osmo", "config.yaml")
+	if err := os.MkdirAll(filepath.Dir(configLoc), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	var outputs common.ArrayFlags
+	for i := range 8 {
+		outputs = append(outputs, fmt.Sprintf("url:s3://bucket/output%d,", i))
+	}
+
+	osmoChan := make(chan string)
+	logsDone := make(chan struct{})
+	go func() {
+		defer close(logsDone)
+		for range osmoChan {
+		}
+	}()
+	metricChan := make(chan metrics.Metric, 10*len(outputs))
+	uploadOutputs(nil, outputs, outputPath, "", osmoChan, metricChan, "0", "group", "task",
+		userConfig, userConfig, configLoc, false, 4)
+	close(osmoChan)
+	<-logsDone
+	close(metricChan)
+
+	emitted := make(map[string]int)
+	for metric := range metricChan {
+		if ioMetric, ok := metric.(metrics.TaskIOMetrics); ok {
+			emitted[ioMetric.URL]++
+		}
+	}
+	for i := range outputs {
+		url := fmt.Sprintf("s3://bucket/output%d", i)
+		if emitted[url] != 1 {
+			t.Errorf("expected one benchmark metric for %s, got %d", url, emitted[url])
+		}
+	}
+	if len(emitted) != len(outputs) {
+		t.Errorf("expected benchmark metrics for %d outputs, got %v", len(outputs), emitted)
+	}
+}
+
+func TestPrintConfig(t *testing.T) {
+	stdout := os.Stdout
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout = writer
+	printConfig(args.CtrlArgs{RefreshToken: "secret", CompressionLevel: 6})
+	os.Stdout = stdout
+	writer.Close()
+	output, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var config args.CtrlArgs
+	if err := json.Unmarshal(output, &config); err != nil {
+		t.Fatalf("expected the configuration as JSON: %v", err)
+	}
+	if config.CompressionLevel != 6 {
+		t.Errorf("expected compression level 6, got %d", config.CompressionLevel)
+	}
+	if strings.Contains(string(output), "secret") {
+		t.Error("expected the refresh token to be redacted")
+	}
+}
+
+func TestGetSrcAddr(t *testing.T) {
+	ipv6 := net.ParseIP("2001:db8::1")
+	tests := []struct {
+		name          string
+		data          []byte
+		addressFamily bool
+		wantAddr      string
+		wantPrefixLen int
+		wantErr       bool
+	}{
+		{
+			name:          "IPv4",
+			data:          append([]byte{4, 127, 0, 0, 1, 0x1f, 0x90}, "payload"...),
+			addressFamily: true,
+			wantAddr:      "127.0.0.1:8080",
+			wantPrefixLen: 7,
+		},
+		{
+			name:          "IPv6",
+			data:          append(append([]byte{6}, ipv6...), 0x00, 0x35),
+			addressFamily: true,
+			wantAddr:      "[2001:db8::1]:53",
+			wantPrefixLen: 19,
+		},
+		{
+			name:          "IPv4 without the address family",
+			data:          append([]byte{10, 0, 0, 2, 0x1f, 0x90}, "payload"...),
+			wantAddr:      "10.0.0.2:8080",
+			wantPrefixLen: 6,
+		},
+		{
+			name:          "empty",
+			data:          []byte{},
+			addressFamily: true,
+			wantErr:       true,
+		},
+		{
+			name:          "unknown address family",
+			data:          []byte{5, 127, 0, 0, 1, 0x1f, 0x90},
+			addressFamily: true,
+			wantErr:       true,
+		},
+		{
+			name:          "short IPv4",
+			data:          []byte{4, 127, 0, 0, 1, 0x1f},
+			addressFamily: true,
+			wantErr:       true,
+		},
+		{
+			name:          "short IPv6",
+			data:          append([]byte{6}, ipv6[:8]...),
+			addressFamily: true,
+			wantErr:       true,
+		},
+		{
+			name:    "short IPv4 without the address family",
+			data:    []byte{127, 0, 0, 1, 0x1f},
+			wantErr: true,
+		},
+		{
+			name:    "empty without the address family",
+			data:    nil,
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			addr, prefixLen, err := getSrcAddr(test.data, test.addressFamily)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %s with a prefix of %d", addr, prefixLen)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if addr != test.wantAddr || prefixLen != test.wantPrefixLen {
+				t.Errorf("expected %s with a prefix of %d, got %s with a prefix of %d",
+					test.wantAddr, test.wantPrefixLen, addr, prefixLen)
+			}
+		})
+	}
+}
+
+// websocketPair returns both ends of a websocket connection
+func websocketPair(t *testing.T) (*websocket.Conn, *websocket.Conn) {
+	t.Helper()
+	serverConns := make(chan *websocket.Conn, 1)
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		serverConns <- conn
+	}))
+	t.Cleanup(server.Close)
+
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConn := <-serverConns
+	t.Cleanup(func() {
+		client.Close()
+		serverConn.Close()
+	})
+	return client, serverConn
+}
+
+func TestCopyWebsocketRateLimit(t *testing.T) {
+	const bytesPerSecond = 1 << 20
+	const chunk = 16 << 10
+	// The first second of bytes is sent as a burst, so the other half second is paced
+	const total = 3 * bytesPerSecond / 2
+
+	srcClient, src := websocketPair(t)
+	dstClient, dst := websocketPair(t)
+	var bytesCopied atomic.Int64
+	go copyWebsocket(dst, src, log.New(io.Discard, "", 0), common.NewRateLimiter(bytesPerSecond),
+		&bytesCopied)
+
+	start := time.Now()
+	go func() {
+		payload := make([]byte, chunk)
+		for sent := 0; sent < total; sent += chunk {
+			if err := srcClient.WriteMessage(websocket.BinaryMessage, payload); err != nil {
+				return
+			}
+		}
+	}()
+	received := 0
+	for received < total {
+		_, data, err := dstClient.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		received += len(data)
+	}
+	elapsed := time.Since(start)
+
+	// The copied bytes are counted after the write, so the last message may still be counting
+	for deadline := time.Now().Add(time.Second); bytesCopied.Load() != total &&
+		time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	if received != total || bytesCopied.Load() != total {
+		t.Errorf("expected %d bytes, received %d and copied %d", total, received,
+			bytesCopied.Load())
+	}
+	if elapsed < 450*time.Millisecond || elapsed > 1500*time.Millisecond {
+		t.Errorf("expected %d bytes at %d bytes per second to take about 500ms, took %s", total,
+			bytesPerSecond, elapsed)
+	}
+}
+
+func TestReleaseBarrierIgnoresDuplicates(t *testing.T) {
+	startExecChan := make(chan bool, 1)
+	barrierMutex.Lock()
+	barrierReq = "barrier"
+	barrierMutex.Unlock()
+
+	released := make(chan struct{})
+	go func() {
+		defer close(released)
+		for range 3 {
+			releaseBarrier(startExecChan)
+		}
+	}()
+	select {
+	case <-released:
+	case <-time.After(time.Second):
+		t.Fatal("expected repeated barrier actions not to block")
+	}
+
+	if len(startExecChan) != 1 {
+		t.Fatalf("expected one barrier signal, got %d", len(startExecChan))
+	}
+	<-startExecChan
+	releaseBarrier(startExecChan)
+	if len(startExecChan) != 0 {
+		t.Error("expected a barrier action without a pending request to be ignored")
+	}
+}
+
+func TestUDPFlowsEvictIdle(t *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	const idleTimeout = 50 * time.Millisecond
+	const burst = 10
+	flows := &udpFlows{flows: make(map[string]*udpFlow)}
+	readersDone := make(chan struct{}, burst)
+	for i := range burst {
+		conn, err := net.Dial("udp", listener.LocalAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		srcAddr := fmt.Sprintf("10.0.0.%d:5000", i)
+		flows.add(srcAddr, conn, 0)
+		go func() {
+			// Like readUDP, the reader stops once its connection is closed
+			buffer := make([]byte, BUFFERSIZE)
+			for {
+				if _, err := conn.Read(buffer); err != nil {
+					break
+				}
+			}
+			flows.remove(srcAddr, conn)
+			readersDone <- struct{}{}
+		}()
+	}
+
+	time.Sleep(2 * idleTimeout)
+	active := flows.get("10.0.0.0:5000")
+	flows.evictIdle(idleTimeout, log.New(io.Discard, "", 0))
+
+	flows.mutex.Lock()
+	remaining := len(flows.flows)
+	flows.mutex.Unlock()
+	if remaining != 1 {
+		t.Fatalf("expected only the active flow to remain, got %d flows", remaining)
+	}
+	for range burst - 1 {
+		select {
+		case <-readersDone:
+		case <-time.After(time.Second):
+			t.Fatal("expected the readers of the idle flows to stop")
+		}
+	}
+	if flows.get("10.0.0.0:5000") != active {
+		t.Error("expected the active flow to be kept")
+	}
+	flows.closeAll()
+}
+
+func TestConfigureCpuCount(t *testing.T) {
+	cpuCount := data.CpuCount
+	defer func() { data.CpuCount = cpuCount }()
+
+	t.Setenv("CPU_COUNT", "3")
+	configureCpuCount(args.CtrlArgs{})
+	if data.CpuCount != "3" {
+		t.Errorf("expected a cpu count of 3, got %s", data.CpuCount)
+	}
+
+	t.Setenv("CPU_COUNT", "all")
+	configureCpuCount(args.CtrlArgs{ClampCpuCount: true})
+	if data.CpuCount != "1" {
+		t.Errorf("expected an invalid cpu count to be clamped to 1, got %s", data.CpuCount)
+	}
+
+	exitCode := osmo_errors.GetExitCode()
+	defer osmo_errors.SetExitCode(exitCode)
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("expected an invalid cpu count to fail without -clampCpuCount")
+			}
+		}()
+		configureCpuCount(args.CtrlArgs{})
+	}()
+	if code := osmo_errors.GetExitCode(); code != osmo_errors.INVALID_INPUT_CODE {
+		t.Errorf("expected exit code %d, got %d", osmo_errors.INVALID_INPUT_CODE, code)
+	}
+}
+
+// runStartupStep runs a step of the startup the way main does, once the termination log is
+// configured and the exit code is saved on exit, and returns the termination log written
+func runStartupStep(t *testing.T, step func()) map[string]interface{} {
+	t.Helper()
+	path, follow := osmo_errors.TerminationLogPath, osmo_errors.FollowTerminationSymlink
+	exitCode := osmo_errors.GetExitCode()
+	defer func() {
+		osmo_errors.TerminationLogPath, osmo_errors.FollowTerminationSymlink = path, follow
+		osmo_errors.SetExitCode(exitCode)
+	}()
+
+	terminationLog := filepath.Join(t.TempDir(), "termination-log")
+	configureTerminationLog(args.CtrlArgs{TerminationLog: terminationLog})
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("expected the startup step to fail")
+			}
+		}()
+		defer saveExitCode()
+		step()
+	}()
+
+	content, err := os.ReadFile(terminationLog)
+	if err != nil {
+		t.Fatalf("expected the termination log to be written: %v", err)
+	}
+	var written map[string]interface{}
+	if err := json.Unmarshal(content, &written); err != nil {
+		t.Fatalf("expected the termination log to be JSON, got %q: %v", content, err)
+	}
+	return written
+}
+
+func TestStartupFailureTerminationLog(t *testing.T) {
+	cpuCount, savedTLS, client := data.CpuCount, tlsConfig, httpClient
+	defer func() { data.CpuCount, tlsConfig, httpClient = cpuCount, savedTLS, client }()
+	t.Setenv("CPU_COUNT", "all")
+	notPEM := filepath.Join(t.TempDir(), "bundle.pem")
+	if err := os.WriteFile(notPEM, []byte("not a certificate"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		step     func()
+		wantCode osmo_errors.ExitCode
+	}{
+		{
+			name:     "invalid cpu count",
+			step:     func() { configureCpuCount(args.CtrlArgs{}) },
+			wantCode: osmo_errors.INVALID_INPUT_CODE,
+		},
+		{
+			name:     "missing CA bundle",
+			step:     func() { configureTLS(args.CtrlArgs{CABundle: notPEM + ".missing"}) },
+			wantCode: osmo_errors.INVALID_INPUT_CODE,
+		},
+		{
+			name:     "CA bundle without certificates",
+			step:     func() { configureTLS(args.CtrlArgs{CABundle: notPEM}) },
+			wantCode: osmo_errors.INVALID_INPUT_CODE,
+		},
+		{
+			name: "invalid allowed osmo command",
+			step: func() {
+				configureOSMOCommands(args.CtrlArgs{AllowOSMOCommands: []string{"dataset"}})
+			},
+			wantCode: osmo_errors.INVALID_INPUT_CODE,
+		},
+		{
+			name: "unwritable protocol record",
+			step: func() {
+				configureProtocolRecord(args.CtrlArgs{
+					RecordProtocol: filepath.Join(notPEM, "record.jsonl")})
+			},
+			wantCode: osmo_errors.FILE_FAILED_CODE,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			written := runStartupStep(t, test.step)
+			if code := written["code"]; code != float64(test.wantCode) {
+				t.Errorf("expected exit code %d in the termination log, got %v", test.wantCode,
+					code)
+			}
+			if reason, _ := written["reason"].(string); reason == "" {
+				t.Errorf("expected a reason in the termination log, got %v", written)
+			}
+		})
+	}
+}
+
+func TestProtocolRecorderRedactsCredentials(t *testing.T) {
+	recordPath := filepath.Join(t.TempDir(), "record.jsonl")
+	recorder, err := newProtocolRecorder(recordPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder.record(ProtocolWebsocket, ProtocolReceived, []byte(`{"action": "portforward", `+
+		`"key": "PORTFORWARD-1", "cookie": "session=secret-cookie", "task_port": 8080, `+
+		`"payload": {"auth": [{"refresh_token": "secret-token", "access_key": "secret-key"}]}}`))
+	recorder.record(ProtocolWebsocket, ProtocolSent, []byte(`{"action": "log_done"}`))
+	recorder.close()
+
+	content, err := os.ReadFile(recordPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"secret-cookie", "secret-token", "secret-key"} {
+		if strings.Contains(string(content), secret) {
+			t.Errorf("expected %s to be redacted, got %s", secret, content)
+		}
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 entries, got %d: %s", len(lines), content)
+	}
+	var entry protocolRecordEntry
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatal(err)
+	}
+	var message map[string]interface{}
+	if err := json.Unmarshal(entry.Message, &message); err != nil {
+		t.Fatal(err)
+	}
+	if message["cookie"] != redactedValue || message["key"] != "PORTFORWARD-1" ||
+		message["task_port"] != float64(8080) {
+		t.Errorf("expected only the cookie to be redacted, got %v", message)
+	}
+	if !strings.Contains(lines[1], `"message":{"action":"log_done"}`) {
+		t.Errorf("expected a message without credentials to be kept, got %s", lines[1])
+	}
+}
+
+func TestRejectPortForward(t *testing.T) {
+	for _, reason := range []string{"local service not listening on port 8080",
+		"readiness probe failed: " + strings.Repeat("x", 200),
+		"readiness probe failed: x" + strings.Repeat("é", 100)} {
+		client, server := websocketPair(t)
+		rejectPortForward(server, reason)
+
+		_, _, err := client.ReadMessage()
+		closeErr, ok := err.(*websocket.CloseError)
+		if !ok {
+			t.Fatalf("expected the connection to be closed, got %v", err)
+		}
+		if closeErr.Code != websocket.CloseTryAgainLater {
+			t.Errorf("expected close code %d, got %d", websocket.CloseTryAgainLater, closeErr.Code)
+		}
+		if len(closeErr.Text) > maxCloseReasonLength || !utf8.ValidString(closeErr.Text) ||
+			!strings.HasPrefix(reason, strings.TrimSuffix(closeErr.Text, "...")) {
+			t.Errorf("expected the reason %q, got %q", reason, closeErr.Text)
+		}
+	}
+}
+
+func TestResolveForwardTarget(t *testing.T) {
+	ttl, lookup := forwardDNSCacheTTL, lookupForwardHost
+	defer func() {
+		forwardDNSCacheTTL, lookupForwardHost = ttl, lookup
+		forwardDNSCache = map[string]resolvedAddress{}
+	}()
+	forwardDNSCacheTTL = time.Minute
+	forwardDNSCache = map[string]resolvedAddress{}
+
+	lookups := 0
+	slowLookup := make(chan struct{})
+	lookupForwardHost = func(host string) ([]string, error) {
+		if host == "slow" {
+			<-slowLookup
+			return []string{"10.0.0.2"}, nil
+		}
+		lookups++
+		return []string{"10.0.0.1"}, nil
+	}
+
+	if resolved := resolveForwardTarget("service:8080"); resolved != "10.0.0.1:8080" {
+		t.Fatalf("expected 10.0.0.1:8080, got %s", resolved)
+	}
+	resolveForwardTarget("service:8080")
+	if lookups != 1 {
+		t.Errorf("expected the second resolution to be cached, got %d lookups", lookups)
+	}
+	if resolved := resolveForwardTarget("127.0.0.1:8080"); resolved != "127.0.0.1:8080" {
+		t.Errorf("expected an IP address to be used as is, got %s", resolved)
+	}
+
+	// A slow resolution does not block resolving the cached targets
+	slowDone := make(chan string)
+	go func() { slowDone <- resolveForwardTarget("slow:8080") }()
+	cachedDone := make(chan string)
+	go func() { cachedDone <- resolveForwardTarget("service:8080") }()
+	select {
+	case resolved := <-cachedDone:
+		if resolved != "10.0.0.1:8080" {
+			t.Errorf("expected 10.0.0.1:8080, got %s", resolved)
+		}
+	case <-time.After(time.Second):
+		t.Error("expected the cached target to resolve during a slow resolution")
+	}
+	close(slowLookup)
+	if resolved := <-slowDone; resolved != "10.0.0.2:8080" {
+		t.Errorf("expected 10.0.0.2:8080, got %s", resolved)
+	}
+
+	invalidateForwardTarget("service:8080")
+	resolveForwardTarget("service:8080")
+	if lookups != 2 {
+		t.Errorf("expected an invalidated target to be resolved again, got %d lookups", lookups)
+	}
+}
+
+func TestNewExecRecorderKey(t *testing.T) {
+	recordDir := filepath.Join(t.TempDir(), "records")
+	recorder, err := newExecRecorder(recordDir, "EXEC-abc123", "bash", "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder.close()
+	records, err := filepath.Glob(filepath.Join(recordDir, "exec_EXEC-abc123_*.jsonl"))
+	if err != nil || len(records) != 1 {
+		t.Errorf("expected one record in %s, got %v", recordDir, records)
+	}
+
+	for _, key := range []string{"", "../escape", "a/b", `a\b`, ".."} {
+		if recorder, err := newExecRecorder(recordDir, key, "bash", "user"); err == nil {
+			recorder.close()
+			t.Errorf("expected the key %q to be rejected", key)
+		}
+	}
+	entries, err := os.ReadDir(filepath.Dir(recordDir))
+	if err != nil || len(entries) != 1 {
+		t.Errorf("expected only the record directory to be written, got %v", entries)
+	}
+}
@@ -392,6 +392,7 @@ func main() {
 				ctx,
 				cmdArgs.UserBinPath,
 				cmdArgs.RunLocation,
+				cmdArgs.RsyncPort,
 				cmdArgs.RsyncReadLimit,
 				cmdArgs.RsyncWriteLimit,
 				cmdArgs.RsyncPathAllowList,
@@ -19,16 +19,44 @@ SPDX-License-Identifier: Apache-2.0
 package args
 
 import (
+	"compress/flate"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
 	"flag"
 	"fmt"
+	"log"
+	"net"
 	"net/url"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	"go.corp.nvidia.com/osmo/runtime/pkg/common"
 )
 
+// Handling of exec sessions requested while the user command restarts
+const (
+	ExecDuringRestartReject = "reject"
+	ExecDuringRestartWait   = "wait"
+)
+
+// Handling of inputs mounted from a storage backend the config has no data credential for
+const (
+	MissingCredentialFallback = "fallback"
+	MissingCredentialFail     = "fail"
+)
+
+// Environment variable the refresh token is read from when the refresh token file is not set or
+// does not exist. The file takes precedence when both are available.
+const RefreshTokenEnv = "OSMO_REFRESH_TOKEN"
+
+// Features reported to the service when connecting, which the service only uses with tasks whose
+// ctrl reports them
+var CtrlFeatures = []string{"udp_address_family"}
+
 // Parse and process command line arguments
 func CtrlParse() CtrlArgs {
 	var inputs, outputs common.ArrayFlags
@@ -41,7 +69,8 @@ func CtrlParse() CtrlArgs {
 	scheme := flag.String("scheme", "ws", "Scheme to connect to the Workflow service.")
 	host := flag.String("host", "localhost", "Workflow service host.")
 	port := flag.String("port", "8000", "Workflow service port.")
-	refreshToken := flag.String("refreshToken", "/osmo/.refresh_token", "Location of the refresh token file for authentication.")
+	refreshToken := flag.String("refreshToken", "/osmo/.refresh_token", "Location of the refresh token file for authentication. "+
+		"If empty or missing, the token is read from the "+RefreshTokenEnv+" environment variable.")
 	refreshScheme := flag.String("refreshScheme", "http", "Scheme to request for new access token.")
 	tokenHeader := flag.String("tokenHeader", "x-osmo-auth", "HTTP header to pass the token in.")
 	userConfig := flag.String("userConfig", "/osmo/user_config.yaml", "User Config File.")
@@ -54,7 +83,8 @@ func CtrlParse() CtrlArgs {
 		"Whether input does mounting or downloaing and what type of mounting if mounting.")
 	timeout := flag.Int("timeout", 60, "Wait time (m) to connect to the OSMO service.")
 	unixTimeout := flag.Int("unixTimeout", 120, "osmo_exec wait time (m) for the unix connection.")
-	execTimeout := flag.Int("execTimeout", 5, "osmo_exec wait time (m) for the exec connection.")
+	execTimeout := flag.Int("execTimeout", 10, "osmo_exec wait time (m) for the user terminal "+
+		"of an interactive exec session to connect.")
 	dataTimeout := flag.Int("dataTimeout", 10,
 		"osmo_exec wait time (m) between data upload/download messages.")
 	groupName := flag.String("groupName", "", "Group name for workflow")
@@ -62,15 +92,203 @@ func CtrlParse() CtrlArgs {
 	logsPeriod := flag.Int("logsPeriod", 100, "How often OSMO control should push logs to the "+
 		"service (in milliseconds)")
 	logsBufferSize := flag.Int("logsBufferSize", 10000, "The capacity of circular buffer for "+
-		"storing messages.")
+		"storing messages. Clamped to minLogsBufferSize and maxLogsBufferSize.")
+	minLogsBufferSize := flag.Int("minLogsBufferSize", 100, "The smallest logsBufferSize, so "+
+		"a buffer that is too small does not drop most logs during a disconnect.")
+	maxLogsBufferSize := flag.Int("maxLogsBufferSize", 1000000, "The largest logsBufferSize, "+
+		"so a buffer that is too large does not exhaust the memory of the task.")
 	cacheSize := flag.Int("cacheSize", 0, "The maximum mount cache size (in MiB) "+
-		"split across inputs.")
+		"split across the inputs mounted at the same time.")
+	logSinkAddress := flag.String("logSinkAddress", "", "Optional address of a local log "+
+		"forwarder receiving NDJSON logs (unix:///path/to.sock or tcp://host:port).")
+	logSinkBufferSize := flag.Int("logSinkBufferSize", 1000, "The number of log records "+
+		"queued for the log forwarder before records are dropped.")
+	tlsMinVersion := flag.String("tlsMinVersion", "1.2", "Minimum TLS version used for "+
+		"connections to the OSMO service (1.2 or 1.3).")
+	tlsCipherSuites := flag.String("tlsCipherSuites", "", "Optional comma separated list of "+
+		"TLS 1.2 cipher suite names to allow. Defaults to the Go standard library list.")
+	readWriteDatasetMounts := flag.Bool("experimentalReadWriteDatasets", false, "EXPERIMENTAL: "+
+		"Allow mounted dataset inputs to be modified. Files written to them are uploaded as a "+
+		"new dataset version before the outputs when the user command succeeds.")
+	uploadOnly := flag.Bool("uploadOnly", false, "Debug mode that only uploads the existing "+
+		"output folder, skipping download, barrier and exec. Logs are written locally.")
+	downloadOnly := flag.Bool("downloadOnly", false, "Debug mode that only downloads the "+
+		"inputs, skipping barrier, exec and upload. Logs are written locally.")
+	dirListingWorkers := flag.Int("dirListingWorkers", 8, "The number of directories listed "+
+		"concurrently when previewing input contents.")
+	dirListingTimeout := flag.Int("dirListingTimeout", 10, "Time (s) allowed for previewing "+
+		"input contents before a partial listing is printed.")
+	outputScanWorkers := flag.Int("outputScanWorkers", 1, "The number of goroutines matching "+
+		"the files of an output, across its directories and batches of directory entries.")
+	metricsSigningKey := flag.String("metricsSigningKey", "", "Optional file containing a key "+
+		"used to HMAC-SHA256 sign every metric record.")
+	specFormat := flag.String("specFormat", "legacy", "Encoding of the inputs and outputs "+
+		"specs: legacy (delimited fields) or json (one JSON object per spec).")
+	streamExecLogs := flag.Bool("streamExecLogs", false, "Send user command output to the "+
+		"service as soon as it is received instead of every logsPeriod. Can be toggled by the "+
+		"service at runtime.")
+	throughputWindow := flag.Int("throughputWindow", 0, "How often (s) to emit the "+
+		"throughput of the download and upload phases. Default to 0, which disables it.")
+	hostname := flag.String("hostname", "", "Hostname attached to logs and metrics. Default to "+
+		"the hostname reported by the kernel.")
+	nodeLabelEnv := flag.String("nodeLabelEnv", "OSMO_NODE_NAME", "Environment variable "+
+		"containing an optional node label attached to logs and metrics.")
+	strictOutputs := flag.Bool("strictOutputs", false, "Fail the task when the output folder "+
+		"does not exist at upload time instead of skipping the upload.")
+	maxLogBytes := flag.Int64("maxLogBytes", 0, "The maximum total bytes of logs sent for the "+
+		"task. Further logs are dropped. Default to 0, which is unlimited.")
+	forwardDNSCacheTTL := flag.Int("forwardDNSCacheTTL", 0, "How long (s) to reuse the "+
+		"resolved address of a port forward target. Default to 0, which resolves every dial.")
+	recordExecDir := flag.String("recordExec", "", "Optional folder to record the terminal "+
+		"I/O of exec sessions in. Transcripts capture everything typed and printed, which may "+
+		"include sensitive data.")
+	downloadRetries := flag.Int("downloadPhaseRetries", 0, "How many times to retry the "+
+		"whole download phase when every input may be affected by a failure, such as a network "+
+		"partition. Completed inputs are not downloaded again.")
+	downloadBackoff := flag.Int("downloadPhaseBackoff", 30, "Wait time (s) before the "+
+		"first download phase retry, doubled after each retry.")
+	perForwardBandwidth := flag.Int64("perForwardBandwidth", 0, "The maximum bytes per second "+
+		"in each direction of a single port forward connection. Default to 0, which is unlimited.")
+	controlSocket := flag.String("controlSocket", "", "Optional unix socket serving JSON "+
+		"runtime commands such as health and reload_credentials.")
+	pinnedCertSHA256 := flag.String("pinnedCertSHA256", "", "Optional SHA-256 fingerprint of "+
+		"the OSMO service certificate. When set, only this certificate is trusted, regardless "+
+		"of its chain.")
+	logDoneBeforeUpload := flag.Bool("logDoneBeforeUpload", false, "Signal log done to the "+
+		"service before uploading outputs, so done means the logs are flushed. By default it "+
+		"is signaled after the upload, so done means the outputs are persisted.")
+	skipSelfCheck := flag.Bool("skipSelfCheck", false, "Skip verifying the osmo CLI, FUSE "+
+		"helper and data folders at startup.")
+	droppedLogsInterval := flag.Int("droppedLogsInterval", 0, "How often (s) to report the "+
+		"stream, time range and total count of log lines dropped because the log buffer was "+
+		"full, in intervals with dropped lines. Default to 0, which only reports the number of "+
+		"dropped lines.")
+	handshakeTimeout := flag.Int("handshakeTimeout", 45, "Wait time (s) for a websocket "+
+		"handshake to complete before the dial fails and is retried.")
+	forwardProbe := flag.String("forwardProbe", "none", "Readiness probe run against the local "+
+		"server before a port forward connection starts: none, tcp or http.")
+	forwardProbePath := flag.String("forwardProbePath", "/", "Path requested by the http "+
+		"forward probe, which must return 200.")
+	forwardProbeTimeout := flag.Int("forwardProbeTimeout", 60, "Wait time (s) for the forward "+
+		"probe to succeed.")
+	uploadShards := flag.Int("uploadShards", 1, "The number of parallel subprocesses a url output "+
+		"upload is split across. Dataset outputs always upload with one subprocess. Default to 1.")
+	allowDuplicateInputFolders := flag.Bool("allowDuplicateInputFolders", false, "Warn instead "+
+		"of failing when multiple inputs are written to the same folder.")
+	maxTotalRetries := flag.Int("maxTotalRetries", 0, "The maximum number of retries across "+
+		"all downloads, uploads and service connections of the task, after which they fail "+
+		"without retrying. Default to 0, which is unlimited.")
+	followTerminationSymlink := flag.Bool("followTerminationSymlink", false, "Write the "+
+		"exit code through the termination log when it is a symlink. By default a symlinked "+
+		"termination log is not written.")
+	terminationLog := flag.String("terminationLog", "", "Path the exit code is written to. "+
+		"Defaults to OSMO_TERMINATION_LOG when set, otherwise /dev/termination-log.")
+	missingCredential := flag.String("missingMountCredential", MissingCredentialFallback, "How "+
+		"an input mounted from a storage backend the config has no data credential for is "+
+		"handled: "+MissingCredentialFallback+" attempts the mount, which falls back to a "+
+		"download, "+MissingCredentialFail+" fails the task before mounting.")
+	emptyMountFailPercent := flag.Int("emptyMountFailPercent", 100, "The percentage of the "+
+		"mounts of a dataset input that have to be empty for the input to fail. Fewer empty "+
+		"mounts produce a warning. 0 never fails the input.")
+	cleanupScratch := flag.Bool("cleanupScratch", false, "Remove the benchmark and cache "+
+		"directories created by the task when it succeeds. They are kept on failure.")
+	dataAuthWorkers := flag.Int("dataAuthWorkers", 4, "The number of inputs and outputs "+
+		"whose data access is validated in parallel before the task starts.")
+	reconnectAfterFinished := flag.Bool("reconnectAfterFinished", false, "Keep reconnecting to "+
+		"the OSMO service after it reports the task as finished. By default ctrl stops.")
+	sourceAddr := flag.String("sourceAddr", "", "Optional local IP address that connections "+
+		"to the OSMO service are made from, for nodes with several network interfaces.")
+	metadataPathMode := flag.String("metadataPathMode", "relative", "How metadata and label "+
+		"files named in dataset output specs are resolved: relative (to the output folder) or "+
+		"absolute (used as given).")
+	maxUDPFlows := flag.Int("maxUDPFlows", 1024, "The maximum number of client flows of a UDP "+
+		"port forward. The least recently used flow is closed for each new flow beyond it. 0 is "+
+		"unlimited.")
+	progressInterval := flag.Int("progressInterval", 0, "How often (s) to send the progress of "+
+		"each input and output to the service. Default to 0, which disables it.")
+	recordProtocol := flag.String("recordProtocol", "", "Optional file to record the messages "+
+		"received from the service and exchanged with the user container in, as JSON lines.")
+	downloadStagingPath := flag.String("downloadStagingPath", "", "Optional folder to download "+
+		"inputs into before moving them into their input folder once complete. It has to be on "+
+		"the same filesystem as the input folders.")
+	resourceMetricsInterval := flag.Int("resourceMetricsInterval", 0, "How often (s) to report "+
+		"the peak number of goroutines of ctrl. Default to 0, which disables it.")
+	goroutineWarnThreshold := flag.Int("goroutineWarnThreshold", 10000, "Number of goroutines "+
+		"above which a warning is sent when resource metrics are enabled. 0 disables the warning.")
+	execCloseStdin := flag.Bool("execCloseStdin", true, "Whether to close the stdin of an exec "+
+		"session when the client closes its input, so commands reading stdin see EOF.")
+	var allowOSMOCommands common.ArrayFlags
+	flag.Var(&allowOSMOCommands, "allowOSMOCommand", "Additional osmo subcommand ctrl may run, "+
+		"as <group>:<subcommand>. Can be repeated.")
+	logCommands := flag.Bool("logCommands", false, "Log the command line of each osmo command "+
+		"ctrl runs, with credentials redacted.")
+	phasesFile := flag.String("phasesFile", "", "Optional file to write the start and end time "+
+		"of each phase of the task to as JSON when ctrl exits.")
+	phaseMetrics := flag.Bool("phaseMetrics", false, "Send the start and end time of each "+
+		"phase of the task as a metric.")
+	mountTimeout := flag.Int("mountTimeout", 0, "How long (s) mounting an input may take before "+
+		"the mount is aborted and treated as failed. Inputs with a timeout use it instead. "+
+		"Default to 0, which never aborts.")
+	refreshMargin := flag.Int("refreshMargin", 60, "How long (s) before the jwt token expires "+
+		"to refresh it.")
+	outputResultsFile := flag.String("outputResultsFile", "", "Optional file to append the "+
+		"version, uri, size and checksum of each uploaded dataset to as JSON lines.")
+	maxReconnectBackoff := flag.Int("maxReconnectBackoff", 32, "The maximum time (s) to wait "+
+		"before reconnecting to the service or the router. The wait is randomized up to it.")
+	strictUpdatePaths := flag.Bool("strictUpdatePaths", false, "Fail the task when a path of "+
+		"a dataset update output has no files instead of skipping the path.")
+	caBundle := flag.String("caBundle", "", "Optional PEM file of CA certificates trusted in "+
+		"addition to the system roots. When set, the OSMO service certificate is verified.")
+	insecureSkipVerify := flag.Bool("insecureSkipVerify", false, "Skip verifying the "+
+		"certificate chain of the OSMO service when no CA bundle or pinned certificate is set. "+
+		"By default it is verified against the system roots.")
+	maxOutputBytes := flag.Int64("maxOutputBytes", 0, "The maximum total bytes of the outputs "+
+		"of the task. Larger outputs fail the task before uploading. Default to 0, which is "+
+		"unlimited.")
+	taskHost := flag.String("taskHost", "127.0.0.1", "Host or IP address the services of the "+
+		"task are forwarded to.")
+	udpIdleTimeout := flag.Int("udpIdleTimeout", 60, "How long (s) a client flow of a UDP port "+
+		"forward may go without datagrams before it is closed. 0 never closes idle flows.")
+	clampCpuCount := flag.Bool("clampCpuCount", false, "Use 1 process when the CPU_COUNT "+
+		"environment variable is invalid instead of failing at startup.")
+	logHighWaterMarks := flag.String("logHighWaterMarks", "80,95", "Comma separated fill "+
+		"percentages of the log buffer that send a warning when first reached, before logs are "+
+		"dropped. Empty disables the warnings.")
+	forwardDrainTimeout := flag.Int("forwardDrainTimeout", 10, "How long (s) to wait on shutdown "+
+		"for port forwards to close their connections and for their telemetry to be sent before "+
+		"exiting.")
+	startupRefreshTimeout := flag.Int("startupRefreshTimeout", 0, "How long (s) ctrl keeps "+
+		"retrying to retrieve its first jwt token at startup before failing. Defaults to 0, "+
+		"which retries until the task retry budget or the connection timeout is exhausted.")
+	execDuringRestart := flag.String("execDuringRestart", ExecDuringRestartReject, "How exec "+
+		"sessions requested while the user command restarts are handled: "+
+		ExecDuringRestartReject+" tells the client to retry, "+ExecDuringRestartWait+" starts "+
+		"the session once the restart finishes, up to the exec timeout.")
+	inputParallelism := flag.Int("inputParallelism", 1, "The number of inputs that are "+
+		"downloaded or mounted at the same time.")
+	outputParallelism := flag.Int("outputParallelism", 1, "The number of outputs that are "+
+		"uploaded at the same time.")
+	compressionLevel := flag.Int("compressionLevel", DefaultCompressionLevel, "The compression "+
+		"level of the data ctrl compresses. ctrl only compresses websocket messages: those to "+
+		"the OSMO service and those of port forwards, each only when the other end supports "+
+		"it. Transferred inputs and outputs are not compressed. Ranges from -2 (Huffman only) "+
+		"to 9 (best compression), 0 disables compression. Default to 6, which balances CPU "+
+		"and ratio.")
+	execLogGracePeriod := flag.Int("execLogGracePeriod", 2, "How long (s) ctrl keeps "+
+		"forwarding user command output and sending queued logs after exec finishes, before "+
+		"the outputs are uploaded. 0 moves on immediately.")
+	forwardListenCheck := flag.Bool("forwardListenCheck", false, "Check that the local port "+
+		"of a TCP port forward is listening when the forward is requested, and close the "+
+		"session with a reason for the router when it is not.")
+	printConfig := flag.Bool("printConfig", false, "Print the effective configuration, after "+
+		"defaults and validation are applied, and exit.")
 	flag.Parse()
 
 	// logSource is also the name of the task in the workflow
 	path := fmt.Sprintf("/api/logger/workflow/%s/osmo_ctrl/%s/retry_id/%s",
 		*workflow, *logSource, *retryId)
-	workflowServiceUrl := url.URL{Scheme: *scheme, Host: *host + ":" + *port, Path: path}
+	workflowServiceUrl := url.URL{Scheme: *scheme, Host: *host + ":" + *port, Path: path,
+		RawQuery: url.Values{"feature": CtrlFeatures}.Encode()}
 
 	refreshTokenPath := "/api/auth/jwt/refresh_token"
 	refreshTokenUrl := url.URL{Scheme: *refreshScheme, Host: *host + ":" + *port, Path: refreshTokenPath}
@@ -94,9 +312,73 @@ func CtrlParse() CtrlArgs {
 		finalLogsPeriod = 1
 	}
 
-	finalLogsBufferSize := *logsBufferSize
-	if finalLogsBufferSize <= 0 {
-		finalLogsBufferSize = 1
+	finalLogsBufferSize, err := clampLogsBufferSize(*logsBufferSize, *minLogsBufferSize,
+		*maxLogsBufferSize)
+	if err != nil {
+		panic(err)
+	}
+
+	finalInputParallelism := *inputParallelism
+	if finalInputParallelism <= 0 {
+		finalInputParallelism = 1
+	}
+
+	finalOutputParallelism := *outputParallelism
+	if finalOutputParallelism <= 0 {
+		finalOutputParallelism = 1
+	}
+
+	if *uploadOnly && *downloadOnly {
+		panic("uploadOnly and downloadOnly cannot be used together")
+	}
+
+	if *hostname == "" {
+		*hostname, _ = os.Hostname()
+	}
+
+	if *specFormat != "legacy" && *specFormat != "json" {
+		panic(fmt.Sprintf("Invalid specFormat %s, must be legacy or json", *specFormat))
+	}
+	if *metadataPathMode != "relative" && *metadataPathMode != "absolute" {
+		panic(fmt.Sprintf("Invalid metadataPathMode %s, must be relative or absolute",
+			*metadataPathMode))
+	}
+
+	minTLSVersion, err := parseTLSVersion(*tlsMinVersion)
+	if err != nil {
+		panic(err)
+	}
+	cipherSuites, err := parseCipherSuites(*tlsCipherSuites)
+	if err != nil {
+		panic(err)
+	}
+	pinnedFingerprint, err := parseFingerprint(*pinnedCertSHA256)
+	if err != nil {
+		panic(err)
+	}
+	localSourceAddr, err := parseSourceAddr(*sourceAddr)
+	if err != nil {
+		panic(err)
+	}
+	if err := validateTaskHost(*taskHost); err != nil {
+		panic(err)
+	}
+	if err := validateCompressionLevel(*compressionLevel); err != nil {
+		panic(err)
+	}
+	if *execDuringRestart != ExecDuringRestartReject && *execDuringRestart != ExecDuringRestartWait {
+		panic(fmt.Sprintf("Invalid execDuringRestart %s, must be %s or %s", *execDuringRestart,
+			ExecDuringRestartReject, ExecDuringRestartWait))
+	}
+	switch *missingCredential {
+	case MissingCredentialFallback, MissingCredentialFail:
+	default:
+		panic(fmt.Sprintf("Invalid missingMountCredential %s, must be %s or %s",
+			*missingCredential, MissingCredentialFallback, MissingCredentialFail))
+	}
+	highWaterMarks, err := parseHighWaterMarks(*logHighWaterMarks)
+	if err != nil {
+		panic(err)
 	}
 
 	parsedArgs := CtrlArgs{
@@ -126,6 +408,209 @@ func CtrlParse() CtrlArgs {
 		LogsPeriod:         finalLogsPeriod,
 		LogsBufferSize:     finalLogsBufferSize,
 		CacheSize:          *cacheSize,
+		LogSinkAddress:     *logSinkAddress,
+		LogSinkBufferSize:  *logSinkBufferSize,
+		TLSMinVersion:      minTLSVersion,
+		TLSCipherSuites:    cipherSuites,
+		UploadOnly:         *uploadOnly,
+		DownloadOnly:       *downloadOnly,
+		DirListingWorkers:  *dirListingWorkers,
+		DirListingTimeout:  time.Duration(*dirListingTimeout) * time.Second,
+		OutputScanWorkers:  *outputScanWorkers,
+		MetricsSigningKey:  *metricsSigningKey,
+		SpecFormat:         *specFormat,
+		StreamExecLogs:     *streamExecLogs,
+		ThroughputWindow:   time.Duration(*throughputWindow) * time.Second,
+		Hostname:           *hostname,
+		NodeLabel:          os.Getenv(*nodeLabelEnv),
+		StrictOutputs:      *strictOutputs,
+		MaxLogBytes:        *maxLogBytes,
+		ForwardDNSCacheTTL: time.Duration(*forwardDNSCacheTTL) * time.Second,
+		RecordExecDir:      *recordExecDir,
+		DownloadRetries:    *downloadRetries,
+		DownloadBackoff:    time.Duration(*downloadBackoff) * time.Second,
+		ControlSocket:      *controlSocket,
+		PinnedCertSHA256:   pinnedFingerprint,
+		SkipSelfCheck:      *skipSelfCheck,
+		HandshakeTimeout:   time.Duration(*handshakeTimeout) * time.Second,
+		UploadShards:       *uploadShards,
+
+		ForwardProbe:        *forwardProbe,
+		ForwardProbePath:    *forwardProbePath,
+		ForwardProbeTimeout: time.Duration(*forwardProbeTimeout) * time.Second,
+
+		DroppedLogsInterval: time.Duration(*droppedLogsInterval) * time.Second,
+
+		LogDoneBeforeUpload: *logDoneBeforeUpload,
+
+		PerForwardBandwidth: *perForwardBandwidth,
+
+		AllowDuplicateInputFolders: *allowDuplicateInputFolders,
+		MaxTotalRetries:            *maxTotalRetries,
+		FollowTerminationSymlink:   *followTerminationSymlink,
+		EmptyMountFailPercent:      *emptyMountFailPercent,
+		CleanupScratch:             *cleanupScratch,
+		DataAuthWorkers:            *dataAuthWorkers,
+		ReconnectAfterFinished:     *reconnectAfterFinished,
+		SourceAddr:                 localSourceAddr,
+		MetadataPathMode:           *metadataPathMode,
+		MaxUDPFlows:                *maxUDPFlows,
+		ProgressInterval:           time.Duration(*progressInterval) * time.Second,
+		RecordProtocol:             *recordProtocol,
+		DownloadStagingPath:        *downloadStagingPath,
+		ResourceMetricsInterval:    time.Duration(*resourceMetricsInterval) * time.Second,
+		GoroutineWarnThreshold:     *goroutineWarnThreshold,
+		ExecCloseStdin:             *execCloseStdin,
+		AllowOSMOCommands:          allowOSMOCommands,
+		LogCommands:                *logCommands,
+		PhasesFile:                 *phasesFile,
+		PhaseMetrics:               *phaseMetrics,
+		MountTimeout:               time.Duration(*mountTimeout) * time.Second,
+		RefreshMargin:              time.Duration(*refreshMargin) * time.Second,
+		OutputResultsFile:          *outputResultsFile,
+		MaxReconnectBackoff:        time.Duration(*maxReconnectBackoff) * time.Second,
+		StrictUpdatePaths:          *strictUpdatePaths,
+		CABundle:                   *caBundle,
+		InsecureSkipVerify:         *insecureSkipVerify,
+		MaxOutputBytes:             *maxOutputBytes,
+		TaskHost:                   *taskHost,
+		UDPIdleTimeout:             time.Duration(*udpIdleTimeout) * time.Second,
+		ClampCpuCount:              *clampCpuCount,
+		LogHighWaterMarks:          highWaterMarks,
+		ForwardDrainTimeout:        time.Duration(*forwardDrainTimeout) * time.Second,
+		StartupRefreshTimeout:      time.Duration(*startupRefreshTimeout) * time.Second,
+		ExecDuringRestart:          *execDuringRestart,
+		InputParallelism:           finalInputParallelism,
+		OutputParallelism:          finalOutputParallelism,
+		CompressionLevel:           *compressionLevel,
+		ExecLogGracePeriod:         time.Duration(*execLogGracePeriod) * time.Second,
+		ForwardListenCheck:         *forwardListenCheck,
+		TerminationLog:             *terminationLog,
+		MissingMountCredential:     *missingCredential,
+		PrintConfig:                *printConfig,
+
+		// Experimental flags
+		ReadWriteDatasetMounts: *readWriteDatasetMounts,
 	}
 	return parsedArgs
 }
+
+func parseTLSVersion(version string) (uint16, error) {
+	switch version {
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unsupported minimum TLS version %s, expected 1.2 or 1.3", version)
+}
+
+// parseHighWaterMarks parses comma separated percentages between 1 and 100 into ascending order
+func parseHighWaterMarks(percentages string) ([]int, error) {
+	if percentages == "" {
+		return nil, nil
+	}
+	var marks []int
+	for _, percentage := range strings.Split(percentages, ",") {
+		mark, err := strconv.Atoi(strings.TrimSpace(percentage))
+		if err != nil || mark < 1 || mark > 100 {
+			return nil, fmt.Errorf("invalid log high water mark %q, must be a percentage "+
+				"between 1 and 100", percentage)
+		}
+		marks = append(marks, mark)
+	}
+	sort.Ints(marks)
+	return marks, nil
+}
+
+func parseCipherSuites(names string) ([]uint16, error) {
+	if names == "" {
+		return nil, nil
+	}
+	available := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		available[suite.Name] = suite.ID
+	}
+
+	var cipherSuites []uint16
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		id, ok := available[name]
+		if !ok {
+			return nil, fmt.Errorf("unsupported TLS cipher suite %s", name)
+		}
+		cipherSuites = append(cipherSuites, id)
+	}
+	return cipherSuites, nil
+}
+
+// Parse a hex encoded SHA-256 fingerprint, optionally separated by colons
+func parseFingerprint(fingerprint string) ([]byte, error) {
+	if fingerprint == "" {
+		return nil, nil
+	}
+	decoded, err := hex.DecodeString(strings.ReplaceAll(fingerprint, ":", ""))
+	if err != nil || len(decoded) != sha256.Size {
+		return nil, fmt.Errorf("invalid SHA-256 certificate fingerprint %s", fingerprint)
+	}
+	return decoded, nil
+}
+
+// parseSourceAddr parses the source address and checks that it is assigned to this host
+func parseSourceAddr(addr string) (net.IP, error) {
+	if addr == "" {
+		return nil, nil
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid sourceAddr %s, must be an IP address", addr)
+	}
+	interfaceAddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list local addresses: %w", err)
+	}
+	for _, interfaceAddr := range interfaceAddrs {
+		if ipNet, ok := interfaceAddr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return ip, nil
+		}
+	}
+	return nil, fmt.Errorf("sourceAddr %s is not an address of this host", addr)
+}
+
+// clampLogsBufferSize limits the log buffer size to [minSize, maxSize] and logs a size that is out
+// of range. Bounds that do not allow a buffer of at least one record are an error.
+func clampLogsBufferSize(size int, minSize int, maxSize int) (int, error) {
+	if minSize < 1 || maxSize < minSize {
+		return 0, fmt.Errorf("invalid log buffer size bounds [%d, %d], minLogsBufferSize must "+
+			"be at least 1 and at most maxLogsBufferSize", minSize, maxSize)
+	}
+	clamped := min(max(size, minSize), maxSize)
+	if clamped != size {
+		log.Printf("logsBufferSize %d is outside of [%d, %d], using %d", size, minSize, maxSize,
+			clamped)
+	}
+	return clamped, nil
+}
+
+// Compression level that balances the CPU spent against the compression ratio
+const DefaultCompressionLevel = 6
+
+// validateCompressionLevel checks the level is within the range of the gzip and deflate codecs
+func validateCompressionLevel(level int) error {
+	if level < flate.HuffmanOnly || level > flate.BestCompression {
+		return fmt.Errorf("invalid compressionLevel %d, must be between %d and %d", level,
+			flate.HuffmanOnly, flate.BestCompression)
+	}
+	return nil
+}
+
+// validateTaskHost checks that the task host is an IP address or a host name without a port
+func validateTaskHost(host string) error {
+	if net.ParseIP(host) != nil {
+		return nil
+	}
+	if host == "" || strings.ContainsAny(host, ":/ ") {
+		return fmt.Errorf("invalid taskHost %q, must be an IP address or a host name", host)
+	}
+	return nil
+}
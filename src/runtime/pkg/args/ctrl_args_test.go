@@ -0,0 +1,62 @@
+/*
+SPDX-FileCopyrightText: Copyright (c) 2025 NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package args
+
+import "testing"
+
+func TestClampLogsBufferSize(t *testing.T) {
+	tests := []struct {
+		name    string
+		size    int
+		minSize int
+		maxSize int
+		want    int
+		wantErr bool
+	}{
+		{name: "zero", size: 0, minSize: 100, maxSize: 1000, want: 100},
+		{name: "negative", size: -5, minSize: 100, maxSize: 1000, want: 100},
+		{name: "below the minimum", size: 99, minSize: 100, maxSize: 1000, want: 100},
+		{name: "minimum", size: 100, minSize: 100, maxSize: 1000, want: 100},
+		{name: "in range", size: 500, minSize: 100, maxSize: 1000, want: 500},
+		{name: "maximum", size: 1000, minSize: 100, maxSize: 1000, want: 1000},
+		{name: "above the maximum", size: 1001, minSize: 100, maxSize: 1000, want: 1000},
+		{name: "single element bounds", size: 0, minSize: 1, maxSize: 1, want: 1},
+		{name: "zero minimum", size: 10, minSize: 0, maxSize: 1000, wantErr: true},
+		{name: "negative minimum", size: 10, minSize: -1, maxSize: 1000, wantErr: true},
+		{name: "maximum below the minimum", size: 10, minSize: 100, maxSize: 99, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := clampLogsBufferSize(test.size, test.minSize, test.maxSize)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got size %d", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("expected size %d, got %d", test.want, got)
+			}
+		})
+	}
+}
@@ -38,6 +38,8 @@ func ExecParse() ExecArgs {
 		"historyFilePath", "/osmo/data/.bash_history", "History file path.")
 	runLocation := flag.String("runLocation", "/osmo/run", "Run location.")
 	enableRsync := flag.Bool("enableRsync", false, "Enable rsync.")
+	rsyncPort := flag.Int("rsyncPort", int(common.RsyncPort),
+		"Port the rsync server listens on. 0 selects a free port.")
 	rsyncReadLimit := flag.Int("rsyncReadLimit", 0, "Read limit in bytes per second.")
 	rsyncWriteLimit := flag.Int("rsyncWriteLimit", 0, "Write limit in bytes per second.")
 	rsyncAllowedPaths := flag.String("rsyncPathAllowList", "", "Allowed paths for rsync.")
@@ -68,6 +70,7 @@ func ExecParse() ExecArgs {
 
 		// Rsync flags
 		EnableRsync:        *enableRsync,
+		RsyncPort:          *rsyncPort,
 		RsyncReadLimit:     *rsyncReadLimit,
 		RsyncWriteLimit:    *rsyncWriteLimit,
 		RsyncPathAllowList: *rsyncAllowedPaths,
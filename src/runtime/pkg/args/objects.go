@@ -19,6 +19,7 @@ SPDX-License-Identifier: Apache-2.0
 package args
 
 import (
+	"net"
 	"net/url"
 	"time"
 
@@ -37,6 +38,7 @@ type ExecArgs struct {
 
 	// Rsync flags
 	EnableRsync        bool
+	RsyncPort          int
 	RsyncReadLimit     int
 	RsyncWriteLimit    int
 	RsyncPathAllowList string
@@ -72,4 +74,91 @@ type CtrlArgs struct {
 	LogsPeriod         int
 	LogsBufferSize     int
 	CacheSize          int
+	LogSinkAddress     string
+	LogSinkBufferSize  int
+	TLSMinVersion      uint16
+	TLSCipherSuites    []uint16
+	UploadOnly         bool
+	DownloadOnly       bool
+	DirListingWorkers  int
+	DirListingTimeout  time.Duration
+	OutputScanWorkers  int
+	MetricsSigningKey  string
+	SpecFormat         string
+	StreamExecLogs     bool
+	ThroughputWindow   time.Duration
+	Hostname           string
+	NodeLabel          string
+	StrictOutputs      bool
+	MaxLogBytes        int64
+	ForwardDNSCacheTTL time.Duration
+	RecordExecDir      string
+	DownloadRetries    int
+	DownloadBackoff    time.Duration
+	ControlSocket      string
+	PinnedCertSHA256   []byte
+	SkipSelfCheck      bool
+	HandshakeTimeout   time.Duration
+	UploadShards       int
+
+	// Readiness probe run against the local server before a port forward connection starts
+	ForwardProbe        string
+	ForwardProbePath    string
+	ForwardProbeTimeout time.Duration
+
+	// How often to report the streams and times of dropped log records
+	DroppedLogsInterval time.Duration
+
+	// Signal log done before uploading outputs instead of after
+	LogDoneBeforeUpload bool
+
+	// Bytes per second allowed in each direction of a port forward connection. Zero is unlimited.
+	PerForwardBandwidth int64
+
+	AllowDuplicateInputFolders bool
+	MaxTotalRetries            int
+	FollowTerminationSymlink   bool
+	EmptyMountFailPercent      int
+	CleanupScratch             bool
+	DataAuthWorkers            int
+	ReconnectAfterFinished     bool
+	SourceAddr                 net.IP
+	MetadataPathMode           string
+	MaxUDPFlows                int
+	ProgressInterval           time.Duration
+	RecordProtocol             string
+	DownloadStagingPath        string
+	ResourceMetricsInterval    time.Duration
+	GoroutineWarnThreshold     int
+	ExecCloseStdin             bool
+	AllowOSMOCommands          common.ArrayFlags
+	LogCommands                bool
+	PhasesFile                 string
+	PhaseMetrics               bool
+	MountTimeout               time.Duration
+	RefreshMargin              time.Duration
+	OutputResultsFile          string
+	MaxReconnectBackoff        time.Duration
+	StrictUpdatePaths          bool
+	CABundle                   string
+	InsecureSkipVerify         bool
+	MaxOutputBytes             int64
+	TaskHost                   string
+	UDPIdleTimeout             time.Duration
+	ClampCpuCount              bool
+	LogHighWaterMarks          []int
+	ForwardDrainTimeout        time.Duration
+	StartupRefreshTimeout      time.Duration
+	ExecDuringRestart          string
+	InputParallelism           int
+	OutputParallelism          int
+	CompressionLevel           int
+	ExecLogGracePeriod         time.Duration
+	ForwardListenCheck         bool
+	TerminationLog             string
+	MissingMountCredential     string
+	PrintConfig                bool
+
+	// Experimental flags
+	ReadWriteDatasetMounts bool
 }
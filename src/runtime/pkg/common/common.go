@@ -20,16 +20,22 @@ package common
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"math"
+	"math/rand"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"go.corp.nvidia.com/osmo/runtime/pkg/osmo_errors"
 )
@@ -67,14 +73,136 @@ func AppendStringToList(s string, l []string) []string {
 	return outArray
 }
 
-func GetFiles(s string, osmoChan chan string) []string {
-	files, err := filepath.Glob(s)
-	if err != nil {
+// Number of goroutines GetFiles matches files with. The directories matched by the directory part
+// of a pattern are scanned concurrently, and the entries of a single directory are matched in
+// batches while it is still being listed.
+var OutputScanWorkers int = 1
+
+// Number of directory entries listed at a time, so a scan can stop between batches
+const scanBatchSize = 4096
+
+// GetFiles returns the files matching pattern s, like filepath.Glob. The scan stops without
+// matches once ctx is cancelled.
+func GetFiles(ctx context.Context, s string, osmoChan chan string) []string {
+	files, err := globParallel(ctx, s, OutputScanWorkers)
+	if err != nil && ctx.Err() == nil {
 		osmo_errors.LogError("", "", osmoChan, err, osmo_errors.INVALID_INPUT_CODE)
 	}
 	return files
 }
 
+// globParallel returns the same matches as filepath.Glob, in the same order. The matched
+// directories and the batches of entries of each directory are matched by up to workers
+// goroutines.
+func globParallel(ctx context.Context, pattern string, workers int) ([]string, error) {
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	dir, file := filepath.Split(pattern)
+	switch dir {
+	case "":
+		dir = "."
+	case string(filepath.Separator):
+	default:
+		dir = dir[:len(dir)-1]
+	}
+	if !strings.ContainsAny(file, `*?[\`) {
+		return filepath.Glob(pattern)
+	}
+	if !strings.ContainsAny(dir, `*?[\`) {
+		return matchDir(ctx, dir, file, workers)
+	}
+
+	dirs, err := filepath.Glob(dir)
+	if err != nil {
+		return nil, err
+	}
+	dirMatches := make([][]string, len(dirs))
+	semaphore := make(chan bool, max(workers, 1))
+	var wg sync.WaitGroup
+	for i, dirPath := range dirs {
+		wg.Add(1)
+		go func(i int, dirPath string) {
+			defer wg.Done()
+			semaphore <- true
+			defer func() { <-semaphore }()
+			// A scan only fails when ctx is cancelled, which is checked once all are done
+			dirMatches[i], _ = matchDir(ctx, dirPath, file, 1)
+		}(i, dirPath)
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var matches []string
+	for _, m := range dirMatches {
+		matches = append(matches, m...)
+	}
+	return matches, nil
+}
+
+// matchDir returns the sorted entries of dirPath matching pattern. The entries are listed in
+// batches, which up to workers goroutines match while the next batches are listed. Like
+// filepath.Glob, a directory that cannot be read has no matches.
+func matchDir(ctx context.Context, dirPath string, pattern string,
+	workers int) ([]string, error) {
+	info, err := os.Stat(dirPath)
+	if err != nil || !info.IsDir() {
+		return nil, nil
+	}
+	d, err := os.Open(dirPath)
+	if err != nil {
+		return nil, nil
+	}
+	defer d.Close()
+
+	var batchMatches [][]string
+	var batchMutex sync.Mutex
+	semaphore := make(chan bool, max(workers, 1))
+	var wg sync.WaitGroup
+	for {
+		if err := ctx.Err(); err != nil {
+			wg.Wait()
+			return nil, err
+		}
+		names, err := d.Readdirnames(scanBatchSize)
+		if len(names) > 0 {
+			batchMutex.Lock()
+			batch := len(batchMatches)
+			batchMatches = append(batchMatches, nil)
+			batchMutex.Unlock()
+
+			wg.Add(1)
+			semaphore <- true
+			go func() {
+				defer wg.Done()
+				defer func() { <-semaphore }()
+				var matches []string
+				for _, name := range names {
+					if matched, _ := filepath.Match(pattern, name); matched {
+						matches = append(matches, filepath.Join(dirPath, name))
+					}
+				}
+				batchMutex.Lock()
+				batchMatches[batch] = matches
+				batchMutex.Unlock()
+			}()
+		}
+		if err != nil {
+			break
+		}
+	}
+	wg.Wait()
+
+	var matches []string
+	for _, m := range batchMatches {
+		matches = append(matches, m...)
+	}
+	sort.Strings(matches)
+	return matches, nil
+}
+
 func IsDirEmpty(name string) (bool, error) {
 	f, err := os.Open(name)
 	if err != nil {
@@ -153,10 +281,11 @@ type CircularBuffer struct {
 	count int
 }
 
-// NewCircularBuffer creates a new circular buffer with the given size.
+// NewCircularBuffer creates a new circular buffer with the given size, holding at least one
+// element.
 func NewCircularBuffer(size int) *CircularBuffer {
 	return &CircularBuffer{
-		data: make([]string, size),
+		data: make([]string, max(size, 1)),
 	}
 }
 
@@ -165,6 +294,16 @@ func (cb *CircularBuffer) IsFull() bool {
 	return cb.count == len(cb.data)
 }
 
+// Len returns the number of elements in the circular buffer.
+func (cb *CircularBuffer) Len() int {
+	return cb.count
+}
+
+// Cap returns the number of elements the circular buffer holds before overwriting.
+func (cb *CircularBuffer) Cap() int {
+	return len(cb.data)
+}
+
 // IsEmpty checks if the circular buffer is empty.
 func (cb *CircularBuffer) IsEmpty() bool {
 	return cb.count == 0
@@ -250,8 +389,12 @@ func RunCommand(cmd *exec.Cmd,
 	stderrScanner.Split(splitFunc)
 
 	cmd.Start()
+	streamErrDone := make(chan struct{})
 	go streamOutCommand(cmd, stdoutScanner, waitStreamLogs, timeoutChan)
-	go streamErrCommand(stderrScanner, waitStreamLogs)
+	go func() {
+		defer close(streamErrDone)
+		streamErrCommand(stderrScanner, waitStreamLogs)
+	}()
 	waitStreamLogs.Wait()
 
 	if <-timeoutChan {
@@ -261,6 +404,9 @@ func RunCommand(cmd *exec.Cmd,
 		return "", &osmo_errors.TimeoutError{S: "Command timed out"}
 	}
 
+	// Wait closes the pipes, so stderr is read to the end first. Its logs are then sent before
+	// the caller moves on, as the caller may close the log channel once the command is done.
+	<-streamErrDone
 	err = cmd.Wait()
 	return fmt.Sprintf("Command failed with error: %v\n", err), err
 }
@@ -306,3 +452,134 @@ func LongestCommonPathPrefix(strs []string) string {
 	}
 	return longestPathPrefix
 }
+
+// Retries left across the whole task, only consulted once a budget is set
+var retryBudget atomic.Int64
+var retryBudgetSet atomic.Bool
+
+// Retries of the task budget as set at startup
+var retryBudgetSize int
+
+// SetRetryBudget caps the total number of retries of the task. A budget of 0 or less is unlimited.
+func SetRetryBudget(retries int) {
+	if retries <= 0 {
+		return
+	}
+	retryBudgetSize = retries
+	retryBudget.Store(int64(retries))
+	retryBudgetSet.Store(true)
+}
+
+// RetryBudgetExhausted describes a failure after attempts once TakeRetry returned false
+func RetryBudgetExhausted(attempts int) string {
+	return fmt.Sprintf("Failed after %d attempts, the task retry budget of %d retries is exhausted",
+		attempts, retryBudgetSize)
+}
+
+// TakeRetry consumes one retry from the task retry budget. Returns false once the budget is spent,
+// in which case the caller should fail instead of retrying.
+func TakeRetry() bool {
+	if !retryBudgetSet.Load() {
+		return true
+	}
+	return retryBudget.Add(-1) >= 0
+}
+
+// Backoff computes how long to wait before a retry
+type Backoff interface {
+	Delay(attempt int) time.Duration
+}
+
+// ExponentialBackoff waits Base * 2^attempt, capped at Max. With Jitter, the delay is lowered by
+// a random fraction of up to Jitter of its distance to Base, so a Jitter of 1 waits a uniformly
+// random time between Base and the exponential delay.
+type ExponentialBackoff struct {
+	Base   time.Duration
+	Max    time.Duration
+	Jitter float64
+	// Source of the jitter, returning values in [0, 1). Defaults to a time seeded source.
+	Random func() float64
+}
+
+func (b ExponentialBackoff) Delay(attempt int) time.Duration {
+	delay := b.exponentialDelay(attempt)
+	if b.Jitter > 0 {
+		delay -= b.Jitter * b.random() * (delay - float64(b.Base))
+	}
+	return time.Duration(delay)
+}
+
+// FullJitterDelay waits a uniformly random time between 0 and Base * 2^attempt, capped at Max.
+// Jitter is ignored.
+func (b ExponentialBackoff) FullJitterDelay(attempt int) time.Duration {
+	return time.Duration(b.random() * b.exponentialDelay(attempt))
+}
+
+func (b ExponentialBackoff) exponentialDelay(attempt int) float64 {
+	delay := float64(b.Base) * math.Pow(2, float64(max(attempt, 0)))
+	if b.Max > 0 {
+		delay = math.Min(delay, float64(b.Max))
+	}
+	return delay
+}
+
+func (b ExponentialBackoff) random() float64 {
+	if b.Random == nil {
+		return rand.Float64()
+	}
+	return b.Random()
+}
+
+// NewSeededRandom returns a jitter source with a fixed seed, so backoff delays are reproducible.
+// It is safe for concurrent use.
+func NewSeededRandom(seed int64) func() float64 {
+	var mutex sync.Mutex
+	source := rand.New(rand.NewSource(seed))
+	return func() float64 {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return source.Float64()
+	}
+}
+
+// BackoffWithJitter waits a uniformly random time between 0 and 2^retryCount seconds, capped at
+// maxDelay. The full jitter spreads out clients that start retrying at the same time.
+func BackoffWithJitter(retryCount int, maxDelay time.Duration) time.Duration {
+	backoff := ExponentialBackoff{Base: time.Second, Max: max(maxDelay, time.Second)}
+	return backoff.FullJitterDelay(retryCount)
+}
+
+// RateLimiter paces a stream of bytes to a fixed rate, allowing bursts of up to one second of
+// bytes. A nil RateLimiter is unlimited. It is not safe for concurrent use.
+type RateLimiter struct {
+	bytesPerSecond float64
+	tokens         float64
+	last           time.Time
+}
+
+// NewRateLimiter returns nil, which is unlimited, when bytesPerSecond is not positive
+func NewRateLimiter(bytesPerSecond int64) *RateLimiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return &RateLimiter{
+		bytesPerSecond: float64(bytesPerSecond),
+		tokens:         float64(bytesPerSecond),
+		last:           time.Now(),
+	}
+}
+
+// Wait blocks until n more bytes may be sent
+func (r *RateLimiter) Wait(n int) {
+	if r == nil {
+		return
+	}
+	now := time.Now()
+	r.tokens = math.Min(r.bytesPerSecond,
+		r.tokens+now.Sub(r.last).Seconds()*r.bytesPerSecond)
+	r.last = now
+	r.tokens -= float64(n)
+	if r.tokens < 0 {
+		time.Sleep(time.Duration(-r.tokens / r.bytesPerSecond * float64(time.Second)))
+	}
+}
@@ -0,0 +1,217 @@
+/*
+SPDX-FileCopyrightText: Copyright (c) 2025 NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestGlobParallel(t *testing.T) {
+	root := t.TempDir()
+	// More entries than a listing batch, so a directory is matched in several batches
+	for i := range scanBatchSize + 10 {
+		if err := os.WriteFile(filepath.Join(root, fmt.Sprintf("file%d.txt", i)), nil,
+			0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, dir := range []string{"a", "b", "c"} {
+		if err := os.MkdirAll(filepath.Join(root, dir, "sub"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{"x.bin", "y.txt"} {
+			if err := os.WriteFile(filepath.Join(root, dir, name), nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	patterns := []string{
+		root + "/*",
+		root + "/*.txt",
+		root + "/file1*",
+		root + "/*/*.txt",
+		root + "/[ab]/*",
+		root + "/a/x.bin",
+		root + "/missing/*",
+	}
+	for _, pattern := range patterns {
+		want, err := filepath.Glob(pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, workers := range []int{1, 4} {
+			got, err := globParallel(context.Background(), pattern, workers)
+			if err != nil {
+				t.Fatalf("%s with %d workers: %v", pattern, workers, err)
+			}
+			if !slices.Equal(got, want) {
+				t.Errorf("%s with %d workers: got %d matches, want %d", pattern, workers,
+					len(got), len(want))
+			}
+		}
+	}
+
+	if _, err := globParallel(context.Background(), root+"/[", 4); err == nil {
+		t.Error("expected a malformed pattern to fail")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := globParallel(ctx, root+"/*", 4); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected a cancelled scan to fail with context.Canceled, got %v", err)
+	}
+}
+
+func TestNewCircularBufferSize(t *testing.T) {
+	for _, size := range []int{-1, 0, 1} {
+		buffer := NewCircularBuffer(size)
+		if buffer.Cap() != 1 {
+			t.Fatalf("expected a buffer of size %d to hold one record, got %d", size,
+				buffer.Cap())
+		}
+		buffer.Push("first")
+		buffer.Push("second")
+		if record, err := buffer.Pop(); err != nil || record != "second" {
+			t.Errorf("expected the newest record of a buffer of size %d, got %q, %v", size,
+				record, err)
+		}
+	}
+}
+
+func TestExponentialBackoffSeededJitter(t *testing.T) {
+	newBackoff := func() ExponentialBackoff {
+		return ExponentialBackoff{Base: time.Second, Max: time.Minute, Jitter: 1,
+			Random: NewSeededRandom(42)}
+	}
+	first, second := newBackoff(), newBackoff()
+	for attempt := range 10 {
+		if delay, other := first.Delay(attempt), second.Delay(attempt); delay != other {
+			t.Fatalf("expected the same delay for attempt %d with the same seed, got %s and %s",
+				attempt, delay, other)
+		}
+		if delay, other := first.FullJitterDelay(attempt),
+			second.FullJitterDelay(attempt); delay != other {
+			t.Fatalf("expected the same full jitter delay for attempt %d with the same seed, "+
+				"got %s and %s", attempt, delay, other)
+		}
+	}
+
+	half := ExponentialBackoff{Base: time.Second, Max: time.Minute, Jitter: 1,
+		Random: func() float64 { return 0.5 }}
+	if delay := half.Delay(3); delay != 4500*time.Millisecond {
+		t.Errorf("expected half way between 1s and 8s, got %s", delay)
+	}
+	if delay := half.FullJitterDelay(3); delay != 4*time.Second {
+		t.Errorf("expected half of 8s, got %s", delay)
+	}
+}
+
+func TestBackoffWithJitterDistribution(t *testing.T) {
+	const samples = 2000
+	for _, maxDelay := range []time.Duration{0, 5 * time.Second, 30 * time.Second} {
+		for retryCount := range 20 {
+			// The delay is capped at maxDelay, which is at least one second
+			bound := time.Duration(1<<retryCount) * time.Second
+			if maxDelay < time.Second {
+				bound = time.Second
+			} else if bound > maxDelay {
+				bound = maxDelay
+			}
+			var sum, highest time.Duration
+			lowest := bound
+			for range samples {
+				delay := BackoffWithJitter(retryCount, maxDelay)
+				if delay < 0 || delay > bound {
+					t.Fatalf("delay %s of retry %d is outside of [0, %s]", delay, retryCount,
+						bound)
+				}
+				sum += delay
+				if delay < lowest {
+					lowest = delay
+				}
+				if delay > highest {
+					highest = delay
+				}
+			}
+			// Full jitter is uniform over [0, bound], so the mean is half of the bound and the
+			// samples reach both ends of the range
+			mean := float64(sum) / samples / float64(bound)
+			if mean < 0.45 || mean > 0.55 {
+				t.Errorf("expected a mean of half of %s for retry %d, got %.2f of it", bound,
+					retryCount, mean)
+			}
+			if lowest > bound/10 || highest < bound*9/10 {
+				t.Errorf("expected delays of retry %d to span [0, %s], got [%s, %s]",
+					retryCount, bound, lowest, highest)
+			}
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	const bytesPerSecond = 1 << 20
+	const chunk = 16 << 10
+	// The first second of bytes is sent as a burst, so the other half second is paced
+	const total = 3 * bytesPerSecond / 2
+	limiter := NewRateLimiter(bytesPerSecond)
+	start := time.Now()
+	for sent := 0; sent < total; sent += chunk {
+		limiter.Wait(chunk)
+	}
+	elapsed := time.Since(start)
+	if elapsed < 450*time.Millisecond || elapsed > time.Second {
+		t.Errorf("expected %d bytes at %d bytes per second to take about 500ms, took %s", total,
+			bytesPerSecond, elapsed)
+	}
+
+	if NewRateLimiter(0) != nil {
+		t.Error("expected a rate of 0 to be unlimited")
+	}
+	var unlimited *RateLimiter
+	unlimited.Wait(total)
+}
+
+func TestRetryBudget(t *testing.T) {
+	defer func() {
+		retryBudgetSet.Store(false)
+		retryBudgetSize = 0
+	}()
+
+	SetRetryBudget(2)
+	for i := range 2 {
+		if !TakeRetry() {
+			t.Fatalf("expected retry %d to be within the budget", i+1)
+		}
+	}
+	if TakeRetry() {
+		t.Fatal("expected the budget to be exhausted")
+	}
+	want := "Failed after 3 attempts, the task retry budget of 2 retries is exhausted"
+	if message := RetryBudgetExhausted(3); message != want {
+		t.Errorf("expected %q, got %q", want, message)
+	}
+}
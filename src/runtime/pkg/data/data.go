@@ -21,42 +21,86 @@ package data
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
+	"io/fs"
 	"log"
 	"math"
-	"math/rand"
 	"net"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"go.corp.nvidia.com/osmo/runtime/pkg/common"
+	"go.corp.nvidia.com/osmo/runtime/pkg/metrics"
 	"go.corp.nvidia.com/osmo/runtime/pkg/osmo_errors"
 )
 
+// How long a data transfer may go without output before it is killed and retried. This bounds
+// inactivity, not the total time of the transfer.
 var DataTimeout time.Duration = 10 * time.Minute
 
+// Wait before retrying an OSMO command that was rate limited by the service
+var RateLimitBackoff common.Backoff = common.ExponentialBackoff{
+	Base:   time.Second,
+	Max:    32 * time.Second,
+	Jitter: 1,
+}
+
 // Number of CPUs available to the Golang process. This may be used to by OSMO commands that are
 // capable of multiprocessing.
 var CpuCount string = "1"
 
+// CpuCountAuto resolves the cpu count to the number of CPUs usable by the Golang process
+const CpuCountAuto string = "auto"
+
+// ParseCpuCount resolves the CPU_COUNT value to a positive number of processes. An empty value
+// means 1 and CpuCountAuto means runtime.NumCPU().
+func ParseCpuCount(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	switch value {
+	case "":
+		return "1", nil
+	case CpuCountAuto:
+		return strconv.Itoa(runtime.NumCPU()), nil
+	}
+	count, err := strconv.Atoi(value)
+	if err != nil || count < 1 {
+		return "", fmt.Errorf("invalid cpu count %q, must be a positive integer or %q",
+			value, CpuCountAuto)
+	}
+	return strconv.Itoa(count), nil
+}
+
 var MountRetryCount int = 3
 
+// Experimental: let tasks modify mounted datasets and upload the changes as a new version when
+// the mounts are cleaned up
+var ReadWriteDatasetMounts bool = false
+
 const (
 	Download         string = "download"
 	Mountpoint       string = "mountpoint-s3"
 	MountpointFailed string = "mountpoint-s3-failed"
+	MountpointEmpty  string = "mountpoint-s3-empty"
 	NotApplicable    string = "N/A"
 	BenchmarkSuffix  string = "_benchmark.json"
-	BenchmarkPath    string = "/osmo/data/benchmarks/"
+	InputMarkerPath  string = "/osmo/data/input_markers/"
 )
 
+// Directory the OSMO CLI writes the benchmarks of each transfer to
+var BenchmarkPath string = "/osmo/data/benchmarks/"
+
 const (
 	URLOperation     string = "Url"
 	DatasetOperation string = "Dataset"
@@ -71,12 +115,50 @@ type VersionInfo struct {
 	Version      string
 }
 
+// Dataset type of a collection. The versions of a collection are its members, each a version of
+// another dataset with its own hash location.
+const DatasetTypeCollection string = "COLLECTION"
+
 type DatasetInfo struct {
 	Type         string
 	Versions     []VersionInfo
 	HashLocation string `json:"hash_location"`
 }
 
+// validateCollection checks that every member of a collection can be placed in its own folder of
+// the input. Members that are collections themselves have no hash location and are not supported.
+func validateCollection(datasetInfo DatasetInfo, downloadType string) error {
+	members := map[string]bool{}
+	for _, member := range datasetInfo.Versions {
+		if member.Name == "" || member.Version == "" || member.Uri == "" {
+			return fmt.Errorf("collection member %q is missing its name, version or uri",
+				member.Name)
+		}
+		if members[member.Name] {
+			return fmt.Errorf("collection has more than one version of member %s, which would "+
+				"be placed in the same folder", member.Name)
+		}
+		members[member.Name] = true
+		if downloadType == Mountpoint && member.HashLocation == "" {
+			return fmt.Errorf("collection member %s has no hash location, nested collections "+
+				"are not supported", member.Name)
+		}
+	}
+	return nil
+}
+
+// versionLayout returns the benchmark path, manifest folder and hash location of a version of a
+// dataset input. Members of a collection keep their benchmarks and manifest in a folder of their
+// name, so their metrics are attributed to them, and are mounted from their own hash location.
+func versionLayout(datasetInfo DatasetInfo, versionInfo VersionInfo, benchmarkPath string,
+	manifestFolder string) (string, string, string) {
+	if datasetInfo.Type == DatasetTypeCollection {
+		return benchmarkPath + "/" + versionInfo.Name, manifestFolder + "/" + versionInfo.Name,
+			versionInfo.HashLocation
+	}
+	return benchmarkPath, manifestFolder, datasetInfo.HashLocation
+}
+
 type DatasetStartInfo struct {
 	VersionID string `json:"version_id"`
 }
@@ -115,6 +197,149 @@ func (mm *MountMap) Load(uriPath string) {
 	}
 }
 
+// Dataset folder whose locally written files are uploaded when the user command succeeds
+type writeBackMount struct {
+	Dataset string
+	Folder  string
+}
+
+var writeBackMounts []writeBackMount
+var writeBackLock sync.Mutex
+
+func registerWriteBackMount(dataset string, folder string) {
+	writeBackLock.Lock()
+	defer writeBackLock.Unlock()
+	writeBackMounts = append(writeBackMounts, writeBackMount{Dataset: dataset, Folder: folder})
+}
+
+func inputMarker(inputIndex int, spec string) string {
+	return fmt.Sprintf("%s%d_%x", InputMarkerPath, inputIndex, sha256.Sum256([]byte(spec)))
+}
+
+// ClearInputMarkers forgets which inputs have been completed
+func ClearInputMarkers() {
+	os.RemoveAll(InputMarkerPath)
+}
+
+// MarkInputCompleted records that an input was mounted or downloaded, so a retry of the
+// download phase skips it
+func MarkInputCompleted(inputIndex int, spec string) {
+	if err := os.MkdirAll(InputMarkerPath, 0755); err != nil {
+		log.Printf("Failed to create input marker folder: %v", err)
+		return
+	}
+	if err := os.WriteFile(inputMarker(inputIndex, spec), nil, 0644); err != nil {
+		log.Printf("Failed to mark input %d as completed: %v", inputIndex, err)
+	}
+}
+
+func IsInputCompleted(inputIndex int, spec string) bool {
+	_, err := os.Stat(inputMarker(inputIndex, spec))
+	return err == nil
+}
+
+// FlushWriteBackMounts uploads files written into read-write dataset mounts as a new version of
+// each dataset. Linked files are symlinks into the read-only mounts, so every regular file in the
+// folder was created or replaced by the task. Each mount is flushed at most once.
+func FlushWriteBackMounts(osmoChan chan string) {
+	writeBackLock.Lock()
+	mounts := writeBackMounts
+	writeBackMounts = nil
+	writeBackLock.Unlock()
+
+	for _, mount := range mounts {
+		var addPaths []string
+		err := filepath.WalkDir(mount.Folder, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !entry.Type().IsRegular() {
+				return nil
+			}
+			relativeDir, err := filepath.Rel(mount.Folder, filepath.Dir(path))
+			if err != nil {
+				return err
+			}
+			if relativeDir == "." {
+				addPaths = append(addPaths, path)
+			} else {
+				addPaths = append(addPaths, path+":"+relativeDir)
+			}
+			return nil
+		})
+		if err != nil {
+			log.Printf("Failed to scan read-write mount %s: %v", mount.Folder, err)
+			continue
+		}
+		if len(addPaths) == 0 {
+			log.Printf("No changes to upload for dataset %s", mount.Dataset)
+			continue
+		}
+
+		log.Printf("Uploading %d modified files from %s to dataset %s",
+			len(addPaths), mount.Folder, mount.Dataset)
+		commandArgs := []string{"osmo", "dataset", "update", mount.Dataset, "--processes",
+			CpuCount, "--add"}
+		commandArgs = append(commandArgs, addPaths...)
+		RunOSMOCommandWithRetry(commandArgs, 5, osmoChan, osmo_errors.UPLOAD_FAILED_CODE, "")
+		osmoChan <- "Uploaded changes to dataset " + mount.Dataset
+	}
+}
+
+// Benchmark and cache directories created by this task, removed by CleanupScratch
+var scratchDirs []string
+var scratchLock sync.Mutex
+
+func registerScratchDir(path string) {
+	scratchLock.Lock()
+	defer scratchLock.Unlock()
+	scratchDirs = append(scratchDirs, filepath.Clean(path))
+}
+
+// containsMount reports whether path is, or contains, a mount point
+func containsMount(path string) (bool, error) {
+	content, err := os.ReadFile("/proc/mounts")
+	if err != nil {
+		return false, err
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		if fields[1] == path || strings.HasPrefix(fields[1], path+"/") {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// CleanupScratch removes the benchmark and cache directories this task created. Only registered
+// directories are removed, and a directory is kept when a mount is still present in it.
+func CleanupScratch() {
+	scratchLock.Lock()
+	dirs := scratchDirs
+	scratchDirs = nil
+	scratchLock.Unlock()
+
+	removed := make(map[string]bool)
+	for _, dir := range dirs {
+		if removed[dir] || dir == "/" || dir == "." {
+			continue
+		}
+		removed[dir] = true
+		if mounted, err := containsMount(dir); err != nil || mounted {
+			log.Printf("Keeping scratch directory %s since it may contain a mount", dir)
+			continue
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			log.Printf("Failed to remove scratch directory %s: %v", dir, err)
+		} else {
+			log.Printf("Removed scratch directory %s", dir)
+		}
+	}
+}
+
 type WebsocketConnectionInfo struct {
 	// task:<folder>,<url>,<regex>
 	IsBroken            bool
@@ -157,14 +382,66 @@ func (f WebsocketConnectionInfo) TimeLeft() time.Duration {
 
 var WebsocketConnection WebsocketConnectionInfo
 
-func createOutCommandStream(osmoChan chan string) func(*exec.Cmd,
+// Guards WebsocketConnection for readers outside the goroutine maintaining the connection
+var websocketConnectionMutex sync.RWMutex
+
+// GetWebsocketConnection returns a copy of the connection state taken under the lock
+func GetWebsocketConnection() WebsocketConnectionInfo {
+	websocketConnectionMutex.RLock()
+	defer websocketConnectionMutex.RUnlock()
+	return WebsocketConnection
+}
+
+// UpdateWebsocketConnection changes the connection state under the lock
+func UpdateWebsocketConnection(update func(connection *WebsocketConnectionInfo)) {
+	websocketConnectionMutex.Lock()
+	defer websocketConnectionMutex.Unlock()
+	update(&WebsocketConnection)
+}
+
+// Context of the data transfer commands. It is cancelled once the connection to the service is
+// permanently lost, since the task can no longer report the result of the transfer.
+var transferContext, cancelTransferContext = context.WithCancel(context.Background())
+
+// Transfer commands that are currently running
+var activeTransfers sync.WaitGroup
+
+// CancelTransfers kills all running data transfer commands, prevents new ones from starting and
+// waits up to timeout for the running commands to exit.
+func CancelTransfers(timeout time.Duration) {
+	cancelTransferContext()
+	done := make(chan bool)
+	go func() {
+		activeTransfers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		log.Printf("Data transfers did not exit within %s of being cancelled", timeout)
+	}
+}
+
+// checkTransferCancelled fails the task if transfers were cancelled due to losing the connection
+// to the service
+func checkTransferCancelled(osmoChan chan string) {
+	if transferContext.Err() != nil {
+		osmoChan <- "Data transfer cancelled: lost connection to OSMO service"
+		osmo_errors.SetExitCode(osmo_errors.WEBSOCKET_TIMEOUT_CODE)
+		panic("Data transfer cancelled: lost connection to OSMO service")
+	}
+}
+
+func createOutCommandStream(osmoChan chan string, dataTimeout time.Duration) func(*exec.Cmd,
 	*bufio.Scanner, sync.WaitGroup, chan bool) {
 	streamOutCommand := func(cmd *exec.Cmd, scanner *bufio.Scanner,
 		waitStreamLogs sync.WaitGroup, timeoutChan chan bool) {
 		waitStreamLogs.Add(1)
 		defer waitStreamLogs.Done()
 
-		lastMessageTime := time.Now()
+		// Written by the scanner and read by the timeout check, in Unix nanoseconds
+		var lastMessageTime atomic.Int64
+		lastMessageTime.Store(time.Now().UnixNano())
 		quit := make(chan bool)
 
 		go func() {
@@ -173,7 +450,7 @@ func createOutCommandStream(osmoChan chan string) func(*exec.Cmd,
 				case <-quit:
 					return
 				default:
-					if time.Since(lastMessageTime) >= DataTimeout {
+					if time.Since(time.Unix(0, lastMessageTime.Load())) >= dataTimeout {
 						if err := cmd.Process.Kill(); err != nil {
 							osmo_errors.SetExitCode(osmo_errors.CMD_FAILED_CODE)
 							panic(fmt.Sprintf("Failed to kill process: %s", err))
@@ -190,7 +467,7 @@ func createOutCommandStream(osmoChan chan string) func(*exec.Cmd,
 		for scanner.Scan() {
 			log.Println(scanner.Text())
 			osmoChan <- scanner.Text()
-			lastMessageTime = time.Now()
+			lastMessageTime.Store(time.Now().UnixNano())
 		}
 		if err := scanner.Err(); err != nil {
 			osmo_errors.SetExitCode(osmo_errors.CMD_FAILED_CODE)
@@ -219,9 +496,194 @@ func createErrCommandStream(osmoChan chan string) func(*bufio.Scanner, sync.Wait
 	return streamErrCommand
 }
 
+// RetryAttempt describes a single failed attempt of a retried OSMO command
+type RetryAttempt struct {
+	Attempt        int     `json:"attempt"`
+	Error          string  `json:"error"`
+	ElapsedSeconds float64 `json:"elapsed_seconds"`
+}
+
+// RetryExhaustedRecord summarizes every attempt of an OSMO command that ran out of retries
+type RetryExhaustedRecord struct {
+	Command        string         `json:"command"`
+	CommandLine    string         `json:"command_line"`
+	Attempts       []RetryAttempt `json:"attempts"`
+	ElapsedSeconds float64        `json:"elapsed_seconds"`
+	startTime      time.Time
+}
+
+func newRetryExhaustedRecord(command []string) *RetryExhaustedRecord {
+	// Only keep the subcommand, the arguments are only recorded redacted with each attempt
+	return &RetryExhaustedRecord{
+		Command:   strings.Join(command[:common.Min(len(command), 3)], " "),
+		startTime: time.Now(),
+	}
+}
+
+func (r *RetryExhaustedRecord) addAttempt(attemptStart time.Time, command []string, err error) {
+	errMsg := ""
+	if err != nil {
+		errMsg = err.Error()
+	}
+	r.CommandLine = RedactCommand(command)
+	r.Attempts = append(r.Attempts, RetryAttempt{
+		Attempt:        len(r.Attempts) + 1,
+		Error:          errMsg,
+		ElapsedSeconds: time.Since(attemptStart).Seconds(),
+	})
+}
+
+// Send the record to the log stream and attach it to the termination log
+func (r *RetryExhaustedRecord) report(osmoChan chan string) {
+	r.ElapsedSeconds = time.Since(r.startTime).Seconds()
+	recordJson, err := json.Marshal(r)
+	if err != nil {
+		log.Printf("Failed to marshal retry record: %v", err)
+	} else {
+		osmoChan <- "Retries exhausted: " + string(recordJson)
+	}
+	osmo_errors.SetFailureDetails(r)
+}
+
+// Flags of the osmo subcommands whose values carry credentials
+var redactedOSMOFlags = map[string]bool{
+	"--config-file": true,
+}
+
+// RedactCommand joins the command into a command line without credentials: the values of
+// credential flags are replaced and user info and query parameters are removed from urls
+func RedactCommand(command []string) string {
+	redacted := make([]string, len(command))
+	for i, arg := range command {
+		if i > 0 && redactedOSMOFlags[command[i-1]] {
+			redacted[i] = "<redacted>"
+			continue
+		}
+		if parsed, err := url.Parse(arg); err == nil && parsed.Scheme != "" &&
+			(parsed.User != nil || parsed.RawQuery != "") {
+			parsed.User = nil
+			parsed.RawQuery = ""
+			arg = parsed.String()
+		}
+		redacted[i] = arg
+	}
+	return strings.Join(redacted, " ")
+}
+
+// Whether the command line of each osmo command is logged before it runs
+var LogCommands bool
+
+func logCommand(command []string) {
+	if LogCommands {
+		log.Printf("Running: %s", RedactCommand(command))
+	}
+}
+
+// osmo subcommands ctrl runs, by command group. Commands outside of it are rejected before they
+// are run so a malformed spec cannot run an unexpected subcommand.
+var allowedOSMOCommands = map[string]map[string]bool{
+	"dataset": {"info": true, "download": true, "upload": true, "update": true, "tag": true,
+		"check": true},
+	"data": {"download": true, "upload": true, "check": true},
+}
+
+// Flags of the osmo subcommands ctrl runs, and whether they are followed by a value
+var allowedOSMOFlags = map[string]bool{
+	"--access-type":   true,
+	"--add":           false,
+	"--benchmark-out": true,
+	"--config-file":   true,
+	"--format-type":   true,
+	"--metadata":      false,
+	"--processes":     true,
+	"--regex":         true,
+	"--resume":        false,
+	"--set":           true,
+	"--start-only":    false,
+	"-c":              true,
+}
+
+// AllowOSMOCommand adds a subcommand in the form <group>:<subcommand> to the allowlist
+func AllowOSMOCommand(command string) error {
+	group, subcommand, found := strings.Cut(command, ":")
+	if !found || group == "" || subcommand == "" {
+		return fmt.Errorf("invalid osmo command %q, expected <group>:<subcommand>", command)
+	}
+	if allowedOSMOCommands[group] == nil {
+		allowedOSMOCommands[group] = map[string]bool{}
+	}
+	allowedOSMOCommands[group][subcommand] = true
+	return nil
+}
+
+func validateOSMOCommand(command []string) error {
+	if len(command) < 3 || command[0] != "osmo" {
+		return fmt.Errorf("not an osmo subcommand: %s", strings.Join(command, " "))
+	}
+	if !allowedOSMOCommands[command[1]][command[2]] {
+		return fmt.Errorf("osmo subcommand %s %s is not allowed", command[1], command[2])
+	}
+	for i := 3; i < len(command); i++ {
+		if !strings.HasPrefix(command[i], "-") {
+			continue
+		}
+		takesValue, ok := allowedOSMOFlags[command[i]]
+		if !ok {
+			return fmt.Errorf("flag %s of osmo %s %s is not allowed", command[i], command[1],
+				command[2])
+		}
+		if takesValue {
+			i++
+		}
+	}
+	return nil
+}
+
+// Fail the task if the command is not an allowed osmo subcommand
+func checkOSMOCommand(command []string, osmoChan chan string) {
+	if err := validateOSMOCommand(command); err != nil {
+		log.Printf("Rejected command: %s", err)
+		osmoChan <- fmt.Sprintf("Rejected command: %s", err)
+		osmo_errors.SetExitCode(osmo_errors.INVALID_INPUT_CODE)
+		panic(err)
+	}
+}
+
+// Environment variable of the directory the OSMO CLI reads its config from
+const OSMOConfigDirEnv string = "OSMO_CONFIG_FILE_DIR"
+
+// osmoCommandEnv returns the environment of OSMO commands reading the CLI config from configDir,
+// or nil to inherit the environment of ctrl when configDir is empty
+func osmoCommandEnv(configDir string) []string {
+	if configDir == "" {
+		return nil
+	}
+	return append(os.Environ(), OSMOConfigDirEnv+"="+configDir)
+}
+
+// RunOSMOCommandStreamingWithRetry runs the command with the CLI config in configDir, or the
+// default config when configDir is empty
 func RunOSMOCommandStreamingWithRetry(command []string, retryCommand []string,
-	retryCount int, osmoChan chan string, exitCode osmo_errors.ExitCode) {
+	retryCount int, osmoChan chan string, exitCode osmo_errors.ExitCode, configDir string) {
+	RunOSMOCommandStreamingWithRetryTimeout(command, retryCommand, retryCount, osmoChan, exitCode,
+		DataTimeout, configDir)
+}
+
+// RunOSMOCommandStreamingWithRetryTimeout retries the command whenever it produces no output
+// for dataTimeout
+func RunOSMOCommandStreamingWithRetryTimeout(command []string, retryCommand []string,
+	retryCount int, osmoChan chan string, exitCode osmo_errors.ExitCode,
+	dataTimeout time.Duration, configDir string) {
+	checkOSMOCommand(command, osmoChan)
+	checkOSMOCommand(retryCommand, osmoChan)
+	record := newRetryExhaustedRecord(command)
+	failure := fmt.Sprintf("Failed after %d retries", retryCount)
 	for i := 0; i < retryCount; i++ {
+		if i > 0 && !common.TakeRetry() {
+			failure = common.RetryBudgetExhausted(i)
+			break
+		}
+		attemptStart := time.Now()
 		var commandInput []string
 		if i > 0 {
 			osmoChan <- "OSMO Command timed out. Retrying..."
@@ -237,14 +699,20 @@ func RunOSMOCommandStreamingWithRetry(command []string, retryCommand []string,
 		// This retry count variable is for 429 has no limit
 		backoffCount := 0
 		for {
+			checkTransferCancelled(osmoChan)
 			// Wait until we have a stable connection to the service
 			if WebsocketConnection.IsBroken {
 				time.Sleep(10 * time.Second)
 				continue
 			}
-			cmd := exec.Command(commandInput[0], commandInput[1:]...)
+			logCommand(commandInput)
+			cmd := exec.CommandContext(transferContext, commandInput[0], commandInput[1:]...)
+			cmd.Env = osmoCommandEnv(configDir)
+			activeTransfers.Add(1)
 			msg, err = common.RunCommand(cmd,
-				createOutCommandStream(osmoChan), createErrCommandStream(osmoChan))
+				createOutCommandStream(osmoChan, dataTimeout), createErrCommandStream(osmoChan))
+			activeTransfers.Done()
+			checkTransferCancelled(osmoChan)
 			if err != nil {
 				if exiterr, ok := err.(*exec.ExitError); ok {
 					// The program has exited with an exit code != 0
@@ -268,8 +736,7 @@ func RunOSMOCommandStreamingWithRetry(command []string, retryCommand []string,
 								osmoChan <- "Rate limited by service. Waiting before retrying..."
 								firstError = true
 							}
-							maxSleep := math.Pow(2, float64(math.Min(float64(backoffCount), 5)))
-							sleepTime = time.Second * time.Duration(1+rand.Float64()*(maxSleep-1))
+							sleepTime = RateLimitBackoff.Delay(backoffCount)
 							backoffCount++
 							continueLoop = true
 						}
@@ -284,6 +751,7 @@ func RunOSMOCommandStreamingWithRetry(command []string, retryCommand []string,
 		}
 		_, isTypeTimeout := err.(*osmo_errors.TimeoutError)
 		if isTypeTimeout {
+			record.addAttempt(attemptStart, commandInput, err)
 			continue
 		}
 		if err != nil {
@@ -292,16 +760,25 @@ func RunOSMOCommandStreamingWithRetry(command []string, retryCommand []string,
 			return
 		}
 	}
-	osmoChan <- fmt.Sprintf("Failed after %d retries", retryCount)
+	osmoChan <- failure
+	record.report(osmoChan)
 	osmo_errors.SetExitCode(exitCode)
-	panic(fmt.Sprintf("Failed after %d retries", retryCount))
+	panic(failure)
 }
 
 func RunOSMOCommandWithRetry(commandArgs []string, retryCount int,
-	osmoChan chan string, code osmo_errors.ExitCode) bytes.Buffer {
+	osmoChan chan string, code osmo_errors.ExitCode, configDir string) bytes.Buffer {
 	var outb, errb bytes.Buffer
 	var err error
+	checkOSMOCommand(commandArgs, osmoChan)
+	record := newRetryExhaustedRecord(commandArgs)
+	failure := fmt.Sprintf("Failed after %d retries", retryCount)
 	for i := 0; i < retryCount; i++ {
+		if i > 0 && !common.TakeRetry() {
+			failure = common.RetryBudgetExhausted(i)
+			break
+		}
+		attemptStart := time.Now()
 		if i > 0 {
 			osmoChan <- "Retrying..."
 		}
@@ -310,6 +787,7 @@ func RunOSMOCommandWithRetry(commandArgs []string, retryCount int,
 		// This retry count variable is for 429 has no limit
 		backoffCount := 0
 		for {
+			checkTransferCancelled(osmoChan)
 			// Wait until we have a stable connection to the service
 			if WebsocketConnection.IsBroken {
 				if !firstError {
@@ -320,10 +798,16 @@ func RunOSMOCommandWithRetry(commandArgs []string, retryCount int,
 				time.Sleep(10 * time.Second)
 				continue
 			}
-			cmd := exec.Command(commandArgs[0], commandArgs[1:]...)
+			logCommand(commandArgs)
+			cmd := exec.CommandContext(transferContext, commandArgs[0], commandArgs[1:]...)
+			cmd.Env = osmoCommandEnv(configDir)
 			cmd.Stdout = &outb
 			cmd.Stderr = &errb
-			if err = cmd.Run(); err != nil {
+			activeTransfers.Add(1)
+			err = cmd.Run()
+			activeTransfers.Done()
+			checkTransferCancelled(osmoChan)
+			if err != nil {
 				if exiterr, ok := err.(*exec.ExitError); ok {
 					// The program has exited with an exit code != 0
 
@@ -346,8 +830,7 @@ func RunOSMOCommandWithRetry(commandArgs []string, retryCount int,
 								osmoChan <- "Rate limited by service. Waiting before retrying..."
 								firstError = true
 							}
-							maxSleep := math.Pow(2, float64(math.Min(float64(backoffCount), 5)))
-							sleepTime = time.Second * time.Duration(1+rand.Float64()*(maxSleep-1))
+							sleepTime = RateLimitBackoff.Delay(backoffCount)
 							backoffCount++
 							continueLoop = true
 						}
@@ -368,12 +851,14 @@ func RunOSMOCommandWithRetry(commandArgs []string, retryCount int,
 			log.Println("err:", errb.String())
 			osmoChan <- outb.String()
 			osmoChan <- errb.String()
+			record.addAttempt(attemptStart, commandArgs, err)
 			continue
 		}
 
 		return outb
 	}
-	osmoChan <- fmt.Sprintf("Failed after %d retries", retryCount)
+	osmoChan <- failure
+	record.report(osmoChan)
 	osmo_errors.LogError(outb.String(), errb.String(), osmoChan, err, code)
 	return outb
 }
@@ -391,19 +876,158 @@ func CreateFolder(inputPath string, folder string) string {
 	return mountPath
 }
 
+// Folder inputs are downloaded into before they are moved into the input folder, so a failed
+// download never leaves a partial input behind. It has to be on the same filesystem as the input
+// folders. Downloads go directly into the input folder when empty.
+var DownloadStagingPath string
+
+// stageDownload returns the folder to download the input with the given name into. The name is
+// stable across retries so interrupted downloads can resume.
+func stageDownload(finalPath string, name string) string {
+	if DownloadStagingPath == "" {
+		return finalPath
+	}
+	return CreateFolder(DownloadStagingPath, name)
+}
+
+// commitDownload moves a download staged by stageDownload into its input folder
+func commitDownload(stagingPath string, finalPath string) {
+	if stagingPath == finalPath {
+		return
+	}
+	// Replace the folder as a whole when it is empty, otherwise move the entries into it
+	if err := os.Remove(finalPath); err == nil {
+		if err := os.Rename(stagingPath, finalPath); err != nil {
+			osmo_errors.SetExitCode(osmo_errors.FILE_FAILED_CODE)
+			panic(fmt.Sprintf("Failed to move %s to %s, the staging folder has to be on the "+
+				"same filesystem as the input folder: %s", stagingPath, finalPath, err))
+		}
+	} else {
+		entries, err := os.ReadDir(stagingPath)
+		if err != nil {
+			osmo_errors.SetExitCode(osmo_errors.FILE_FAILED_CODE)
+			panic(err)
+		}
+		for _, entry := range entries {
+			source := filepath.Join(stagingPath, entry.Name())
+			destination := filepath.Join(finalPath, entry.Name())
+			if err := os.Rename(source, destination); err != nil {
+				osmo_errors.SetExitCode(osmo_errors.FILE_FAILED_CODE)
+				panic(fmt.Sprintf("Failed to move %s to %s, the staging folder has to be on "+
+					"the same filesystem as the input folder: %s", source, destination, err))
+			}
+		}
+		os.Remove(stagingPath)
+	}
+	log.Printf("Moved staged download %s to %s", stagingPath, finalPath)
+}
+
+// Percentage of the mounts of a dataset that have to be empty for the input to fail. Fewer empty
+// mounts only produce a warning. 0 never fails the input.
+var EmptyMountFailPercent int = 100
+
+// emptyMountsExceedThreshold reports whether enough mounts of a dataset are empty to fail it
+func emptyMountsExceedThreshold(numEmpty int, numMounts int) bool {
+	if EmptyMountFailPercent <= 0 || numEmpty == 0 || numMounts == 0 {
+		return false
+	}
+	return numEmpty*100 >= EmptyMountFailPercent*numMounts
+}
+
+// emptyMountsMessage reports whether all, some or none of the mounts of a dataset are empty
+func emptyMountsMessage(datasetID string, numEmpty int, numMounts int) string {
+	if numMounts > 0 && numEmpty == numMounts {
+		return fmt.Sprintf("All Mounts for %s failed", datasetID)
+	} else if numEmpty > 0 {
+		return fmt.Sprintf("WARNING: Partial Mount for %s failed: %d of %d mounts are empty",
+			datasetID, numEmpty, numMounts)
+	}
+	return fmt.Sprintf("Mounting finished for %s", datasetID)
+}
+
+type MountStatus string
+
+const (
+	// The mount has files
+	MountSucceeded MountStatus = "mounted"
+	// The mount command could not be run or did not complete
+	MountFailed MountStatus = "mount_failed"
+	// The mount succeeded but the source has no files
+	MountSourceEmpty MountStatus = "source_empty"
+	// The mount succeeded but its contents could not be listed
+	MountUnlistable MountStatus = "unlistable"
+)
+
+// Outcome of MountURL with the reason the mount is unusable
+type MountResult struct {
+	Status MountStatus
+	Reason string
+}
+
+// IsEmpty reports whether the mount has no usable files
+func (r MountResult) IsEmpty() bool {
+	return r.Status != MountSucceeded
+}
+
+// DownloadType is the download type reported in the metrics of the mount
+func (r MountResult) DownloadType(downloadType string) string {
+	switch r.Status {
+	case MountSucceeded:
+		return downloadType
+	case MountSourceEmpty:
+		return MountpointEmpty
+	default:
+		return MountpointFailed
+	}
+}
+
+// How long a mount attempt, including listing the mounted folder, may take before it is aborted
+// and the mount is treated as failed. Inputs with a timeout use it instead. 0 never aborts.
+var MountTimeout time.Duration
+
+// mountTimeout returns the timeout of mounting an input with the given input timeout
+func mountTimeout(timeout time.Duration) time.Duration {
+	if timeout > 0 {
+		return timeout
+	}
+	return MountTimeout
+}
+
+// isDirEmptyWithContext lists the folder, giving up when the context is done so a hung mount
+// cannot block the caller
+func isDirEmptyWithContext(ctx context.Context, name string) (bool, error) {
+	type listResult struct {
+		isEmpty bool
+		err     error
+	}
+	resultChan := make(chan listResult, 1)
+	go func() {
+		isEmpty, err := common.IsDirEmpty(name)
+		resultChan <- listResult{isEmpty, err}
+	}()
+	select {
+	case result := <-resultChan:
+		return result.isEmpty, result.err
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+}
+
 func MountURL(downloadType string, credentialInfo ConfigInfo, urlPath string,
-	localPath string, cachePath string, cacheSize int, osmoChan chan string) bool {
+	localPath string, cachePath string, cacheSize int, timeout time.Duration,
+	osmoChan chan string) MountResult {
 
-	isEmpty := true
 	storageBackend := ParseStorageBackend(urlPath)
 
-	dataCredential, ok := credentialInfo.Auth.Data[storageBackend.GetProfile()]
-	if !ok {
-		osmoChan <- fmt.Sprintf("Missing data credential for %s.", storageBackend.GetProfile())
-		return isEmpty
+	dataCredential, err := credentialInfo.GetDataCredential(storageBackend)
+	if err != nil {
+		osmoChan <- fmt.Sprintf("Missing data credential: %s.", err)
+		return MountResult{MountFailed, fmt.Sprintf("missing data credential: %s", err)}
 	}
-	os.Setenv("AWS_ACCESS_KEY_ID", dataCredential.AccessKeyId)
-	os.Setenv("AWS_SECRET_ACCESS_KEY", dataCredential.AccessKey)
+	// Only the mount gets the credential, since mounts running at the same time can use different
+	// credentials
+	mountEnv := append(os.Environ(), "AWS_ACCESS_KEY_ID="+dataCredential.AccessKeyId,
+		"AWS_SECRET_ACCESS_KEY="+dataCredential.AccessKey)
 
 	var commandArgs []string
 
@@ -438,41 +1062,64 @@ func MountURL(downloadType string, credentialInfo ConfigInfo, urlPath string,
 		}
 	} else {
 		osmoChan <- fmt.Sprintf("Mounting type %s is not supported.", downloadType)
-		return isEmpty
+		return MountResult{MountFailed, fmt.Sprintf("mounting type %s is not supported",
+			downloadType)}
 	}
 
+	result := MountResult{MountFailed, "mount was not attempted"}
 	// Loop 3 times in case mountpoint doesn't connect properly
 	for i := 0; i < MountRetryCount; i++ {
+		ctx, cancel := context.Background(), context.CancelFunc(func() {})
+		if timeout > 0 {
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+		}
 		if downloadType == Mountpoint {
-			log, err := os.Create("/tmp/mount.log")
+			// Each mount has its own log, so a failure reports the output of its own mount
+			mountLog, err := os.CreateTemp(credentialInfo.ConfigDir, "mount-*.log")
 			if err != nil {
 				osmo_errors.LogError("", "", osmoChan, err, osmo_errors.FILE_FAILED_CODE)
 			}
 
 			mountS3Path := common.ResolveCommandPath("MOUNT_S3_PATH", "mount-s3", "/usr/bin/mount-s3")
-			cmd := exec.Command(mountS3Path, commandArgs...)
-			cmd.Stderr = log
-			if err = cmd.Run(); err != nil {
+			cmd := exec.CommandContext(ctx, mountS3Path, commandArgs...)
+			cmd.Env = mountEnv
+			cmd.Stderr = mountLog
+			err = cmd.Run()
+			mountLog.Close()
+			stderr, _ := os.ReadFile(mountLog.Name())
+			os.Remove(mountLog.Name())
+			if err != nil && ctx.Err() == nil {
 				if strings.Contains(err.Error(), "Timeout") {
 					osmoChan <- "Timeout while waiting for mount to complete. Retrying..."
+					result = MountResult{MountFailed, "timed out waiting for the mount to complete"}
+					cancel()
 					continue
 				} else if !strings.Contains(err.Error(), "is already mounted") {
-					stderr, _ := os.ReadFile("/tmp/mount.log")
 					osmo_errors.LogError("", string(stderr), osmoChan, err,
 						osmo_errors.MOUNT_FAILED_CODE)
 				}
 			}
 		}
 
-		var err error
-		isEmpty, err = common.IsDirEmpty(localPath)
-		if err != nil {
+		isEmpty, err := isDirEmptyWithContext(ctx, localPath)
+		timedOut := ctx.Err() == context.DeadlineExceeded
+		cancel()
+		if timedOut {
+			// The backend is unresponsive so retrying would likely hang again. Detach the mount
+			// so it does not block the cleanup of the input folder.
+			osmoChan <- fmt.Sprintf("Mount of %s did not complete within %s.", urlPath, timeout)
+			if err := syscall.Unmount(localPath, syscall.MNT_DETACH); err != nil {
+				log.Println("umount failed:", err)
+			}
+			return MountResult{MountFailed, fmt.Sprintf("mount did not complete within %s",
+				timeout)}
+		} else if err != nil {
 			log.Println(err)
-		}
-
-		// Exit the loop
-		if !isEmpty {
-			break
+			result = MountResult{MountUnlistable, fmt.Sprintf("failed to list the mount: %s", err)}
+		} else if isEmpty {
+			result = MountResult{MountSourceEmpty, "the mounted source has no files"}
+		} else {
+			return MountResult{Status: MountSucceeded}
 		}
 
 		// TODO: Handle paths that are an object by downloading instead of mounting
@@ -480,7 +1127,7 @@ func MountURL(downloadType string, credentialInfo ConfigInfo, urlPath string,
 			log.Println("umount failed:", err)
 		}
 	}
-	return isEmpty
+	return result
 }
 
 func DownloadURI(
@@ -490,7 +1137,9 @@ func DownloadURI(
 	regex string,
 	osmoChan chan string,
 	benchmarkFolderName string,
-) []BenchmarkMetrics {
+	dataTimeout time.Duration,
+	configDir string,
+) ([]BenchmarkMetrics, []string) {
 	if benchmarkFolderName == "" {
 		benchmarkFolderName = fmt.Sprintf("download_%d", time.Now().UnixMilli())
 	}
@@ -506,8 +1155,8 @@ func DownloadURI(
 
 	downloadResumeInput := append(downloadInput, "--resume")
 
-	RunOSMOCommandStreamingWithRetry(
-		downloadInput, downloadResumeInput, 5, osmoChan, osmo_errors.DOWNLOAD_FAILED_CODE)
+	RunOSMOCommandStreamingWithRetryTimeout(downloadInput, downloadResumeInput, 5, osmoChan,
+		osmo_errors.DOWNLOAD_FAILED_CODE, dataTimeout, configDir)
 
 	return CollectBenchmarkMetrics(benchmarkPath)
 }
@@ -518,7 +1167,8 @@ func UploadData(
 	regex string,
 	osmoChan chan string,
 	benchmarkFolderName string,
-) []BenchmarkMetrics {
+	configDir string,
+) ([]BenchmarkMetrics, []string) {
 	if benchmarkFolderName == "" {
 		benchmarkFolderName = fmt.Sprintf("upload_%d", time.Now().UnixMilli())
 	}
@@ -533,11 +1183,115 @@ func UploadData(
 	}
 
 	RunOSMOCommandStreamingWithRetry(uploadInput, uploadInput, 5, osmoChan,
-		osmo_errors.UPLOAD_FAILED_CODE)
+		osmo_errors.UPLOAD_FAILED_CODE, configDir)
 
 	return CollectBenchmarkMetrics(benchmarkPath)
 }
 
+// Number of parallel subprocesses a url output upload is split across. The files of the output
+// are partitioned between the subprocesses. Dataset outputs always upload with one subprocess, as
+// each upload subprocess would create its own dataset version.
+var UploadShards int = 1
+
+// scanOutputFiles expands pattern into the files to upload and reports how long the scan took
+func scanOutputFiles(pattern string, osmoChan chan string, metricChan chan metrics.Metric,
+	retryId string, groupName string, taskName string, outputUrlID string) []string {
+	start := time.Now()
+	files := common.GetFiles(transferContext, pattern, osmoChan)
+	checkTransferCancelled(osmoChan)
+	metricChan <- metrics.OutputScanMetrics{
+		RetryId:         retryId,
+		GroupName:       groupName,
+		TaskName:        taskName,
+		URL:             outputUrlID,
+		Pattern:         pattern,
+		NumberOfFiles:   len(files),
+		DurationSeconds: time.Since(start).Seconds(),
+	}
+	return files
+}
+
+// hasFiles reports whether any of the paths matched by an output pattern is a file or a folder
+// containing one. Matches that are only empty folders have nothing to upload.
+func hasFiles(paths []string) bool {
+	found := false
+	for _, path := range paths {
+		filepath.WalkDir(path, func(_ string, entry fs.DirEntry, err error) error {
+			if err == nil && !entry.IsDir() {
+				found = true
+				return filepath.SkipAll
+			}
+			return nil
+		})
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+// shardFiles partitions files round-robin into at most shards non-empty groups
+func shardFiles(files []string, shards int) [][]string {
+	if shards > len(files) {
+		shards = len(files)
+	}
+	if shards < 1 {
+		shards = 1
+	}
+	groups := make([][]string, shards)
+	for i, file := range files {
+		groups[i%shards] = append(groups[i%shards], file)
+	}
+	return groups
+}
+
+// runUploadShards uploads each group of files with its own subprocess in parallel. shardCommand
+// builds the command of a shard from its files and benchmark path. The benchmarks of all shards,
+// and the benchmark files that could not be parsed, are returned together.
+func runUploadShards(shards [][]string, benchmarkPath string, osmoChan chan string,
+	configDir string,
+	shardCommand func(files []string, benchmarkPath string) []string,
+) ([]BenchmarkMetrics, []string) {
+
+	var waitShards sync.WaitGroup
+	var shardMutex sync.Mutex
+	var shardPanic interface{}
+	benchmarkPaths := make([]string, len(shards))
+	for i, files := range shards {
+		benchmarkPaths[i] = fmt.Sprintf("%s/shard_%d", benchmarkPath, i)
+		command := shardCommand(files, benchmarkPaths[i])
+		waitShards.Add(1)
+		go func() {
+			defer waitShards.Done()
+			// Failures are raised again by the caller so they are handled like an unsharded upload
+			defer func() {
+				if r := recover(); r != nil {
+					shardMutex.Lock()
+					if shardPanic == nil {
+						shardPanic = r
+					}
+					shardMutex.Unlock()
+				}
+			}()
+			RunOSMOCommandStreamingWithRetry(command, command, 5, osmoChan,
+				osmo_errors.UPLOAD_FAILED_CODE, configDir)
+		}()
+	}
+	waitShards.Wait()
+	if shardPanic != nil {
+		panic(shardPanic)
+	}
+
+	var benchmarks []BenchmarkMetrics
+	var benchmarkFailures []string
+	for _, path := range benchmarkPaths {
+		shardBenchmarks, failures := CollectBenchmarkMetrics(path)
+		benchmarks = append(benchmarks, shardBenchmarks...)
+		benchmarkFailures = append(benchmarkFailures, failures...)
+	}
+	return benchmarks, benchmarkFailures
+}
+
 func ParseMountLocations(manifestFilePath string,
 	uriPath string) (map[string]MountLocation, error) {
 
@@ -704,11 +1458,46 @@ func symlinkWorker(jobs <-chan ManifestObject, wg *sync.WaitGroup,
 	}
 }
 
-func SendDatasetSizeAndChecksum(c net.Conn, dataset string, osmoChan chan string) string {
+// File the result of each dataset output is appended to as a JSON line, so an orchestrator can
+// recover the uploaded versions without the task logs. Disabled when empty.
+var OutputResultsFile string
+var outputResultsLock sync.Mutex
+
+type DatasetOutputResult struct {
+	Dataset   string `json:"dataset"`
+	VersionID string `json:"version_id"`
+	Uri       string `json:"uri"`
+	Size      int    `json:"size"`
+	Checksum  string `json:"checksum"`
+}
+
+func recordDatasetOutputResult(result DatasetOutputResult, osmoChan chan string) {
+	if OutputResultsFile == "" {
+		return
+	}
+	outputResultsLock.Lock()
+	defer outputResultsLock.Unlock()
+	file, err := os.OpenFile(OutputResultsFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err == nil {
+		err = json.NewEncoder(file).Encode(result)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to record the result of %s: %v", result.Dataset, err)
+		osmoChan <- fmt.Sprintf("WARNING: Failed to record the result of %s in %s",
+			result.Dataset, OutputResultsFile)
+	}
+}
+
+func SendDatasetSizeAndChecksum(c net.Conn, dataset string, osmoChan chan string,
+	configDir string) string {
 	// Prints Dataset information and Returns the Version URI
 	commandArgs := []string{"osmo", "dataset", "info", dataset,
 		"--format-type", "json", "-c", "1"}
-	outb := RunOSMOCommandWithRetry(commandArgs, 5, osmoChan, osmo_errors.UPLOAD_FAILED_CODE)
+	outb := RunOSMOCommandWithRetry(commandArgs, 5, osmoChan, osmo_errors.UPLOAD_FAILED_CODE,
+		configDir)
 
 	var datasetInfo DatasetInfo
 	json.Unmarshal(outb.Bytes(), &datasetInfo)
@@ -716,64 +1505,247 @@ func SendDatasetSizeAndChecksum(c net.Conn, dataset string, osmoChan chan string
 		osmoChan <- "Dataset " + dataset + " info is Empty"
 		return ""
 	} else {
-		osmoChan <- "Size: " + strconv.Itoa(datasetInfo.Versions[0].Size) +
-			"B   Checksum: " + datasetInfo.Versions[0].Checksum
-		return datasetInfo.Versions[0].Uri
+		versionInfo := datasetInfo.Versions[0]
+		osmoChan <- "Size: " + strconv.Itoa(versionInfo.Size) +
+			"B   Checksum: " + versionInfo.Checksum
+		recordDatasetOutputResult(DatasetOutputResult{
+			Dataset:   dataset,
+			VersionID: versionInfo.Version,
+			Uri:       versionInfo.Uri,
+			Size:      versionInfo.Size,
+			Checksum:  versionInfo.Checksum,
+		}, osmoChan)
+		return versionInfo.Uri
 	}
 }
 
-func PrintDirContents(c net.Conn, path string, maxLevel int, osmoChan chan string) {
-	// Set the lines output for tree
-	// Get the first 20 lines and the last line if the number of lines is over 20
-	treePath := common.ResolveCommandPath("TREE_PATH", "tree", "/usr/bin/tree")
-	cmd := exec.Command(treePath, "-n", "-L", strconv.Itoa(maxLevel), path)
-	var outb, errb bytes.Buffer
-	cmd.Stdout = &outb
-	cmd.Stderr = &errb
-	if err := cmd.Run(); err != nil {
-		osmo_errors.LogError(outb.String(), errb.String(), osmoChan, err,
-			osmo_errors.MISC_FAILED_CODE)
+// Number of directories listed concurrently when previewing input contents
+var DirListingWorkers int = 8
+
+// Total time allowed for previewing input contents before a partial listing is printed
+var DirListingTimeout time.Duration = 10 * time.Second
+
+type dirNode struct {
+	name     string
+	isDir    bool
+	children []*dirNode
+}
+
+// listDirTree lists path up to maxLevel levels deep with a bounded number of workers. Returns
+// the listed tree and whether the listing was truncated because the time budget ran out.
+func listDirTree(path string, maxLevel int) (*dirNode, *sync.Mutex, bool) {
+	root := &dirNode{name: path, isDir: true}
+	workers := DirListingWorkers
+	if workers <= 0 {
+		workers = 1
 	}
+	deadline := time.Now().Add(DirListingTimeout)
+	semaphore := make(chan bool, workers)
+	var treeLock sync.Mutex
+	var truncated atomic.Bool
+	var wg sync.WaitGroup
 
-	// Limit output: first 20 lines and, if applicable, the last line
-	output := outb.String()
-	output = strings.TrimRight(output, "\n")
-	lines := strings.Split(output, "\n")
-	if len(lines) <= 20 {
-		osmoChan <- output
-		return
+	var listDir func(node *dirNode, dirPath string, level int)
+	listDir = func(node *dirNode, dirPath string, level int) {
+		defer wg.Done()
+		semaphore <- true
+		if time.Now().After(deadline) {
+			<-semaphore
+			truncated.Store(true)
+			return
+		}
+		entries, err := os.ReadDir(dirPath)
+		<-semaphore
+		if err != nil {
+			log.Printf("Failed to list %s: %v", dirPath, err)
+			return
+		}
+
+		children := make([]*dirNode, 0, len(entries))
+		for _, entry := range entries {
+			child := &dirNode{name: entry.Name(), isDir: entry.IsDir()}
+			children = append(children, child)
+			if child.isDir && level < maxLevel {
+				wg.Add(1)
+				go listDir(child, filepath.Join(dirPath, entry.Name()), level+1)
+			}
+		}
+		treeLock.Lock()
+		node.children = children
+		treeLock.Unlock()
+	}
+
+	done := make(chan bool)
+	wg.Add(1)
+	go listDir(root, path, 1)
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Until(deadline)):
+		// Listings blocked on the filesystem are abandoned
+		truncated.Store(true)
+	}
+	return root, &treeLock, truncated.Load()
+}
+
+// renderDirTree formats the tree in the same layout as the tree command
+func renderDirTree(node *dirNode, prefix string, lines []string, dirs, files *int) []string {
+	for i, child := range node.children {
+		connector, childPrefix := "├── ", "│   "
+		if i == len(node.children)-1 {
+			connector, childPrefix = "└── ", "    "
+		}
+		lines = append(lines, prefix+connector+child.name)
+		if child.isDir {
+			*dirs++
+			lines = renderDirTree(child, prefix+childPrefix, lines, dirs, files)
+		} else {
+			*files++
+		}
 	}
+	return lines
+}
 
+func PrintDirContents(c net.Conn, path string, maxLevel int, osmoChan chan string) {
+	root, treeLock, truncated := listDirTree(path, maxLevel)
+
+	treeLock.Lock()
+	dirs, files := 0, 0
+	lines := renderDirTree(root, "", []string{path}, &dirs, &files)
+	treeLock.Unlock()
+	lines = append(lines, "", fmt.Sprintf("%d directories, %d files", dirs, files))
+
+	// Limit output: first 20 lines and, if applicable, the last line
 	var builder strings.Builder
-	for i := 0; i < 20 && i < len(lines); i++ {
-		builder.WriteString(lines[i])
-		builder.WriteString("\n")
+	if len(lines) <= 20 {
+		builder.WriteString(strings.Join(lines, "\n"))
+	} else {
+		for i := 0; i < 20 && i < len(lines); i++ {
+			builder.WriteString(lines[i])
+			builder.WriteString("\n")
+		}
+		// Append the last line
+		builder.WriteString(lines[len(lines)-1])
+	}
+	if truncated {
+		builder.WriteString(fmt.Sprintf("\nListing truncated due to time (%s)", DirListingTimeout))
 	}
-	// Append the last line
-	builder.WriteString(lines[len(lines)-1])
 	osmoChan <- builder.String()
 }
 
-func CollectBenchmarkMetrics(benchmarkPath string) []BenchmarkMetrics {
+// Total bytes transferred across every benchmark written so far
+func totalBenchmarkBytes() int64 {
+	return benchmarkBytes(BenchmarkPath)
+}
+
+// benchmarkBytes sums the bytes transferred by the benchmarks under root
+func benchmarkBytes(root string) int64 {
+	var total int64
+	filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() || !strings.HasSuffix(entry.Name(), BenchmarkSuffix) {
+			return nil
+		}
+		contents, err := os.ReadFile(path)
+		if err != nil {
+			return nil
+		}
+		var benchmark BenchmarkMetrics
+		// Benchmarks may be partially written while a transfer is in progress
+		if json.Unmarshal(contents, &benchmark) == nil {
+			total += int64(benchmark.TotalBytesTransferred)
+		}
+		return nil
+	})
+	return total
+}
+
+// TransferredBytes returns the bytes transferred so far by an input or output, based on the
+// benchmarks written to its benchmark folders
+func TransferredBytes(isInput bool, index int, groupName string, taskName string) int64 {
+	if isInput {
+		return benchmarkBytes(fmt.Sprintf("%sINPUT_%d", BenchmarkPath, index)) +
+			benchmarkBytes(fmt.Sprintf("%s%s_%s_INPUT_%d", BenchmarkPath, groupName, taskName,
+				index))
+	}
+	return benchmarkBytes(fmt.Sprintf("%sOUTPUT_%d", BenchmarkPath, index))
+}
+
+// SampleThroughput emits the bytes transferred by a data phase every interval, based on the
+// benchmarks written by the OSMO CLI. Sampling stops, after emitting the last partial window,
+// when the returned channel receives a value.
+func SampleThroughput(interval time.Duration, phase string, metricChan chan metrics.Metric,
+	retryId string, groupName string, taskName string) chan bool {
+	stopChan := make(chan bool)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		windowStart := time.Now()
+		lastTotal := totalBenchmarkBytes()
+		emitWindow := func() {
+			windowEnd := time.Now()
+			total := totalBenchmarkBytes()
+			transferred := total - lastTotal
+			if transferred < 0 {
+				transferred = 0
+			}
+			metricChan <- metrics.ThroughputWindowMetrics{
+				RetryId:          retryId,
+				GroupName:        groupName,
+				TaskName:         taskName,
+				Phase:            phase,
+				StartTime:        windowStart.Format("2006-01-02 15:04:05.000"),
+				EndTime:          windowEnd.Format("2006-01-02 15:04:05.000"),
+				BytesTransferred: transferred,
+				BytesPerMinute:   float64(transferred) / windowEnd.Sub(windowStart).Minutes(),
+			}
+			windowStart = windowEnd
+			lastTotal = total
+		}
+
+		for {
+			select {
+			case <-stopChan:
+				emitWindow()
+				return
+			case <-ticker.C:
+				emitWindow()
+			}
+		}
+	}()
+	return stopChan
+}
+
+// CollectBenchmarkMetrics reads the benchmark files under benchmarkPath. It also returns the
+// files that could not be parsed, for example because the OSMO CLI was killed while writing them.
+func CollectBenchmarkMetrics(benchmarkPath string) ([]BenchmarkMetrics, []string) {
+	registerScratchDir(benchmarkPath)
 	entries, err := os.ReadDir(benchmarkPath)
 	if err != nil {
 		fmt.Printf("Error reading directory: %v\n", err)
-		return nil
+		return nil, nil
 	}
 
 	var benchmarkMetrics []BenchmarkMetrics
+	var benchmarkFailures []string
 	for _, entry := range entries {
 		if !entry.IsDir() && strings.HasSuffix(entry.Name(), BenchmarkSuffix) {
 			filePath := filepath.Join(benchmarkPath, entry.Name())
 			data, err := os.ReadFile(filePath)
 			if err != nil {
-				fmt.Printf("Error reading file %s: %v\n", filePath, err)
+				log.Printf("WARNING: Skipping unreadable benchmark file %s: %v", filePath, err)
+				benchmarkFailures = append(benchmarkFailures, filePath)
 				continue
 			}
 
 			var benchmarkMetric BenchmarkMetrics
 			if err := json.Unmarshal(data, &benchmarkMetric); err != nil {
-				fmt.Printf("Error unmarshalling JSON from file %s: %v\n", filePath, err)
+				log.Printf("WARNING: Skipping unparseable benchmark file %s: %v", filePath, err)
+				benchmarkFailures = append(benchmarkFailures, filePath)
 				continue
 			}
 
@@ -781,7 +1753,7 @@ func CollectBenchmarkMetrics(benchmarkPath string) []BenchmarkMetrics {
 		}
 	}
 
-	return benchmarkMetrics
+	return benchmarkMetrics, benchmarkFailures
 }
 
 func Checkpoint(opsChan chan string, checkpointInfo string,
@@ -811,13 +1783,13 @@ func Checkpoint(opsChan chan string, checkpointInfo string,
 		case <-timer.C:
 			// Upload the data
 			opsChan <- fmt.Sprintf("Checkpointing data from %s to %s...", path, url)
-			UploadData(url, path, regex, opsChan, "")
+			UploadData(url, path, regex, opsChan, "", "")
 			timer = time.NewTimer(duration)
 		case <-ticker.C:
 			if *stopCheckpoint {
 				timer.Stop()
 				opsChan <- fmt.Sprintf("Checkpointing data from %s to %s...", path, url)
-				UploadData(url, path, regex, opsChan, "")
+				UploadData(url, path, regex, opsChan, "", "")
 				opsChan <- fmt.Sprintf("Checkpointing data from %s to %s finished", path,
 					url)
 				return
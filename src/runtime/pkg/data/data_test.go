@@ -0,0 +1,333 @@
+/*
+SPDX-FileCopyrightText: Copyright (c) 2025 NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package data
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"go.corp.nvidia.com/osmo/runtime/pkg/common"
+)
+
+func TestParseCpuCount(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{value: "", want: "1"},
+		{value: " ", want: "1"},
+		{value: "4", want: "4"},
+		{value: " 8\n", want: "8"},
+		{value: "007", want: "7"},
+		{value: CpuCountAuto, want: strconv.Itoa(runtime.NumCPU())},
+		{value: "all", wantErr: true},
+		{value: "0", wantErr: true},
+		{value: "-2", wantErr: true},
+		{value: "1.5", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(strconv.Quote(test.value), func(t *testing.T) {
+			got, err := ParseCpuCount(test.value)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %s", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("expected %s, got %s", test.want, got)
+			}
+		})
+	}
+}
+
+func TestEmptyMounts(t *testing.T) {
+	tests := []struct {
+		name        string
+		numEmpty    int
+		numMounts   int
+		failPercent int
+		wantMessage string
+		wantFail    bool
+	}{
+		{
+			name:        "all empty",
+			numEmpty:    3,
+			numMounts:   3,
+			failPercent: 100,
+			wantMessage: "All Mounts for dataset failed",
+			wantFail:    true,
+		},
+		{
+			name:        "some empty",
+			numEmpty:    1,
+			numMounts:   3,
+			failPercent: 100,
+			wantMessage: "WARNING: Partial Mount for dataset failed: 1 of 3 mounts are empty",
+		},
+		{
+			name:        "some empty over a lower threshold",
+			numEmpty:    2,
+			numMounts:   3,
+			failPercent: 50,
+			wantMessage: "WARNING: Partial Mount for dataset failed: 2 of 3 mounts are empty",
+			wantFail:    true,
+		},
+		{
+			name:        "some empty under a lower threshold",
+			numEmpty:    1,
+			numMounts:   3,
+			failPercent: 50,
+			wantMessage: "WARNING: Partial Mount for dataset failed: 1 of 3 mounts are empty",
+		},
+		{
+			name:        "all empty without a threshold",
+			numEmpty:    3,
+			numMounts:   3,
+			failPercent: 0,
+			wantMessage: "All Mounts for dataset failed",
+		},
+		{
+			name:        "none empty",
+			numMounts:   3,
+			failPercent: 1,
+			wantMessage: "Mounting finished for dataset",
+		},
+		{
+			name:        "no mounts",
+			failPercent: 100,
+			wantMessage: "Mounting finished for dataset",
+		},
+	}
+
+	failPercent := EmptyMountFailPercent
+	defer func() { EmptyMountFailPercent = failPercent }()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			EmptyMountFailPercent = test.failPercent
+			message := emptyMountsMessage("dataset", test.numEmpty, test.numMounts)
+			if message != test.wantMessage {
+				t.Errorf("expected %q, got %q", test.wantMessage, message)
+			}
+			fail := emptyMountsExceedThreshold(test.numEmpty, test.numMounts)
+			if fail != test.wantFail {
+				t.Errorf("expected the input to fail: %t, got %t", test.wantFail, fail)
+			}
+		})
+	}
+}
+
+func TestValidateCollection(t *testing.T) {
+	member := func(name string, hashLocation string) VersionInfo {
+		return VersionInfo{Name: name, Version: "1", Uri: "s3://bucket/" + name,
+			HashLocation: hashLocation}
+	}
+
+	tests := []struct {
+		name         string
+		members      []VersionInfo
+		downloadType string
+		wantErr      bool
+	}{
+		{
+			name:         "members with hash locations",
+			members:      []VersionInfo{member("a", "s3://hashes/a"), member("b", "s3://hashes/b")},
+			downloadType: Mountpoint,
+		},
+		{
+			name:         "nested collection mounted",
+			members:      []VersionInfo{member("a", "s3://hashes/a"), member("nested", "")},
+			downloadType: Mountpoint,
+			wantErr:      true,
+		},
+		{
+			name:         "nested collection downloaded",
+			members:      []VersionInfo{member("a", "s3://hashes/a"), member("nested", "")},
+			downloadType: Download,
+		},
+		{
+			name:         "member twice",
+			members:      []VersionInfo{member("a", "s3://hashes/a"), member("a", "s3://hashes/a")},
+			downloadType: Download,
+			wantErr:      true,
+		},
+		{
+			name:         "member without a version",
+			members:      []VersionInfo{{Name: "a", Uri: "s3://bucket/a"}},
+			downloadType: Download,
+			wantErr:      true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			datasetInfo := DatasetInfo{Type: DatasetTypeCollection, Versions: test.members}
+			err := validateCollection(datasetInfo, test.downloadType)
+			if test.wantErr && err == nil {
+				t.Error("expected the collection to be rejected")
+			}
+			if !test.wantErr && err != nil {
+				t.Errorf("expected the collection to be accepted: %v", err)
+			}
+		})
+	}
+}
+
+func TestVersionLayout(t *testing.T) {
+	version := VersionInfo{Name: "member", HashLocation: "s3://hashes/member"}
+
+	collection := DatasetInfo{Type: DatasetTypeCollection, HashLocation: "s3://hashes/collection"}
+	benchmarkPath, manifestFolder, hashesUri := versionLayout(collection, version,
+		"/benchmarks/INPUT_0", "input-manifest")
+	if benchmarkPath != "/benchmarks/INPUT_0/member" || manifestFolder != "input-manifest/member" ||
+		hashesUri != "s3://hashes/member" {
+		t.Errorf("expected the layout of the member, got %s, %s and %s", benchmarkPath,
+			manifestFolder, hashesUri)
+	}
+
+	dataset := DatasetInfo{Type: "DATASET", HashLocation: "s3://hashes/dataset"}
+	benchmarkPath, manifestFolder, hashesUri = versionLayout(dataset, version,
+		"/benchmarks/INPUT_0", "input-manifest")
+	if benchmarkPath != "/benchmarks/INPUT_0" || manifestFolder != "input-manifest" ||
+		hashesUri != "s3://hashes/dataset" {
+		t.Errorf("expected the layout of the dataset, got %s, %s and %s", benchmarkPath,
+			manifestFolder, hashesUri)
+	}
+}
+
+func TestCollectBenchmarkMetricsMalformed(t *testing.T) {
+	benchmarkPath := t.TempDir()
+	files := map[string]string{
+		"0" + BenchmarkSuffix: `{"start_time_ms": 1000, "end_time_ms": 2000, ` +
+			`"total_bytes_transferred": 1024, "total_number_of_files": 2}`,
+		// Cut off, as when the OSMO CLI is killed while writing it
+		"1" + BenchmarkSuffix: `{"start_time_ms": 1000, "end_ti`,
+		"notes.txt":           "not a benchmark",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(benchmarkPath, name), []byte(content),
+			0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	benchmarks, failures := CollectBenchmarkMetrics(benchmarkPath)
+	if len(benchmarks) != 1 || benchmarks[0].TotalBytesTransferred != 1024 ||
+		benchmarks[0].TotalNumberOfFiles != 2 {
+		t.Errorf("expected the parseable benchmark to be collected, got %+v", benchmarks)
+	}
+	malformed := filepath.Join(benchmarkPath, "1"+BenchmarkSuffix)
+	if len(failures) != 1 || failures[0] != malformed {
+		t.Errorf("expected the failures [%s], got %v", malformed, failures)
+	}
+}
+
+func TestOutputsSize(t *testing.T) {
+	outputPath := t.TempDir() + "/"
+	files := map[string]int{"a.txt": 10, "sub/b.bin": 5, "sub/c.txt": 3}
+	for name, size := range files {
+		path := filepath.Join(outputPath, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	outputs := []InputOutput{
+		&UrlOutput{Url: "s3://bucket/out", Regex: `.*\.txt`},
+		&UpdateDatasetOutput{Dataset: "dataset", Paths: common.ArrayFlags{"sub:remote"}},
+		&KpiOutput{Url: "s3://bucket/kpi", Path: "sub/*.txt"},
+		&UpdateDatasetOutput{Dataset: "dataset", Paths: common.ArrayFlags{"missing"}},
+	}
+	size, outputSizes := OutputsSize(outputs, outputPath, make(chan string, 10))
+	// The regex is left to the osmo CLI, and files shared by outputs are counted once
+	if size != 18 {
+		t.Errorf("expected a total of 18 bytes, got %d", size)
+	}
+	wantSizes := []int64{18, 8, 3, 0}
+	if fmt.Sprint(outputSizes) != fmt.Sprint(wantSizes) {
+		t.Errorf("expected the output sizes %v, got %v", wantSizes, outputSizes)
+	}
+}
+
+// Records the credential each mount runs with in the mounted folder, the second argument
+const fakeMountScript = `#!/bin/sh
+echo "$AWS_ACCESS_KEY_ID" > "$2/key"
+echo "mounted $2" >&2
+`
+
+func TestMountURLConcurrentCredentials(t *testing.T) {
+	mountPath := filepath.Join(t.TempDir(), "mount-s3")
+	if err := os.WriteFile(mountPath, []byte(fakeMountScript), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("MOUNT_S3_PATH", mountPath)
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+
+	osmoChan := make(chan string, 100)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := fmt.Sprintf("key-%d", i)
+			config := ConfigInfo{
+				Auth: DataConfig{Data: map[string]DataCredential{
+					DefaultDataProfile: {AccessKeyId: key},
+				}},
+				ConfigDir: t.TempDir(),
+			}
+			localPath := t.TempDir()
+			result := MountURL(Mountpoint, config, fmt.Sprintf("s3://bucket-%d/path", i),
+				localPath, t.TempDir(), 0, 0, osmoChan)
+			if result.Status != MountSucceeded {
+				t.Errorf("expected mount %d to succeed, got %+v", i, result)
+				return
+			}
+			mounted, err := os.ReadFile(filepath.Join(localPath, "key"))
+			if err != nil {
+				t.Error(err)
+			} else if got := strings.TrimSpace(string(mounted)); got != key {
+				t.Errorf("expected mount %d to run with %s, got %s", i, key, got)
+			}
+			if entries, _ := os.ReadDir(config.ConfigDir); len(entries) != 0 {
+				t.Errorf("expected the log of mount %d to be removed, found %d files", i,
+					len(entries))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if key := os.Getenv("AWS_ACCESS_KEY_ID"); key != "" {
+		t.Errorf("expected the credential to stay out of the ctrl environment, got %s", key)
+	}
+}
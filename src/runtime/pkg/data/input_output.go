@@ -20,10 +20,14 @@ package data
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/fs"
 	"log"
 	"net"
+	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -45,6 +49,69 @@ type DataConfig struct {
 
 type ConfigInfo struct {
 	Auth DataConfig `yaml:"auth"`
+	// Directory of the CLI config the OSMO commands run with, empty for the default directory
+	ConfigDir string `yaml:"-"`
+}
+
+// Name of the data credential used when no profile matches the storage backend
+const DefaultDataProfile string = "default"
+
+// GetDataCredential selects the data credential for a storage backend. Profiles are matched in
+// order of:
+//  1. The exact profile of the backend (e.g. s3://bucket)
+//  2. The longest configured profile that prefixes the backend URI (e.g. s3://bucket/path)
+//  3. The "default" profile
+func (c ConfigInfo) GetDataCredential(backend StorageBackend) (DataCredential, error) {
+	if credential, ok := c.Auth.Data[backend.GetProfile()]; ok {
+		return credential, nil
+	}
+
+	longestProfile := ""
+	for profile := range c.Auth.Data {
+		if profile == DefaultDataProfile {
+			continue
+		}
+		if strings.HasPrefix(backend.GetURI(), strings.TrimSuffix(profile, "/")+"/") &&
+			len(profile) > len(longestProfile) {
+			longestProfile = profile
+		}
+	}
+	if longestProfile != "" {
+		return c.Auth.Data[longestProfile], nil
+	}
+
+	if credential, ok := c.Auth.Data[DefaultDataProfile]; ok {
+		log.Printf("Using %s data credential for %s", DefaultDataProfile, backend.GetProfile())
+		return credential, nil
+	}
+
+	profiles := make([]string, 0, len(c.Auth.Data))
+	for profile := range c.Auth.Data {
+		profiles = append(profiles, profile)
+	}
+	sort.Strings(profiles)
+	return DataCredential{}, fmt.Errorf("no data credential matches %s, configured profiles: [%s]",
+		backend.GetProfile(), strings.Join(profiles, ", "))
+}
+
+// CheckMountCredential checks that the config has a data credential for the storage backend an
+// input is mounted from. Dataset inputs are not checked, since their backends are only known once
+// the dataset is resolved.
+func CheckMountCredential(input InputType, credentialInfo ConfigInfo) error {
+	var urlPath string
+	switch v := input.(type) {
+	case TaskInput:
+		urlPath = v.Url
+	case UrlInput:
+		urlPath = v.Url
+	default:
+		return nil
+	}
+	backend := ParseStorageBackend(urlPath)
+	if _, err := credentialInfo.GetDataCredential(backend); err != nil {
+		return fmt.Errorf("no credentials for backend %s in config: %s", backend.GetProfile(), err)
+	}
+	return nil
 }
 
 // Common functionality needed by dataset/task/url
@@ -57,22 +124,25 @@ type InputType interface {
 	GetFolder() string
 	CreateMount(c net.Conn, inputPath string, credentialInfo ConfigInfo, osmoChan chan string,
 		metricChan chan metrics.Metric, retryId string, groupName string, taskName string,
-		downloadType string, inputIndex int, cacheSize int)
+		downloadType string, inputIndex int, cacheSize int) (benchmarkFailures []string)
 }
 
+// UploadFolder and CreateMount return the benchmark files of the transfer that could not be
+// parsed, so its transfer metrics are incomplete
 type OutputType interface {
 	UploadFolder(c net.Conn, outputPath string, osmoChan chan string,
 		metricChan chan metrics.Metric, retryId string, groupName string, taskName string,
-		outputUrlID string, outputIndex int)
+		outputUrlID string, outputIndex int, configDir string) (benchmarkFailures []string)
 }
 
 // Define "task" input/output
 type TaskInput struct {
-	// task:<folder>,<url>,<regex>
-	Folder string
-	Name   string
-	Url    string
-	Regex  string
+	// task:<folder>,<url>,<regex>[,timeout=<duration>]
+	Folder  string
+	Name    string
+	Url     string
+	Regex   string
+	Timeout time.Duration
 }
 
 func (f TaskInput) GetLogInfo() string       { return f.Name }
@@ -81,21 +151,23 @@ func (f TaskInput) GetFolder() string        { return f.Folder }
 func (f TaskInput) CreateMount(c net.Conn, inputPath string,
 	credentialInfo ConfigInfo, osmoChan chan string, metricChan chan metrics.Metric,
 	retryId string, groupName string, taskName string, downloadType string, inputIndex int,
-	cacheSize int) {
+	cacheSize int) (benchmarkFailures []string) {
 
 	mountPath := CreateFolder(inputPath, f.Folder)
 	inputType := "Mounted"
 
 	if downloadType != Download {
 		cachePath := CreateFolder(inputPath, f.Folder+"-cache")
+		registerScratchDir(cachePath)
 		inputStartTime := time.Now().Format("2006-01-02 15:04:05.000")
-		isEmpty := MountURL(downloadType, credentialInfo, f.Url, mountPath,
-			cachePath, cacheSize, osmoChan)
+		mountResult := MountURL(downloadType, credentialInfo, f.Url, mountPath,
+			cachePath, cacheSize, mountTimeout(f.Timeout), osmoChan)
 		inputEndTime := time.Now().Format("2006-01-02 15:04:05.000")
 
-		if isEmpty {
-			osmoChan <- fmt.Sprintf("Mount for task %s failed", f.Name)
-			downloadType = MountpointFailed
+		if mountResult.IsEmpty() {
+			osmoChan <- fmt.Sprintf("Mount for task %s failed: %s", f.Name,
+				mountResult.Reason)
+			downloadType = mountResult.DownloadType(downloadType)
 		}
 		mountTimes := metrics.TaskIOMetrics{
 			RetryId:       retryId,
@@ -113,7 +185,9 @@ func (f TaskInput) CreateMount(c net.Conn, inputPath string,
 		inputType = "Downloaded"
 
 		benchmarkFolder := fmt.Sprintf("INPUT_%d", inputIndex)
-		benchmarks := DownloadURI(c, f.Url, inputPath+f.Folder, f.Regex, osmoChan, benchmarkFolder)
+		var benchmarks []BenchmarkMetrics
+		benchmarks, benchmarkFailures = DownloadURI(c, f.Url, inputPath+f.Folder, f.Regex,
+			osmoChan, benchmarkFolder, inputTimeout(f.Timeout), credentialInfo.ConfigDir)
 
 		for _, benchmark := range benchmarks {
 			if benchmark.TotalBytesTransferred == 0 {
@@ -139,6 +213,7 @@ func (f TaskInput) CreateMount(c net.Conn, inputPath string,
 	log.Printf("%s %s to %s", inputType, f.Name, inputPath+f.Folder)
 	osmoChan <- inputType + " " + f.Name + " to {{input:" + f.Folder + "}}"
 	PrintDirContents(c, inputPath+f.Folder, 1, osmoChan)
+	return benchmarkFailures
 }
 
 type TaskOutput struct {
@@ -151,10 +226,11 @@ func (f TaskOutput) GetLogInfo() string       { return f.Name }
 func (f TaskOutput) GetUrlIdentifier() string { return f.Url }
 func (f *TaskOutput) UploadFolder(c net.Conn, outputPath string, osmoChan chan string,
 	metricChan chan metrics.Metric, retryId string, groupName string, taskName string,
-	outputUrlID string, outputIndex int) {
+	outputUrlID string, outputIndex int, configDir string) (benchmarkFailures []string) {
 
 	benchmarkFolder := fmt.Sprintf("OUTPUT_%d", outputIndex)
-	benchmarks := UploadData(f.Url, outputPath+"*", "", osmoChan, benchmarkFolder)
+	benchmarks, benchmarkFailures := UploadData(f.Url, outputPath+"*", "", osmoChan,
+		benchmarkFolder, configDir)
 
 	for _, benchmark := range benchmarks {
 		if benchmark.TotalBytesTransferred == 0 {
@@ -178,14 +254,20 @@ func (f *TaskOutput) UploadFolder(c net.Conn, outputPath string, osmoChan chan s
 
 	log.Printf("Uploaded %s from %s", f.Name, outputPath+"*")
 	osmoChan <- "Uploaded " + f.Name
+	return benchmarkFailures
 }
 
 // Define "dataset" input/output
+//
+// A dataset is placed in <input folder>/<dataset name>. A collection places each of its members
+// in <input folder>/<member name>, using the version of the member the collection references.
+// Metrics of a collection are reported per member with the uri of the member.
 type DatasetInput struct {
-	// dataset:<folder>,<dataset | dataset:<tag or version>>,<regex>
+	// dataset:<folder>,<dataset | dataset:<tag or version>>,<regex>[,timeout=<duration>]
 	Folder  string
 	Dataset string
 	Regex   string
+	Timeout time.Duration
 }
 
 func (f DatasetInput) GetLogInfo() string       { return f.Dataset }
@@ -196,7 +278,7 @@ func (f DatasetInput) GetFolder() string {
 func (f DatasetInput) CreateMount(c net.Conn, inputPath string,
 	credentialInfo ConfigInfo, osmoChan chan string, metricChan chan metrics.Metric,
 	retryId string, groupName string, taskName string, downloadType string, inputIndex int,
-	cacheSize int) {
+	cacheSize int) (benchmarkFailures []string) {
 
 	if !strings.HasSuffix(inputPath, "/") {
 		inputPath += "/"
@@ -205,7 +287,8 @@ func (f DatasetInput) CreateMount(c net.Conn, inputPath string,
 
 	commandArgs := []string{"osmo", "dataset", "info", f.Dataset,
 		"--format-type", "json", "-c", "1"}
-	outb := RunOSMOCommandWithRetry(commandArgs, 5, osmoChan, osmo_errors.DOWNLOAD_FAILED_CODE)
+	outb := RunOSMOCommandWithRetry(commandArgs, 5, osmoChan, osmo_errors.DOWNLOAD_FAILED_CODE,
+		credentialInfo.ConfigDir)
 
 	datasetSplit := strings.Split(f.Dataset, "/")
 
@@ -216,8 +299,21 @@ func (f DatasetInput) CreateMount(c net.Conn, inputPath string,
 		osmo_errors.SetExitCode(osmo_errors.DOWNLOAD_FAILED_CODE)
 		panic(fmt.Sprintf("Dataset %s Info is Empty", f.Dataset))
 	}
+	if datasetInfo.Type == DatasetTypeCollection {
+		if err := validateCollection(datasetInfo, downloadType); err != nil {
+			osmoChan <- fmt.Sprintf("Collection %s is not supported: %s", f.Dataset, err)
+			osmo_errors.SetExitCode(osmo_errors.INVALID_INPUT_CODE)
+			panic(fmt.Sprintf("Collection %s is not supported: %s", f.Dataset, err))
+		}
+	}
 	inputType := "Mounted"
 
+	stagingPath := downloadPath
+	if downloadType != Mountpoint {
+		stagingPath = stageDownload(downloadPath,
+			fmt.Sprintf("%s_%s_INPUT_%d", groupName, taskName, inputIndex))
+	}
+
 	var metricsWG sync.WaitGroup
 	writeMetrics := func(m metrics.TaskIOMetrics) {
 		defer metricsWG.Done()
@@ -225,32 +321,26 @@ func (f DatasetInput) CreateMount(c net.Conn, inputPath string,
 	}
 
 	for _, versionInfo := range datasetInfo.Versions {
+		benchmarkPath, manifestFolder, hashesUri := versionLayout(datasetInfo, versionInfo,
+			BenchmarkPath+fmt.Sprintf("%s_%s_INPUT_%d", groupName, taskName, inputIndex),
+			fmt.Sprintf("%s-manifest", f.Folder))
 
 		if downloadType == Mountpoint {
-			isAllEmpty := false
-			isAnyEmpty := false
+			numEmpty := 0
 
 			datasetVersionInfo := versionInfo
 			datasetID := datasetVersionInfo.Name
-			var hashesUri string
-			if datasetInfo.Type == "COLLECTION" {
-				hashesUri = datasetVersionInfo.HashLocation
-			} else {
-				hashesUri = datasetInfo.HashLocation
-			}
 
 			// Download Manifest
 			osmoChan <- fmt.Sprintf("Downloading dataset %s manifest.", datasetID)
 
-			manifestFileLoc := CreateFolder(inputPath, fmt.Sprintf("%s-manifest", f.Folder))
+			manifestFileLoc := CreateFolder(inputPath, manifestFolder)
 
-			benchmarkFolder := fmt.Sprintf("%s_%s_INPUT_%d", groupName, taskName, inputIndex)
-			benchmarkPath := BenchmarkPath + benchmarkFolder
 			linkCommand := []string{"osmo", "data", "download", datasetVersionInfo.Uri,
 				manifestFileLoc, "--processes", CpuCount, "--benchmark-out", benchmarkPath}
 
 			RunOSMOCommandStreamingWithRetry(linkCommand, linkCommand, 5,
-				osmoChan, osmo_errors.DOWNLOAD_FAILED_CODE)
+				osmoChan, osmo_errors.DOWNLOAD_FAILED_CODE, credentialInfo.ConfigDir)
 
 			manifestFilePath := manifestFileLoc + "/" + filepath.Base(datasetVersionInfo.Uri)
 			datasetFolderPath := downloadPath + "/" + datasetVersionInfo.Name
@@ -269,21 +359,22 @@ func (f DatasetInput) CreateMount(c net.Conn, inputPath string,
 						fmt.Sprintf("%s-hashes/%s/%d", f.Folder, datasetID, idx))
 					mountCacheFolder := CreateFolder(inputPath,
 						fmt.Sprintf("%s-hashes/%s/%d", f.Folder, datasetID+"-cache", idx))
+					registerScratchDir(mountCacheFolder)
 					mountLocations[profile] = mountLocation
 					log.Printf("Profile: %s mounting to: %s", mountLocation.URI, mountFolder)
 
 					// Mount the folder
 					inputStartTime := time.Now().Format("2006-01-02 15:04:05.000")
-					isEmpty := MountURL(Mountpoint, credentialInfo, mountLocation.URI, mountFolder,
-						mountCacheFolder, cacheSize/numMounts, osmoChan)
+					mountResult := MountURL(Mountpoint, credentialInfo, mountLocation.URI,
+						mountFolder, mountCacheFolder, cacheSize/numMounts, mountTimeout(f.Timeout),
+						osmoChan)
 					inputEndTime := time.Now().Format("2006-01-02 15:04:05.000")
+					isEmpty := mountResult.IsEmpty()
 
-					localDownloadType := downloadType
+					localDownloadType := mountResult.DownloadType(downloadType)
 					if isEmpty {
-						// Either mounting failed or no hashes
-						osmoChan <- fmt.Sprintf("Mount folder for path %s is empty",
-							mountLocation.URI)
-						localDownloadType = MountpointFailed
+						osmoChan <- fmt.Sprintf("Mount for path %s failed: %s",
+							mountLocation.URI, mountResult.Reason)
 					} else {
 						// Update only when mount successful so if it failed, we don't try to link
 						// those files
@@ -309,18 +400,20 @@ func (f DatasetInput) CreateMount(c net.Conn, inputPath string,
 						DownloadType:  localDownloadType,
 					})
 
-					isAllEmpty = isAllEmpty && isEmpty
-					isAnyEmpty = isAnyEmpty || isEmpty
+					if isEmpty {
+						numEmpty++
+					}
 
 					idx++
 				}
 
-				if isAllEmpty {
-					osmoChan <- fmt.Sprintf("All Mounts for %s failed", datasetID)
-				} else if isAnyEmpty {
-					osmoChan <- fmt.Sprintf("Partial Mount for %s failed", datasetID)
-				} else {
-					osmoChan <- fmt.Sprintf("Mounting finished for %s", datasetID)
+				osmoChan <- emptyMountsMessage(datasetID, numEmpty, numMounts)
+				if emptyMountsExceedThreshold(numEmpty, numMounts) {
+					metricsWG.Wait()
+					osmo_errors.SetExitCode(osmo_errors.MOUNT_FAILED_CODE)
+					panic(fmt.Sprintf("%d of %d mounts for %s are empty, which reaches the "+
+						"failure threshold of %d%%", numEmpty, numMounts, datasetID,
+						EmptyMountFailPercent))
 				}
 
 				// Link the manifest files
@@ -328,10 +421,22 @@ func (f DatasetInput) CreateMount(c net.Conn, inputPath string,
 
 				// Link files from the manifest to the dataset location
 				if err := LinkManifest(manifestFilePath, mountLocations, destination); err != nil {
-					isAllEmpty = true
+					osmoChan <- fmt.Sprintf("Linking dataset %s manifest failed: %s", datasetID, err)
 				} else {
+					if ReadWriteDatasetMounts {
+						writeBackDataset := datasetID
+						if len(datasetSplit) > 1 {
+							writeBackDataset = datasetSplit[0] + "/" + writeBackDataset
+						}
+						osmoChan <- fmt.Sprintf("WARNING: %s is mounted read-write (experimental). "+
+							"Files written to it are uploaded as a new version on unmount.",
+							writeBackDataset)
+						registerWriteBackMount(writeBackDataset, destination)
+					}
+
 					// Write metrics for downloading mounted files
-					benchmarks := CollectBenchmarkMetrics(benchmarkPath)
+					benchmarks, failures := CollectBenchmarkMetrics(benchmarkPath)
+					benchmarkFailures = append(benchmarkFailures, failures...)
 					for _, benchmark := range benchmarks {
 						if benchmark.TotalBytesTransferred == 0 {
 							// Nothing transferred for this benchmark, skipping
@@ -365,9 +470,7 @@ func (f DatasetInput) CreateMount(c net.Conn, inputPath string,
 				inputDataset = datasetSplit[0] + "/" + inputDataset
 			}
 
-			benchmarkFolder := fmt.Sprintf("%s_%s_INPUT_%d", groupName, taskName, inputIndex)
-			benchmarkPath := BenchmarkPath + benchmarkFolder
-			commandInput := []string{"osmo", "dataset", "download", inputDataset, downloadPath,
+			commandInput := []string{"osmo", "dataset", "download", inputDataset, stagingPath,
 				"--processes", CpuCount, "--benchmark-out", benchmarkPath}
 
 			if f.Regex != "" {
@@ -379,10 +482,12 @@ func (f DatasetInput) CreateMount(c net.Conn, inputPath string,
 			// Construct resume command
 			downloadResumeCommand := append(commandInput, "--resume")
 
-			RunOSMOCommandStreamingWithRetry(downloadCommand, downloadResumeCommand,
-				5, osmoChan, osmo_errors.DOWNLOAD_FAILED_CODE)
+			RunOSMOCommandStreamingWithRetryTimeout(downloadCommand, downloadResumeCommand,
+				5, osmoChan, osmo_errors.DOWNLOAD_FAILED_CODE, inputTimeout(f.Timeout),
+				credentialInfo.ConfigDir)
 
-			benchmarks := CollectBenchmarkMetrics(benchmarkPath)
+			benchmarks, failures := CollectBenchmarkMetrics(benchmarkPath)
+			benchmarkFailures = append(benchmarkFailures, failures...)
 
 			for _, benchmark := range benchmarks {
 				if benchmark.TotalBytesTransferred == 0 {
@@ -409,10 +514,144 @@ func (f DatasetInput) CreateMount(c net.Conn, inputPath string,
 
 	// Wait for all metrics to be processed before moving on.
 	metricsWG.Wait()
+	commitDownload(stagingPath, downloadPath)
 
 	log.Printf("%s %s to %s", inputType, f.Dataset, downloadPath)
 	osmoChan <- inputType + " " + f.Dataset + " to {{input:" + f.Folder + "}}"
 	PrintDirContents(c, downloadPath, 2, osmoChan)
+	return benchmarkFailures
+}
+
+const (
+	// Metadata and label files named in dataset output specs are relative to the output folder
+	MetadataPathRelative string = "relative"
+	// Metadata and label files named in dataset output specs are used as given
+	MetadataPathAbsolute string = "absolute"
+)
+
+// How metadata and label files named in dataset output specs are resolved. The metadata file
+// passed to ctrl with -metadataFile is always used as given.
+var MetadataPathMode string = MetadataPathRelative
+
+// resolveOutputFile returns the path of a metadata or label file named in a dataset output spec
+func resolveOutputFile(outputPath string, file string) string {
+	if MetadataPathMode == MetadataPathAbsolute {
+		return file
+	}
+	return outputPath + file
+}
+
+// ValidateOutputFiles checks that the metadata and label files of a dataset output exist, so a
+// missing file fails the task before any upload starts
+func ValidateOutputFiles(output InputOutput, outputPath string, metadataFile string) error {
+	var files []string
+	switch v := output.(type) {
+	case *DatasetOutput:
+		files = append(files, v.Metadata...)
+		files = append(files, v.Labels...)
+	case *UpdateDatasetOutput:
+		files = append(files, v.Metadata...)
+		files = append(files, v.Labels...)
+	default:
+		return nil
+	}
+
+	paths := []string{metadataFile}
+	for _, file := range files {
+		paths = append(paths, resolveOutputFile(outputPath, file))
+	}
+	var missing []string
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			missing = append(missing, path)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("metadata or label files of %s do not exist: %s",
+			output.GetLogInfo(), strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// outputPatterns returns the patterns of the paths an output uploads from the output folder
+func outputPatterns(output InputOutput, outputPath string) []string {
+	switch v := output.(type) {
+	case *DatasetOutput:
+		if len(v.Path) > 0 {
+			return []string{outputPath + v.Path}
+		}
+		return []string{outputPath + "*"}
+	case *UpdateDatasetOutput:
+		var patterns []string
+		for _, path := range v.Paths {
+			localPath := strings.Split(path, ":")[0]
+			if len(localPath) == 0 {
+				localPath = "*"
+			}
+			patterns = append(patterns, outputPath+localPath)
+		}
+		return patterns
+	case *UrlOutput, *TaskOutput:
+		return []string{outputPath + "*"}
+	case *KpiOutput:
+		return []string{outputPath + v.Path}
+	}
+	return nil
+}
+
+// addFileSizes adds the regular files under path, or path itself if it is a file, to files with
+// their size
+func addFileSizes(files map[string]int64, path string) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	if !info.IsDir() {
+		if info.Mode().IsRegular() {
+			files[filepath.Clean(path)] = info.Size()
+		}
+		return
+	}
+	filepath.WalkDir(path, func(file string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return nil
+		}
+		fileInfo, err := os.Stat(file)
+		if err == nil && fileInfo.Mode().IsRegular() {
+			files[filepath.Clean(file)] = fileInfo.Size()
+		}
+		return nil
+	})
+}
+
+// OutputsSize returns the total bytes of the files the outputs upload from the output folder, and
+// the bytes each output uploads. The paths of an output are matched with GetFiles like the upload
+// does. A file uploaded by several outputs is counted once in the total. The regex of an output is
+// applied by the osmo CLI, so the files it excludes are still counted.
+func OutputsSize(outputs []InputOutput, outputPath string, osmoChan chan string) (int64, []int64) {
+	files := make(map[string]int64)
+	outputSizes := make([]int64, len(outputs))
+	for i, output := range outputs {
+		outputFiles := make(map[string]int64)
+		for _, pattern := range outputPatterns(output, outputPath) {
+			for _, path := range common.GetFiles(transferContext, pattern, osmoChan) {
+				addFileSizes(outputFiles, path)
+			}
+		}
+		for file, fileSize := range outputFiles {
+			files[file] = fileSize
+			outputSizes[i] += fileSize
+		}
+	}
+
+	var size int64
+	for _, fileSize := range files {
+		size += fileSize
+	}
+	return size, outputSizes
 }
 
 type DatasetOutput struct {
@@ -430,7 +669,7 @@ func (f DatasetOutput) GetLogInfo() string       { return f.Dataset }
 func (f DatasetOutput) GetUrlIdentifier() string { return f.Url }
 func (f *DatasetOutput) UploadFolder(c net.Conn, outputPath string, osmoChan chan string,
 	metricChan chan metrics.Metric, retryId string, groupName string, taskName string,
-	outputUrlID string, outputIndex int) {
+	outputUrlID string, outputIndex int, configDir string) (benchmarkFailures []string) {
 	if f.MetadataFile == "" {
 		osmo_errors.SetExitCode(osmo_errors.UPLOAD_FAILED_CODE)
 		panic("Metadata File is not Set")
@@ -443,7 +682,8 @@ func (f *DatasetOutput) UploadFolder(c net.Conn, outputPath string, osmoChan cha
 	} else {
 		combineOut += "*"
 	}
-	files := common.GetFiles(combineOut, osmoChan)
+	files := scanOutputFiles(combineOut, osmoChan, metricChan, retryId, groupName, taskName,
+		outputUrlID)
 
 	if len(files) == 0 {
 		osmoChan <- fmt.Sprintf("No files in path %s", combineOut)
@@ -462,7 +702,7 @@ func (f *DatasetOutput) UploadFolder(c net.Conn, outputPath string, osmoChan cha
 		log.Printf("Fetching version for %s", f.Dataset)
 		metadataInput := []string{"--metadata", f.MetadataFile}
 		for _, metadataFile := range f.Metadata {
-			metadataFilePath := outputPath + metadataFile
+			metadataFilePath := resolveOutputFile(outputPath, metadataFile)
 			if !common.CheckIfFileExists(metadataFilePath, osmoChan) {
 				return
 			}
@@ -471,7 +711,8 @@ func (f *DatasetOutput) UploadFolder(c net.Conn, outputPath string, osmoChan cha
 		commandArgs := []string{"osmo", "dataset", "upload", f.Dataset, "/tmp", "--start-only",
 			"--processes", CpuCount}
 		commandArgs = append(commandArgs, metadataInput...)
-		outb := RunOSMOCommandWithRetry(commandArgs, 5, osmoChan, osmo_errors.UPLOAD_FAILED_CODE)
+		outb := RunOSMOCommandWithRetry(commandArgs, 5, osmoChan, osmo_errors.UPLOAD_FAILED_CODE,
+			configDir)
 
 		var datasetInfo DatasetStartInfo
 		json.Unmarshal(outb.Bytes(), &datasetInfo)
@@ -484,7 +725,7 @@ func (f *DatasetOutput) UploadFolder(c net.Conn, outputPath string, osmoChan cha
 	commandInput := []string{"osmo", "dataset", "upload", "--resume", f.Dataset, combineOut,
 		"--processes", CpuCount, "--benchmark-out", benchmarkPath}
 	for _, labelsFile := range f.Labels {
-		labelsFilePath := outputPath + labelsFile
+		labelsFilePath := resolveOutputFile(outputPath, labelsFile)
 		if !common.CheckIfFileExists(labelsFilePath, osmoChan) {
 			return
 		}
@@ -496,10 +737,10 @@ func (f *DatasetOutput) UploadFolder(c net.Conn, outputPath string, osmoChan cha
 	}
 
 	RunOSMOCommandStreamingWithRetry(commandInput, commandInput, 5, osmoChan,
-		osmo_errors.UPLOAD_FAILED_CODE)
+		osmo_errors.UPLOAD_FAILED_CODE, configDir)
 
 	// Write benchmark metrics
-	benchmarks := CollectBenchmarkMetrics(benchmarkPath)
+	benchmarks, benchmarkFailures := CollectBenchmarkMetrics(benchmarkPath)
 	for _, benchmark := range benchmarks {
 		if benchmark.TotalBytesTransferred == 0 {
 			continue
@@ -525,13 +766,19 @@ func (f *DatasetOutput) UploadFolder(c net.Conn, outputPath string, osmoChan cha
 
 	if datasetTag != "" {
 		commandArgs := []string{"osmo", "dataset", "tag", f.Dataset, "--set", datasetTag}
-		RunOSMOCommandWithRetry(commandArgs, 5, osmoChan, osmo_errors.UPLOAD_FAILED_CODE)
+		RunOSMOCommandWithRetry(commandArgs, 5, osmoChan, osmo_errors.UPLOAD_FAILED_CODE,
+			configDir)
 		osmoChan <- "Tagged " + f.Dataset + " with " + datasetTag
 	}
 
-	f.Url = SendDatasetSizeAndChecksum(c, f.Dataset, osmoChan)
+	f.Url = SendDatasetSizeAndChecksum(c, f.Dataset, osmoChan, configDir)
+	return benchmarkFailures
 }
 
+// Whether an update_dataset output fails when one of its paths has no files. Otherwise empty
+// paths are skipped.
+var StrictUpdatePaths bool
+
 type UpdateDatasetOutput struct {
 	// dataset:<dataset | dataset:<tag>>,<path>,<metadata>...;<regex>
 	Dataset      string
@@ -546,7 +793,7 @@ func (f UpdateDatasetOutput) GetLogInfo() string       { return f.Dataset }
 func (f UpdateDatasetOutput) GetUrlIdentifier() string { return f.Url }
 func (f *UpdateDatasetOutput) UploadFolder(c net.Conn, outputPath string, osmoChan chan string,
 	metricChan chan metrics.Metric, retryId string, groupName string, taskName string,
-	outputUrlID string, outputIndex int) {
+	outputUrlID string, outputIndex int, configDir string) (benchmarkFailures []string) {
 	if f.MetadataFile == "" {
 		osmo_errors.SetExitCode(osmo_errors.UPLOAD_FAILED_CODE)
 		panic("Metadata File is not Set")
@@ -562,11 +809,16 @@ func (f *UpdateDatasetOutput) UploadFolder(c net.Conn, outputPath string, osmoCh
 		} else {
 			combineOut += "*"
 		}
-		files := common.GetFiles(combineOut, osmoChan)
+		files := scanOutputFiles(combineOut, osmoChan, metricChan, retryId, groupName, taskName,
+			outputUrlID)
+		empty := !hasFiles(files)
 
-		if len(files) == 0 {
+		if empty && StrictUpdatePaths {
 			osmoChan <- fmt.Sprintf("No files in path %s", combineOut)
-			return
+			osmo_errors.SetExitCode(osmo_errors.UPLOAD_FAILED_CODE)
+			panic(fmt.Sprintf("No files in path %s of %s", combineOut, f.Dataset))
+		} else if empty {
+			osmoChan <- fmt.Sprintf("WARNING: No files in path %s, skipping it", combineOut)
 		} else {
 			if len(splitPaths) > 1 {
 				combineOut += ":" + splitPaths[1]
@@ -574,6 +826,10 @@ func (f *UpdateDatasetOutput) UploadFolder(c net.Conn, outputPath string, osmoCh
 			uploadPaths = append(uploadPaths, combineOut)
 		}
 	}
+	if len(uploadPaths) == 0 {
+		osmoChan <- fmt.Sprintf("No files in any path of %s", f.Dataset)
+		return
+	}
 
 	// Upload Dataset
 	var datasetVersion string
@@ -584,7 +840,7 @@ func (f *UpdateDatasetOutput) UploadFolder(c net.Conn, outputPath string, osmoCh
 
 		metadataInput := []string{"--metadata", f.MetadataFile}
 		for _, metadataFile := range f.Metadata {
-			metadataFilePath := outputPath + metadataFile
+			metadataFilePath := resolveOutputFile(outputPath, metadataFile)
 			if !common.CheckIfFileExists(metadataFilePath, osmoChan) {
 				return
 			}
@@ -593,7 +849,8 @@ func (f *UpdateDatasetOutput) UploadFolder(c net.Conn, outputPath string, osmoCh
 		commandArgs := []string{"osmo", "dataset", "update", f.Dataset, "--start-only",
 			"--add", "/tmp", "--processes", CpuCount}
 		commandArgs = append(commandArgs, metadataInput...)
-		outb := RunOSMOCommandWithRetry(commandArgs, 5, osmoChan, osmo_errors.UPLOAD_FAILED_CODE)
+		outb := RunOSMOCommandWithRetry(commandArgs, 5, osmoChan, osmo_errors.UPLOAD_FAILED_CODE,
+			configDir)
 
 		// Fetch new version to construct resume
 		var datasetInfo DatasetStartInfo
@@ -607,7 +864,7 @@ func (f *UpdateDatasetOutput) UploadFolder(c net.Conn, outputPath string, osmoCh
 		"--processes", CpuCount, "--benchmark-out", benchmarkPath}
 	updateInput = append(updateInput, pathsInput...)
 	for _, labelsFile := range f.Labels {
-		labelsFilePath := outputPath + labelsFile
+		labelsFilePath := resolveOutputFile(outputPath, labelsFile)
 		if !common.CheckIfFileExists(labelsFilePath, osmoChan) {
 			return
 		}
@@ -615,10 +872,10 @@ func (f *UpdateDatasetOutput) UploadFolder(c net.Conn, outputPath string, osmoCh
 	}
 
 	RunOSMOCommandStreamingWithRetry(updateInput, updateInput, 5, osmoChan,
-		osmo_errors.UPLOAD_FAILED_CODE)
+		osmo_errors.UPLOAD_FAILED_CODE, configDir)
 
 	// Write benchmark metrics
-	benchmarks := CollectBenchmarkMetrics(benchmarkPath)
+	benchmarks, benchmarkFailures := CollectBenchmarkMetrics(benchmarkPath)
 	for _, benchmark := range benchmarks {
 		if benchmark.TotalBytesTransferred == 0 {
 			continue
@@ -649,15 +906,17 @@ func (f *UpdateDatasetOutput) UploadFolder(c net.Conn, outputPath string, osmoCh
 		f.Dataset = f.Dataset + ":" + datasetVersion
 	}
 
-	f.Url = SendDatasetSizeAndChecksum(c, f.Dataset, osmoChan)
+	f.Url = SendDatasetSizeAndChecksum(c, f.Dataset, osmoChan, configDir)
+	return benchmarkFailures
 }
 
 // Define "url" input/output
 type UrlInput struct {
-	// url:<folder>,<url>,<regex>
-	Folder string
-	Url    string
-	Regex  string
+	// url:<folder>,<url>,<regex>[,timeout=<duration>]
+	Folder  string
+	Url     string
+	Regex   string
+	Timeout time.Duration
 }
 
 func (f UrlInput) GetLogInfo() string       { return f.Url }
@@ -666,7 +925,7 @@ func (f UrlInput) GetFolder() string        { return f.Folder }
 func (f UrlInput) CreateMount(c net.Conn, inputPath string,
 	credentialInfo ConfigInfo, osmoChan chan string, metricChan chan metrics.Metric,
 	retryId string, groupName string, taskName string, downloadType string, inputIndex int,
-	cacheSize int) {
+	cacheSize int) (benchmarkFailures []string) {
 
 	mountPath := CreateFolder(inputPath, f.Folder)
 	inputType := "Mounted"
@@ -674,14 +933,15 @@ func (f UrlInput) CreateMount(c net.Conn, inputPath string,
 	if downloadType != Download {
 		// TODO: Detect if url is to a file to download instead of mount
 		cachePath := CreateFolder(inputPath, f.Folder+"-cache")
+		registerScratchDir(cachePath)
 		inputStartTime := time.Now().Format("2006-01-02 15:04:05.000")
-		isEmpty := MountURL(downloadType, credentialInfo, f.Url, mountPath,
-			cachePath, cacheSize, osmoChan)
+		mountResult := MountURL(downloadType, credentialInfo, f.Url, mountPath,
+			cachePath, cacheSize, mountTimeout(f.Timeout), osmoChan)
 		inputEndTime := time.Now().Format("2006-01-02 15:04:05.000")
 
-		if isEmpty {
-			osmoChan <- fmt.Sprintf("Mount for %s failed", f.Url)
-			downloadType = MountpointFailed
+		if mountResult.IsEmpty() {
+			osmoChan <- fmt.Sprintf("Mount for %s failed: %s", f.Url, mountResult.Reason)
+			downloadType = mountResult.DownloadType(downloadType)
 		}
 		mountTimes := metrics.TaskIOMetrics{
 			RetryId:       retryId,
@@ -698,7 +958,11 @@ func (f UrlInput) CreateMount(c net.Conn, inputPath string,
 	} else {
 		inputType = "Downloaded"
 		benchmarkFolder := fmt.Sprintf("%s_%s_INPUT_%d", groupName, taskName, inputIndex)
-		benchmarks := DownloadURI(c, f.Url, inputPath+f.Folder, f.Regex, osmoChan, benchmarkFolder)
+		stagingPath := stageDownload(mountPath, benchmarkFolder)
+		var benchmarks []BenchmarkMetrics
+		benchmarks, benchmarkFailures = DownloadURI(c, f.Url, stagingPath, f.Regex, osmoChan,
+			benchmarkFolder, inputTimeout(f.Timeout), credentialInfo.ConfigDir)
+		commitDownload(stagingPath, mountPath)
 		for _, benchmark := range benchmarks {
 			if benchmark.TotalBytesTransferred == 0 {
 				// Nothing transferred for this benchmark, skipping
@@ -725,6 +989,7 @@ func (f UrlInput) CreateMount(c net.Conn, inputPath string,
 	log.Printf("%s %s to %s", inputType, f.Url, inputPath+f.Folder)
 	osmoChan <- inputType + " " + f.Url + " to {{input:" + f.Folder + "}}"
 	PrintDirContents(c, inputPath+f.Folder, 1, osmoChan)
+	return benchmarkFailures
 }
 
 type UrlOutput struct {
@@ -737,9 +1002,29 @@ func (f UrlOutput) GetLogInfo() string       { return f.Url }
 func (f UrlOutput) GetUrlIdentifier() string { return f.Url }
 func (f *UrlOutput) UploadFolder(c net.Conn, outputPath string, osmoChan chan string,
 	metricChan chan metrics.Metric, retryId string, groupName string, taskName string,
-	outputUrlID string, outputIndex int) {
+	outputUrlID string, outputIndex int, configDir string) (benchmarkFailures []string) {
 	benchmarkFolder := fmt.Sprintf("OUTPUT_%d", outputIndex)
-	benchmarks := UploadData(f.Url, outputPath+"*", f.Regex, osmoChan, benchmarkFolder)
+	var benchmarks []BenchmarkMetrics
+	files := scanOutputFiles(outputPath+"*", osmoChan, metricChan, retryId, groupName, taskName,
+		outputUrlID)
+	if UploadShards > 1 && len(files) > 1 {
+		shards := shardFiles(files, UploadShards)
+		log.Printf("Uploading %s in %d shards", f.Url, len(shards))
+		benchmarks, benchmarkFailures = runUploadShards(shards, BenchmarkPath+benchmarkFolder,
+			osmoChan, configDir,
+			func(shardPaths []string, shardBenchmarkPath string) []string {
+				uploadInput := append([]string{"osmo", "data", "upload", f.Url}, shardPaths...)
+				uploadInput = append(uploadInput, "--processes", CpuCount,
+					"--benchmark-out", shardBenchmarkPath)
+				if f.Regex != "" {
+					uploadInput = append(uploadInput, "--regex", f.Regex)
+				}
+				return uploadInput
+			})
+	} else {
+		benchmarks, benchmarkFailures = UploadData(f.Url, outputPath+"*", f.Regex, osmoChan,
+			benchmarkFolder, configDir)
+	}
 
 	for _, benchmark := range benchmarks {
 		if benchmark.TotalBytesTransferred == 0 {
@@ -763,6 +1048,7 @@ func (f *UrlOutput) UploadFolder(c net.Conn, outputPath string, osmoChan chan st
 
 	log.Printf("Uploaded %s from %s", f.Url, outputPath+"*")
 	osmoChan <- "Uploaded " + f.Url
+	return benchmarkFailures
 }
 
 type KpiOutput struct {
@@ -775,9 +1061,10 @@ func (f KpiOutput) GetLogInfo() string       { return fmt.Sprintf("KPI: %s", f.P
 func (f KpiOutput) GetUrlIdentifier() string { return fmt.Sprintf("%s/%s", f.Url, f.Path) }
 func (f *KpiOutput) UploadFolder(c net.Conn, outputPath string, osmoChan chan string,
 	metricChan chan metrics.Metric, retryId string, groupName string, taskName string,
-	outputUrlID string, outputIndex int) {
+	outputUrlID string, outputIndex int, configDir string) (benchmarkFailures []string) {
 	benchmarkFolder := fmt.Sprintf("OUTPUT_%d", outputIndex)
-	benchmarks := UploadData(f.Url, outputPath+f.Path, "", osmoChan, benchmarkFolder)
+	benchmarks, benchmarkFailures := UploadData(f.Url, outputPath+f.Path, "", osmoChan,
+		benchmarkFolder, configDir)
 
 	for _, benchmark := range benchmarks {
 		if benchmark.TotalBytesTransferred == 0 {
@@ -801,85 +1088,312 @@ func (f *KpiOutput) UploadFolder(c net.Conn, outputPath string, osmoChan chan st
 
 	log.Printf("Uploaded KPI from %s", f.Path)
 	osmoChan <- "Uploaded KPI: " + f.Path
+	return benchmarkFailures
+}
+
+// Inputs may override the global data timeout by ending the spec with ,timeout=<duration>. The
+// field is split before it is unescaped, so a quoted or escaped ,timeout= stays in the regex.
+// A download is killed and retried once it produces no output for the timeout, so it bounds
+// inactivity rather than the total download time. A mount is aborted once it takes longer than
+// the timeout in total, see mountTimeout.
+func splitInputTimeout(field string) (string, time.Duration) {
+	parts := splitSpec(field, ',', -1)
+	last := parts[len(parts)-1]
+	if len(parts) == 1 || !strings.HasPrefix(last, "timeout=") {
+		return field, 0
+	}
+	timeout, err := time.ParseDuration(strings.TrimPrefix(last, "timeout="))
+	if err != nil || timeout <= 0 {
+		// Not a timeout override, so it is part of the regex
+		return field, 0
+	}
+	return field[:len(field)-len(last)-1], timeout
+}
+
+// Returns the inactivity timeout of downloading an input, defaulting to the global DataTimeout
+func inputTimeout(timeout time.Duration) time.Duration {
+	if timeout > 0 {
+		return timeout
+	}
+	return DataTimeout
+}
+
+// Encodings accepted for input and output specs
+const (
+	SpecFormatLegacy string = "legacy"
+	SpecFormatJSON   string = "json"
+)
+
+// Encoding of the specs passed to ParseInputOutput
+var SpecFormat string = SpecFormatLegacy
+
+// Input or output spec in the JSON encoding. Inputs are the specs that set a folder, e.g.
+//
+//	{"type": "url", "folder": "data", "url": "s3://bucket/a,b", "regex": ".*", "timeout": "30m"}
+//	{"type": "update_dataset", "dataset": "name:tag", "paths": ["out"], "labels": ["l.yaml"]}
+type inputOutputSpec struct {
+	Type     string   `json:"type"`
+	Folder   string   `json:"folder"`
+	Url      string   `json:"url"`
+	Dataset  string   `json:"dataset"`
+	Path     string   `json:"path"`
+	Paths    []string `json:"paths"`
+	Metadata []string `json:"metadata"`
+	Labels   []string `json:"labels"`
+	Regex    string   `json:"regex"`
+	Timeout  string   `json:"timeout"`
+}
+
+func parseInputOutputJSON(value string) InputOutput {
+	var spec inputOutputSpec
+	decoder := json.NewDecoder(strings.NewReader(value))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&spec); err != nil {
+		osmo_errors.SetExitCode(osmo_errors.INVALID_INPUT_CODE)
+		panic(fmt.Sprintf("Invalid JSON spec %s: %s", value, err))
+	}
+
+	var timeout time.Duration
+	if spec.Timeout != "" {
+		var err error
+		timeout, err = time.ParseDuration(spec.Timeout)
+		if err != nil || timeout <= 0 {
+			osmo_errors.SetExitCode(osmo_errors.INVALID_INPUT_CODE)
+			panic(fmt.Sprintf("Invalid timeout %s in spec %s", spec.Timeout, value))
+		}
+	}
+
+	isInput := spec.Folder != ""
+	switch spec.Type {
+	case "task":
+		name := spec.Url[strings.LastIndex(spec.Url, "/")+1:]
+		if isInput {
+			return TaskInput{spec.Folder, name, spec.Url, spec.Regex, timeout}
+		}
+		return &TaskOutput{name, spec.Url}
+	case "url":
+		if isInput {
+			return UrlInput{spec.Folder, spec.Url, spec.Regex, timeout}
+		}
+		return &UrlOutput{spec.Url, spec.Regex}
+	case "dataset":
+		if isInput {
+			return DatasetInput{spec.Folder, spec.Dataset, spec.Regex, timeout}
+		}
+		return &DatasetOutput{spec.Dataset, spec.Path,
+			spec.Metadata, "", spec.Labels, "", spec.Regex}
+	case "update_dataset":
+		pathsLocation := spec.Paths
+		if len(pathsLocation) == 0 {
+			pathsLocation = []string{""}
+		}
+		return &UpdateDatasetOutput{spec.Dataset, pathsLocation,
+			spec.Metadata, "", spec.Labels, ""}
+	case "kpi":
+		return &KpiOutput{spec.Url, spec.Path}
+	}
+	osmo_errors.SetExitCode(osmo_errors.INVALID_INPUT_CODE)
+	panic(fmt.Sprintf("Unknown Input %s", spec.Type))
+}
+
+// splitSpec splits a legacy spec on sep into at most n parts like strings.SplitN, with n < 0
+// returning all parts. Separators escaped with a backslash (\, or \;) or inside a part enclosed
+// in double quotes do not split. The parts keep their escapes and quotes so they can be split
+// again, see unescapeSpec.
+func splitSpec(value string, sep byte, n int) []string {
+	var parts []string
+	start := 0
+	inQuotes := false
+	for i := 0; i < len(value) && (n < 0 || len(parts) < n-1); i++ {
+		switch {
+		case value[i] == '\\' && i+1 < len(value) && strings.IndexByte(`,;"`, value[i+1]) >= 0:
+			i++
+		case value[i] == '"' && (inQuotes || i == start):
+			inQuotes = !inQuotes
+		case value[i] == sep && !inQuotes:
+			parts = append(parts, value[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, value[start:])
+}
+
+// splitSpecList splits a comma separated list of a legacy spec, which is empty for ""
+func splitSpecList(value string) []string {
+	if value == "" {
+		return nil
+	}
+	parts := splitSpec(value, ',', -1)
+	for i, part := range parts {
+		parts[i] = unescapeSpec(part)
+	}
+	return parts
+}
+
+// unescapeSpec removes the quotes enclosing a part of a legacy spec and the backslashes escaping
+// separators and quotes. Other backslashes are kept, so regexes are passed through unchanged.
+// Quotes are only removed when the quote opening the part is closed at its end, as splitSpec
+// reads them, so "a"b and "a\" keep their quotes.
+func unescapeSpec(part string) string {
+	if len(part) >= 2 && closingQuote(part) == len(part)-1 {
+		part = part[1 : len(part)-1]
+	}
+	if !strings.Contains(part, "\\") {
+		return part
+	}
+	return strings.NewReplacer(`\,`, ",", `\;`, ";", `\"`, `"`).Replace(part)
 }
 
+// closingQuote returns the index of the quote closing the quote that opens part, or -1 when part
+// does not start with a quote or the quote is not closed
+func closingQuote(part string) int {
+	if len(part) == 0 || part[0] != '"' {
+		return -1
+	}
+	for i := 1; i < len(part); i++ {
+		switch {
+		case part[i] == '\\' && i+1 < len(part) && strings.IndexByte(`,;"`, part[i+1]) >= 0:
+			i++
+		case part[i] == '"':
+			return i
+		}
+	}
+	return -1
+}
+
+// ParseInputOutput parses an input or output spec. Fields of legacy specs may contain separators
+// escaped with a backslash or be enclosed in double quotes, e.g. url:0,"s3://bucket/a,b",.*
 func ParseInputOutput(value string) InputOutput {
+	if SpecFormat == SpecFormatJSON {
+		return parseInputOutputJSON(value)
+	}
+
 	details := strings.SplitN(value, ":", 2)
 	if details[0] == "task" {
 		// task:<folder>,<url>,<regex> or task:<url>
-		lineDetails := strings.SplitN(details[1], ",", 3)
+		lineDetails := splitSpec(details[1], ',', 3)
 		if len(lineDetails) == 3 {
-			return TaskInput{lineDetails[0],
-				lineDetails[1][strings.LastIndex(lineDetails[1], "/")+1:],
-				lineDetails[1], lineDetails[2]}
+			regex, timeout := splitInputTimeout(lineDetails[2])
+			url := unescapeSpec(lineDetails[1])
+			return TaskInput{unescapeSpec(lineDetails[0]), url[strings.LastIndex(url, "/")+1:],
+				url, unescapeSpec(regex), timeout}
 		}
-		return &TaskOutput{lineDetails[0][strings.LastIndex(lineDetails[0], "/")+1:],
-			lineDetails[0]}
+		url := unescapeSpec(lineDetails[0])
+		return &TaskOutput{url[strings.LastIndex(url, "/")+1:], url}
 	} else if details[0] == "url" {
 		// url:<folder>,<url>,<regex> or url:<url>,<regex>
-		lineDetails := strings.SplitN(details[1], ",", 3)
+		lineDetails := splitSpec(details[1], ',', 3)
 		if len(lineDetails) == 2 {
-			return &UrlOutput{lineDetails[0], lineDetails[1]}
+			return &UrlOutput{unescapeSpec(lineDetails[0]), unescapeSpec(lineDetails[1])}
 		}
-		return UrlInput{lineDetails[0], lineDetails[1], lineDetails[2]}
+		regex, timeout := splitInputTimeout(lineDetails[2])
+		return UrlInput{unescapeSpec(lineDetails[0]), unescapeSpec(lineDetails[1]),
+			unescapeSpec(regex), timeout}
 	} else if details[0] == "dataset" {
 		// dataset:<folder>,<dataset | dataset:<tag or version>>,<regex> or
 		// dataset:<dataset | dataset:<tag>>,<path>,<metadata>...;<labels>...;<regex>
-		lineDetails := strings.SplitN(details[1], ",", 3)
+		lineDetails := splitSpec(details[1], ',', 3)
 
 		// Input
-		if !strings.Contains(details[1], ";") {
-			return DatasetInput{lineDetails[0], lineDetails[1], lineDetails[2]}
+		if len(splitSpec(details[1], ';', 2)) == 1 {
+			regex, timeout := splitInputTimeout(lineDetails[2])
+			return DatasetInput{unescapeSpec(lineDetails[0]), unescapeSpec(lineDetails[1]),
+				unescapeSpec(regex), timeout}
 		}
 
-		regexDetails := strings.SplitN(lineDetails[2], ";", 3)
-
-		var metadataFiles []string
-		if len(regexDetails[0]) > 0 {
-			metadataFiles = strings.Split(regexDetails[0], ",")
-		}
+		regexDetails := splitSpec(lineDetails[2], ';', 3)
+		metadataFiles := splitSpecList(regexDetails[0])
+		labelFiles := splitSpecList(regexDetails[1])
 
-		var labelFiles []string
-		if len(regexDetails[1]) > 0 {
-			labelFiles = strings.Split(regexDetails[1], ",")
-		}
-
-		return &DatasetOutput{lineDetails[0], lineDetails[1],
-			metadataFiles, "", labelFiles, "", regexDetails[2]}
+		return &DatasetOutput{unescapeSpec(lineDetails[0]), unescapeSpec(lineDetails[1]),
+			metadataFiles, "", labelFiles, "", unescapeSpec(regexDetails[2])}
 	} else if details[0] == "update_dataset" {
 		// Only has output
 		// update_dataset:<dataset | dataset:<tag>>;<path1>,<path2>...;<metadata>...;<labels>...
-		lineDetails := strings.SplitN(details[1], ";", 4)
-
-		var pathsLocation []string
-		if len(lineDetails[1]) > 0 {
-			pathsLocation = strings.Split(lineDetails[1], ",")
-		} else {
-			pathsLocation = []string{""}
+		if len(details) < 2 {
+			osmo_errors.SetExitCode(osmo_errors.INVALID_INPUT_CODE)
+			panic(fmt.Sprintf("Invalid spec %s: missing dataset, expected "+
+				"update_dataset:<dataset>;<paths>;<metadata>;<labels>", value))
 		}
-
-		var metadataFiles []string
-		if len(lineDetails[2]) > 0 {
-			metadataFiles = strings.Split(lineDetails[2], ",")
+		lineDetails := splitSpec(details[1], ';', 4)
+		if len(lineDetails) < 4 {
+			missing := []string{"<paths>", "<metadata>", "<labels>"}[len(lineDetails)-1:]
+			osmo_errors.SetExitCode(osmo_errors.INVALID_INPUT_CODE)
+			panic(fmt.Sprintf("Invalid spec %s: missing %s, expected "+
+				"update_dataset:<dataset>;<paths>;<metadata>;<labels>",
+				value, strings.Join(missing, ";")))
 		}
 
-		var labelFiles []string
-		if len(lineDetails[3]) > 0 {
-			labelFiles = strings.Split(lineDetails[3], ",")
+		pathsLocation := splitSpecList(lineDetails[1])
+		if len(pathsLocation) == 0 {
+			pathsLocation = []string{""}
 		}
+		metadataFiles := splitSpecList(lineDetails[2])
+		labelFiles := splitSpecList(lineDetails[3])
 
-		return &UpdateDatasetOutput{lineDetails[0], pathsLocation,
+		return &UpdateDatasetOutput{unescapeSpec(lineDetails[0]), pathsLocation,
 			metadataFiles, "", labelFiles, ""}
 	} else if details[0] == "kpi" {
 		// Only has output
 		// kpi:<url>,<path>
-		lineDetails := strings.SplitN(details[1], ",", 2)
-		return &KpiOutput{lineDetails[0], lineDetails[1]}
+		lineDetails := splitSpec(details[1], ',', 2)
+		return &KpiOutput{unescapeSpec(lineDetails[0]), unescapeSpec(lineDetails[1])}
 	}
 	osmo_errors.SetExitCode(osmo_errors.INVALID_INPUT_CODE)
 	panic(fmt.Sprintf("Unknown Input %s", details[0]))
 }
 
+// Output of a data auth check command, shared by every item that checks the same resource with
+// the same access type
+type dataAuthCheck struct {
+	done   chan struct{}
+	output []byte
+	ok     bool
+}
+
+// Data auth checks run by this process, keyed by their command
+var dataAuthChecks = map[string]*dataAuthCheck{}
+var dataAuthChecksMutex sync.Mutex
+
+// runDataAuthCheck runs a data auth check command at most once per process. Items checking the
+// same resource with the same access type wait for the first check and reuse its output. A check
+// that fails to run is not reused, so the waiting items run it themselves.
+func runDataAuthCheck(commandArgs []string, osmoChan chan string) []byte {
+	key := strings.Join(commandArgs, "\x00")
+	dataAuthChecksMutex.Lock()
+	check, exists := dataAuthChecks[key]
+	if !exists {
+		check = &dataAuthCheck{done: make(chan struct{})}
+		dataAuthChecks[key] = check
+	}
+	dataAuthChecksMutex.Unlock()
+
+	if exists {
+		<-check.done
+		if check.ok {
+			log.Printf("Reusing data auth check result of %s", strings.Join(commandArgs, " "))
+			return check.output
+		}
+		outb := RunOSMOCommandWithRetry(commandArgs, 3, osmoChan,
+			osmo_errors.DATA_AUTH_CHECK_FAILED_CODE, "")
+		return outb.Bytes()
+	}
+
+	defer func() {
+		if !check.ok {
+			dataAuthChecksMutex.Lock()
+			delete(dataAuthChecks, key)
+			dataAuthChecksMutex.Unlock()
+		}
+		close(check.done)
+	}()
+	outb := RunOSMOCommandWithRetry(commandArgs, 3, osmoChan,
+		osmo_errors.DATA_AUTH_CHECK_FAILED_CODE, "")
+	check.output = outb.Bytes()
+	check.ok = true
+	return check.output
+}
+
 // ValidateDataAuth validates access permissions for a single input/output operation
 // Retries on execution failures (service down, rate limit) but fails fast on auth failures
 func ValidateDataAuth(value string, userConfig string, osmoChan chan string) error {
@@ -918,7 +1432,7 @@ func ValidateDataAuth(value string, userConfig string, osmoChan chan string) err
 
 	// Execute with retry logic for transient failures (exit 1)
 	// Auth failures (exit 0 with status=fail) will be caught immediately
-	outb := RunOSMOCommandWithRetry(commandArgs, 3, osmoChan, osmo_errors.DATA_AUTH_CHECK_FAILED_CODE)
+	output := runDataAuthCheck(commandArgs, osmoChan)
 
 	// Parse JSON response
 	var result struct {
@@ -926,10 +1440,10 @@ func ValidateDataAuth(value string, userConfig string, osmoChan chan string) err
 		Error  string `json:"error,omitempty"`
 	}
 
-	if err := json.Unmarshal(outb.Bytes(), &result); err != nil {
-		errMsg := fmt.Sprintf("Failed to parse validation response for %s: %s", logInfo, err.Error())
-		osmoChan <- errMsg
-		return fmt.Errorf("%s", errMsg)
+	if err := json.Unmarshal(output, &result); err != nil {
+		errMsg := fmt.Sprintf("Failed to parse validation response for %s", logInfo)
+		osmoChan <- fmt.Sprintf("%s: %s", errMsg, err)
+		return osmo_errors.Wrap(osmo_errors.DATA_AUTH_CHECK_FAILED_CODE, errMsg, err)
 	}
 
 	switch strings.ToLower(result.Status) {
@@ -940,18 +1454,36 @@ func ValidateDataAuth(value string, userConfig string, osmoChan chan string) err
 	case "fail":
 		errMsg := fmt.Sprintf("Data auth validation failed for %s: %s", logInfo, result.Error)
 		osmoChan <- errMsg
-		return fmt.Errorf("%s", errMsg)
+		return osmo_errors.Wrap(osmo_errors.DATA_UNAUTHORIZED_CODE, errMsg, nil)
 
 	default:
 		errMsg := fmt.Sprintf("unknown data auth validation status: %s", result.Status)
 		osmoChan <- errMsg
-		return fmt.Errorf("%s", errMsg)
+		return osmo_errors.Wrap(osmo_errors.DATA_AUTH_CHECK_FAILED_CODE, errMsg, nil)
 	}
 }
 
+// Number of data auth validations run in parallel by ValidateInputsOutputsAccess
+var DataAuthWorkers int = 4
+
+// bufferLogs appends the messages sent to the returned channel to lines until the channel is
+// closed. The second channel is closed once every message is appended.
+func bufferLogs(lines *[]string) (chan string, chan struct{}) {
+	logChan := make(chan string)
+	collected := make(chan struct{})
+	go func() {
+		defer close(collected)
+		for line := range logChan {
+			*lines = append(*lines, line)
+		}
+	}()
+	return logChan, collected
+}
+
 // ValidateInputsOutputsAccess validates read access for all inputs and write access for all outputs
 // Only validates: UrlInput, DatasetInput (READ) and UrlOutput, DatasetOutput, UpdateDatasetOutput (WRITE)
 // All other types (TaskInput, TaskOutput, KpiOutput) are ignored
+// Every item is validated, and the returned error lists all items that failed.
 func ValidateInputsOutputsAccess(
 	inputs common.ArrayFlags,
 	outputs common.ArrayFlags,
@@ -964,13 +1496,80 @@ func ValidateInputsOutputsAccess(
 	allItems = append(allItems, inputs...)
 	allItems = append(allItems, outputs...)
 
-	// Validate all items - ValidateDataAuth will parse and determine if validation is needed
-	for _, value := range allItems {
-		if err := ValidateDataAuth(value, userConfig, osmoChan); err != nil {
-			return err
+	workers := DataAuthWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	itemErrors := make([]error, len(allItems))
+
+	// The messages of each item are held until every item before it is validated, so the
+	// messages of items validated at the same time are not interleaved
+	itemLogs := make([][]string, len(allItems))
+	itemDone := make([]bool, len(allItems))
+	nextFlush := 0
+	var flushMutex sync.Mutex
+	flush := func(index int) {
+		flushMutex.Lock()
+		defer flushMutex.Unlock()
+		itemDone[index] = true
+		for nextFlush < len(allItems) && itemDone[nextFlush] {
+			for _, line := range itemLogs[nextFlush] {
+				osmoChan <- line
+			}
+			itemLogs[nextFlush] = nil
+			nextFlush++
 		}
 	}
 
+	// A check that could not run at all is raised again after every item is validated
+	var checkPanic interface{}
+	var panicMutex sync.Mutex
+	items := make(chan int)
+	var waitWorkers sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		waitWorkers.Add(1)
+		go func() {
+			defer waitWorkers.Done()
+			for index := range items {
+				itemChan, collected := bufferLogs(&itemLogs[index])
+				func() {
+					defer func() {
+						close(itemChan)
+						<-collected
+						flush(index)
+					}()
+					defer func() {
+						if r := recover(); r != nil {
+							panicMutex.Lock()
+							if checkPanic == nil {
+								checkPanic = r
+							}
+							panicMutex.Unlock()
+							// The item is not parsed again, as the panic may come from parsing it
+							itemErrors[index] = fmt.Errorf("failed to check data access for "+
+								"%s: %v", allItems[index], r)
+						}
+					}()
+					// ValidateDataAuth will parse and determine if validation is needed
+					itemErrors[index] = ValidateDataAuth(allItems[index], userConfig, itemChan)
+				}()
+			}
+		}()
+	}
+	for index := range allItems {
+		items <- index
+	}
+	close(items)
+	waitWorkers.Wait()
+
+	err := errors.Join(itemErrors...)
+	if checkPanic != nil {
+		panic(err.Error())
+	}
+	if err != nil {
+		return err
+	}
+
 	osmoChan <- "All data access validations passed"
 	return nil
 }
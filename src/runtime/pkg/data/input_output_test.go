@@ -0,0 +1,501 @@
+/*
+SPDX-FileCopyrightText: Copyright (c) 2025 NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package data
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"go.corp.nvidia.com/osmo/runtime/pkg/metrics"
+	"go.corp.nvidia.com/osmo/runtime/pkg/osmo_errors"
+)
+
+func TestSplitSpec(t *testing.T) {
+	tests := []struct {
+		value string
+		sep   byte
+		n     int
+		want  []string
+	}{
+		{value: "a,b,c", sep: ',', n: -1, want: []string{"a", "b", "c"}},
+		{value: "a,b,c", sep: ',', n: 2, want: []string{"a", "b,c"}},
+		{value: `a\,b,c`, sep: ',', n: -1, want: []string{`a\,b`, "c"}},
+		{value: `"a,b",c`, sep: ',', n: -1, want: []string{`"a,b"`, "c"}},
+		{value: `"a\",b",c`, sep: ',', n: -1, want: []string{`"a\",b"`, "c"}},
+		{value: `a"b,c`, sep: ',', n: -1, want: []string{`a"b`, "c"}},
+		{value: `a;b\;c;d`, sep: ';', n: -1, want: []string{"a", `b\;c`, "d"}},
+		{value: "", sep: ',', n: -1, want: []string{""}},
+	}
+
+	for _, test := range tests {
+		if got := splitSpec(test.value, test.sep, test.n); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("splitSpec(%q, %q, %d): expected %q, got %q", test.value, test.sep,
+				test.n, test.want, got)
+		}
+	}
+}
+
+func TestUnescapeSpec(t *testing.T) {
+	tests := []struct {
+		part string
+		want string
+	}{
+		{part: `a\,b\;c\"d`, want: `a,b;c"d`},
+		{part: `"a,b"`, want: "a,b"},
+		{part: `"a\"b"`, want: `a"b`},
+		{part: `\d+\.csv`, want: `\d+\.csv`},
+		// Quotes that do not enclose the whole part are kept
+		{part: `"a"b"`, want: `"a"b"`},
+		{part: `"a\"`, want: `"a"`},
+		{part: `"`, want: `"`},
+		{part: "", want: ""},
+	}
+
+	for _, test := range tests {
+		if got := unescapeSpec(test.part); got != test.want {
+			t.Errorf("unescapeSpec(%q): expected %q, got %q", test.part, test.want, got)
+		}
+	}
+}
+
+func TestParseInputOutputEscapes(t *testing.T) {
+	tests := []struct {
+		name string
+		spec string
+		want InputOutput
+	}{
+		{
+			name: "without escapes",
+			spec: "url:0,s3://bucket/a,.*",
+			want: UrlInput{"0", "s3://bucket/a", ".*", 0},
+		},
+		{
+			name: "unescaped commas in the regex",
+			spec: "url:0,s3://bucket/a,a,b",
+			want: UrlInput{"0", "s3://bucket/a", "a,b", 0},
+		},
+		{
+			name: "timeout",
+			spec: "url:0,s3://bucket/a,.*,timeout=5m",
+			want: UrlInput{"0", "s3://bucket/a", ".*", 5 * time.Minute},
+		},
+		{
+			name: "quoted timeout",
+			spec: `url:0,s3://bucket/a,"a,b,timeout=5m"`,
+			want: UrlInput{"0", "s3://bucket/a", "a,b,timeout=5m", 0},
+		},
+		{
+			name: "escaped timeout",
+			spec: `url:0,s3://bucket/a,a\,b\,timeout=5m`,
+			want: UrlInput{"0", "s3://bucket/a", "a,b,timeout=5m", 0},
+		},
+		{
+			name: "quoted regex and timeout",
+			spec: `url:0,s3://bucket/a,"a,b",timeout=5m`,
+			want: UrlInput{"0", "s3://bucket/a", "a,b", 5 * time.Minute},
+		},
+		{
+			name: "quoted url",
+			spec: `url:0,"s3://bucket/a,b",.*`,
+			want: UrlInput{"0", "s3://bucket/a,b", ".*", 0},
+		},
+		{
+			name: "escaped quotes in a quoted url",
+			spec: `url:0,"s3://bucket/\"a,b\"",.*`,
+			want: UrlInput{"0", `s3://bucket/"a,b"`, ".*", 0},
+		},
+		{
+			name: "regex with escaped and unescaped characters",
+			spec: `url:0,s3://bucket/a,^x\.y\,z\d+,w$`,
+			want: UrlInput{"0", "s3://bucket/a", `^x\.y,z\d+,w$`, 0},
+		},
+		{
+			name: "quotes that do not enclose the regex",
+			spec: `url:0,s3://bucket/a,"a"b"`,
+			want: UrlInput{"0", "s3://bucket/a", `"a"b"`, 0},
+		},
+		{
+			name: "escaped separators in dataset output lists",
+			spec: `dataset:name:tag,path,m\;1.yaml,"m,2.yaml";l.yaml;.*`,
+			want: &DatasetOutput{"name:tag", "path", []string{"m;1.yaml", "m,2.yaml"}, "",
+				[]string{"l.yaml"}, "", ".*"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := ParseInputOutput(test.spec); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("expected %#v, got %#v", test.want, got)
+			}
+		})
+	}
+}
+
+// Escape a field of a legacy spec with backslashes
+func escapeSpec(field string) string {
+	return strings.NewReplacer(",", `\,`, ";", `\;`, `"`, `\"`).Replace(field)
+}
+
+// Enclose a field of a legacy spec in quotes. Separators are not escaped in quotes, but the
+// backslashes before them still need to be.
+func quoteSpec(field string) string {
+	return `"` + strings.NewReplacer(`"`, `\"`, `\,`, `\\,`, `\;`, `\\;`).Replace(field) + `"`
+}
+
+func TestParseInputOutputRoundTrip(t *testing.T) {
+	fields := [][3]string{
+		{"data", "s3://bucket/prefix", ".*"},
+		{"da,ta", "s3://bucket/a,b;c", "a,b;c"},
+		{"data", `s3://bucket/"quoted"`, `^"x",y$`},
+		{"data", "s3://bucket/a", `\d+\,\.csv`},
+		{"data", "s3://bucket/a", "a,b,timeout=5m"},
+		{"data", "s3://bucket/a", ""},
+	}
+
+	for _, encode := range []func(string) string{escapeSpec, quoteSpec} {
+		for _, field := range fields {
+			spec := "url:" + encode(field[0]) + "," + encode(field[1]) + "," + encode(field[2])
+			want := UrlInput{field[0], field[1], field[2], 0}
+			if got := ParseInputOutput(spec); !reflect.DeepEqual(got, want) {
+				t.Errorf("%s: expected %#v, got %#v", spec, want, got)
+			}
+		}
+	}
+}
+
+// A stand-in for the OSMO CLI that records its arguments and passes every data auth check
+const fakeCheckScript = `#!/bin/sh
+echo "$@" >> "$OSMO_CHECK_LOG"
+echo '{"status": "pass"}'
+`
+
+func TestValidateInputsOutputsAccessChecksDuplicatesOnce(t *testing.T) {
+	binDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(binDir, "osmo"), []byte(fakeCheckScript),
+		0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", binDir+":"+os.Getenv("PATH"))
+	checkLog := filepath.Join(t.TempDir(), "checks")
+	t.Setenv("OSMO_CHECK_LOG", checkLog)
+
+	dataAuthChecks = map[string]*dataAuthCheck{}
+	workers := DataAuthWorkers
+	DataAuthWorkers = 4
+	defer func() { DataAuthWorkers = workers }()
+
+	inputs := []string{
+		"url:input1,s3://bucket/shared,.*",
+		"url:input2,s3://bucket/shared,.*",
+		"url:input3,s3://bucket/shared,.*",
+		"dataset:input4,name:tag,.*",
+		"dataset:input5,name:tag,.*",
+	}
+	outputs := []string{
+		"url:s3://bucket/shared,.*",
+		"url:s3://bucket/shared,.*",
+	}
+
+	osmoChan := make(chan string)
+	logsDone := make(chan struct{})
+	go func() {
+		defer close(logsDone)
+		for range osmoChan {
+		}
+	}()
+	err := ValidateInputsOutputsAccess(inputs, outputs, "user.yaml", osmoChan)
+	close(osmoChan)
+	<-logsDone
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := os.ReadFile(checkLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checks := strings.Split(strings.TrimSpace(string(content)), "\n")
+	slices.Sort(checks)
+	want := []string{
+		"data check s3://bucket/shared --access-type READ --config-file user.yaml",
+		"data check s3://bucket/shared --access-type WRITE --config-file user.yaml",
+		"dataset check name:tag --access-type READ --config-file user.yaml",
+	}
+	if !reflect.DeepEqual(checks, want) {
+		t.Errorf("expected one check per resource and access type %q, got %q", want, checks)
+	}
+}
+
+func TestGetDataCredential(t *testing.T) {
+	bucket := DataCredential{AccessKeyId: "bucket"}
+	data := DataCredential{AccessKeyId: "data"}
+	train := DataCredential{AccessKeyId: "train"}
+	fallback := DataCredential{AccessKeyId: "default"}
+
+	tests := []struct {
+		name     string
+		profiles map[string]DataCredential
+		url      string
+		want     DataCredential
+		wantErr  bool
+	}{
+		{
+			name:     "single matching profile",
+			profiles: map[string]DataCredential{"s3://bucket": bucket},
+			url:      "s3://bucket/data/file",
+			want:     bucket,
+		},
+		{
+			name:     "single default profile",
+			profiles: map[string]DataCredential{DefaultDataProfile: fallback},
+			url:      "s3://bucket/data/file",
+			want:     fallback,
+		},
+		{
+			name:     "single profile of another backend",
+			profiles: map[string]DataCredential{"s3://other": bucket},
+			url:      "s3://bucket/data/file",
+			wantErr:  true,
+		},
+		{
+			name:     "no profiles",
+			profiles: map[string]DataCredential{},
+			url:      "s3://bucket/data/file",
+			wantErr:  true,
+		},
+		{
+			name: "exact profile before the prefixes and the default",
+			profiles: map[string]DataCredential{
+				"s3://bucket":      bucket,
+				"s3://bucket/data": data,
+				DefaultDataProfile: fallback,
+			},
+			url:  "s3://bucket/data/file",
+			want: bucket,
+		},
+		{
+			name: "longest prefix",
+			profiles: map[string]DataCredential{
+				"s3://bucket/data":        data,
+				"s3://bucket/data/train/": train,
+				DefaultDataProfile:        fallback,
+			},
+			url:  "s3://bucket/data/train/file",
+			want: train,
+		},
+		{
+			name: "prefix only at a path boundary",
+			profiles: map[string]DataCredential{
+				"s3://bucket/data": data,
+				DefaultDataProfile: fallback,
+			},
+			url:  "s3://bucket/database/file",
+			want: fallback,
+		},
+		{
+			name: "default after no other profile matches",
+			profiles: map[string]DataCredential{
+				"gs://bucket":      data,
+				"s3://other":       bucket,
+				DefaultDataProfile: fallback,
+			},
+			url:  "s3://bucket/data/file",
+			want: fallback,
+		},
+		{
+			name: "no match among several profiles",
+			profiles: map[string]DataCredential{
+				"gs://bucket": data,
+				"s3://other":  bucket,
+			},
+			url:     "s3://bucket/data/file",
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := ConfigInfo{Auth: DataConfig{Data: test.profiles}}
+			got, err := config.GetDataCredential(ParseStorageBackend(test.url))
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got the credential %s", got.AccessKeyId)
+				}
+				if !strings.Contains(err.Error(), "s3://bucket") {
+					t.Errorf("expected the error to name the backend, got %q", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("expected the credential %s, got %s", test.want.AccessKeyId,
+					got.AccessKeyId)
+			}
+		})
+	}
+}
+
+func TestParseInputOutputTruncatedUpdateDataset(t *testing.T) {
+	tests := []struct {
+		spec        string
+		wantMissing string
+	}{
+		{spec: "update_dataset", wantMissing: "missing dataset"},
+		{spec: "update_dataset:name", wantMissing: "missing <paths>;<metadata>;<labels>"},
+		{spec: "update_dataset:name;out", wantMissing: "missing <metadata>;<labels>"},
+		{spec: "update_dataset:name;out;meta.yaml", wantMissing: "missing <labels>"},
+	}
+
+	const format = "update_dataset:<dataset>;<paths>;<metadata>;<labels>"
+	exitCode := osmo_errors.GetExitCode()
+	defer osmo_errors.SetExitCode(exitCode)
+	for _, test := range tests {
+		t.Run(test.spec, func(t *testing.T) {
+			osmo_errors.SetExitCode(0)
+			defer func() {
+				message, _ := recover().(string)
+				if !strings.Contains(message, test.wantMissing) ||
+					!strings.Contains(message, format) {
+					t.Errorf("expected an error naming %q and the format, got %q",
+						test.wantMissing, message)
+				}
+				if code := osmo_errors.GetExitCode(); code != osmo_errors.INVALID_INPUT_CODE {
+					t.Errorf("expected exit code %d, got %d", osmo_errors.INVALID_INPUT_CODE, code)
+				}
+			}()
+			ParseInputOutput(test.spec)
+		})
+	}
+
+	output, ok := ParseInputOutput("update_dataset:name;out;;").(*UpdateDatasetOutput)
+	if !ok || output.Dataset != "name" || !slices.Equal(output.Paths, []string{"out"}) {
+		t.Errorf("expected a complete spec with empty metadata and labels to parse, got %+v",
+			output)
+	}
+}
+
+// A stand-in for the OSMO CLI that records its arguments and starts dataset version 2
+const fakeUpdateScript = `#!/bin/sh
+echo "$@" >> "$OSMO_CHECK_LOG"
+echo '{"version_id": "2"}'
+`
+
+func TestUpdateDatasetOutputEmptyPaths(t *testing.T) {
+	binDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(binDir, "osmo"), []byte(fakeUpdateScript),
+		0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", binDir+":"+os.Getenv("PATH"))
+	benchmarkPath := BenchmarkPath
+	BenchmarkPath = t.TempDir() + "/"
+	defer func() { BenchmarkPath = benchmarkPath }()
+	strict := StrictUpdatePaths
+	defer func() { StrictUpdatePaths = strict }()
+
+	outputPath := t.TempDir() + "/"
+	for _, folder := range []string{"full", "empty"} {
+		if err := os.Mkdir(outputPath+folder, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(outputPath+"full/file", []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		paths     []string
+		strict    bool
+		wantPaths []string
+		wantPanic bool
+	}{
+		{
+			name:      "mixed paths",
+			paths:     []string{"full", "empty", "full:remote"},
+			wantPaths: []string{outputPath + "full", outputPath + "full:remote"},
+		},
+		{
+			name:  "only empty paths",
+			paths: []string{"empty", "missing"},
+		},
+		{
+			name:      "mixed paths in strict mode",
+			paths:     []string{"full", "empty"},
+			strict:    true,
+			wantPanic: true,
+		},
+		{
+			name:      "non-empty paths in strict mode",
+			paths:     []string{"full"},
+			strict:    true,
+			wantPaths: []string{outputPath + "full"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			checkLog := filepath.Join(t.TempDir(), "commands")
+			t.Setenv("OSMO_CHECK_LOG", checkLog)
+			StrictUpdatePaths = test.strict
+
+			osmoChan := make(chan string)
+			logsDone := make(chan struct{})
+			go func() {
+				defer close(logsDone)
+				for range osmoChan {
+				}
+			}()
+			metricChan := make(chan metrics.Metric, 10)
+			output := &UpdateDatasetOutput{Dataset: "name", Paths: test.paths,
+				MetadataFile: "metadata.yaml"}
+			panicked := func() (panicked bool) {
+				defer func() { panicked = recover() != nil }()
+				output.UploadFolder(nil, outputPath, osmoChan, metricChan, "0", "group", "task",
+					"name", 0, "")
+				return false
+			}()
+			close(osmoChan)
+			<-logsDone
+			if panicked != test.wantPanic {
+				t.Fatalf("expected a failure: %t, got %t", test.wantPanic, panicked)
+			}
+
+			content, _ := os.ReadFile(checkLog)
+			var added []string
+			for _, command := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+				if !strings.Contains(command, "--resume") {
+					continue
+				}
+				fields := strings.Fields(command)
+				added = fields[slices.Index(fields, "--add")+1:]
+			}
+			if !slices.Equal(added, test.wantPaths) {
+				t.Errorf("expected the update to add %q, got %q", test.wantPaths, added)
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+/*
+SPDX-FileCopyrightText: Copyright (c) 2025 NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package messages
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LogSink receives a copy of every log record sent to the workflow service.
+// Implementations must never block the caller.
+type LogSink interface {
+	Write(record string)
+	Close() error
+}
+
+// NDJSONSink forwards log records as newline delimited JSON to a local forwarder such as
+// fluent-bit. Records are dropped (and counted) when the forwarder cannot keep up.
+type NDJSONSink struct {
+	network string
+	address string
+	records chan string
+	dropped atomic.Int64
+	done    chan bool
+	wait    sync.WaitGroup
+}
+
+// NewNDJSONSink creates a sink for an address of the form unix:///path/to.sock or
+// tcp://host:port
+func NewNDJSONSink(address string, bufferSize int) (*NDJSONSink, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid log sink address %s: %w", address, err)
+	}
+
+	var network, target string
+	switch u.Scheme {
+	case "unix":
+		network, target = "unix", u.Path
+	case "tcp":
+		network, target = "tcp", u.Host
+	default:
+		return nil, fmt.Errorf("unsupported log sink scheme %s", u.Scheme)
+	}
+	if target == "" {
+		return nil, fmt.Errorf("log sink address %s is missing a target", address)
+	}
+	if bufferSize <= 0 {
+		bufferSize = 1
+	}
+
+	sink := &NDJSONSink{
+		network: network,
+		address: target,
+		records: make(chan string, bufferSize),
+		done:    make(chan bool),
+	}
+	sink.wait.Add(1)
+	go sink.run()
+	return sink, nil
+}
+
+// Write queues the record for delivery, dropping it if the queue is full
+func (s *NDJSONSink) Write(record string) {
+	select {
+	case s.records <- record:
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+// Close stops the delivery goroutine. Records still queued are discarded.
+func (s *NDJSONSink) Close() error {
+	close(s.done)
+	s.wait.Wait()
+	return nil
+}
+
+func (s *NDJSONSink) run() {
+	defer s.wait.Done()
+
+	var conn net.Conn
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case record := <-s.records:
+			if conn == nil {
+				var err error
+				conn, err = net.DialTimeout(s.network, s.address, time.Second)
+				if err != nil {
+					// The forwarder is unavailable, so this record is lost
+					s.dropped.Add(1)
+					conn = nil
+					continue
+				}
+			}
+
+			if dropped := s.dropped.Swap(0); dropped > 0 {
+				log.Printf("Log sink %s dropped %d records", s.address, dropped)
+			}
+
+			conn.SetWriteDeadline(time.Now().Add(time.Second))
+			if _, err := conn.Write([]byte(record + "\n")); err != nil {
+				s.dropped.Add(1)
+				conn.Close()
+				conn = nil
+			}
+		}
+	}
+}
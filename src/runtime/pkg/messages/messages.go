@@ -22,6 +22,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"math"
 	"net"
 	"time"
 
@@ -55,6 +56,7 @@ const (
 	Upload   IOType = "UPLOAD"
 	LogDone  IOType = "LOG_DONE"
 	Barrier  IOType = "BARRIER"
+	Progress IOType = "PROGRESS"
 )
 
 /////////////////////////////////////////////////////
@@ -71,6 +73,9 @@ type Request struct {
 	Command       string
 	TaskPort      int
 	RsyncRunning  bool
+	RsyncState    string `json:",omitempty"`
+	RsyncReason   string `json:",omitempty"`
+	RsyncPort     int    `json:",omitempty"`
 }
 
 func ExecStartRequest(outputFolder string) Request {
@@ -147,10 +152,12 @@ func EncodeMessage(unixConn net.Conn, message string, requestMessage Request) {
 /////////////////////////////////////////////////////
 
 type LogRequest struct {
-	Source string
-	Time   time.Time
-	Text   string
-	IOType IOType
+	Source   string
+	Time     time.Time
+	Text     string
+	IOType   IOType
+	Hostname string `json:",omitempty"`
+	Node     string `json:",omitempty"`
 }
 
 type LogDoneRequest struct {
@@ -163,9 +170,29 @@ type BarrierRequest struct {
 	IOType IOType
 }
 
+// Progress of an input or output, sent separately from the logs. BytesTotal and Percent are 0
+// when the size of the transfer is not known.
+type ProgressRequest struct {
+	ID         string
+	Identifier string
+	Time       time.Time
+	BytesDone  int64
+	BytesTotal int64
+	Percent    float64
+	IOType     IOType
+}
+
+// Identity of the host attached to every log, set once at startup
+var hostname, nodeLabel string
+
+func SetIdentity(host string, node string) {
+	hostname = host
+	nodeLabel = node
+}
+
 func CreateLog(source string, text string, ioType IOType) string {
 	currTime := time.Now().UTC()
-	logRequest := LogRequest{source, currTime, text, ioType}
+	logRequest := LogRequest{source, currTime, text, ioType, hostname, nodeLabel}
 	logJson, err := json.Marshal(logRequest)
 	if err != nil {
 		osmo_errors.SetExitCode(osmo_errors.WEBSOCKET_MESSAGE_FAILED_CODE)
@@ -184,6 +211,21 @@ func CreateLogDone() string {
 	return string(logJson)
 }
 
+func CreateProgress(id string, identifier string, bytesDone int64, bytesTotal int64) string {
+	percent := 0.0
+	if bytesTotal > 0 {
+		percent = math.Min(100, 100*float64(bytesDone)/float64(bytesTotal))
+	}
+	progressRequest := ProgressRequest{id, identifier, time.Now().UTC(), bytesDone, bytesTotal,
+		percent, Progress}
+	requestJson, err := json.Marshal(progressRequest)
+	if err != nil {
+		osmo_errors.SetExitCode(osmo_errors.WEBSOCKET_MESSAGE_FAILED_CODE)
+		panic(err)
+	}
+	return string(requestJson)
+}
+
 func CreateBarrier(name string, count int) string {
 	barrierRequest := BarrierRequest{name, count, Barrier}
 	requestJson, err := json.Marshal(barrierRequest)
@@ -0,0 +1,124 @@
+/*
+SPDX-FileCopyrightText: Copyright (c) 2025 NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package messages
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+)
+
+// RPCRequest is a runtime command sent to the control socket. The ID is echoed in the response
+// so clients can correlate responses with requests.
+type RPCRequest struct {
+	ID     string          `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+type RPCResponse struct {
+	ID     string      `json:"id"`
+	Result interface{} `json:"result,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+// RPCHandler decodes its own params and returns a JSON serializable result
+type RPCHandler func(params json.RawMessage) (interface{}, error)
+
+// RPCServer serves newline delimited JSON requests, one response per request, on every
+// connection to a listener. New runtime commands are added with Register.
+type RPCServer struct {
+	mutex   sync.RWMutex
+	methods map[string]RPCHandler
+}
+
+func NewRPCServer() *RPCServer {
+	return &RPCServer{methods: map[string]RPCHandler{}}
+}
+
+func (s *RPCServer) Register(method string, handler RPCHandler) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.methods[method] = handler
+}
+
+// Methods lists the registered methods
+func (s *RPCServer) Methods() []string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	methods := make([]string, 0, len(s.methods))
+	for method := range s.methods {
+		methods = append(methods, method)
+	}
+	return methods
+}
+
+// Serve accepts connections until the listener is closed
+func (s *RPCServer) Serve(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Printf("Control socket closed: %v", err)
+			return
+		}
+		go s.serveConn(conn)
+	}
+}
+
+func (s *RPCServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+	decoder := json.NewDecoder(conn)
+	encoder := json.NewEncoder(conn)
+	for {
+		var request RPCRequest
+		if err := decoder.Decode(&request); err != nil {
+			return
+		}
+		if err := encoder.Encode(s.call(request)); err != nil {
+			return
+		}
+	}
+}
+
+func (s *RPCServer) call(request RPCRequest) (response RPCResponse) {
+	response.ID = request.ID
+	s.mutex.RLock()
+	handler, ok := s.methods[request.Method]
+	s.mutex.RUnlock()
+	if !ok {
+		response.Error = fmt.Sprintf("unknown method %s", request.Method)
+		return response
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			response.Result = nil
+			response.Error = fmt.Sprintf("method %s failed: %v", request.Method, r)
+		}
+	}()
+	result, err := handler(request.Params)
+	if err != nil {
+		response.Error = err.Error()
+		return response
+	}
+	response.Result = result
+	return response
+}
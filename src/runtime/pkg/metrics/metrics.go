@@ -19,7 +19,13 @@ SPDX-License-Identifier: Apache-2.0
 package metrics
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
 	"time"
 
 	"go.corp.nvidia.com/osmo/runtime/pkg/osmo_errors"
@@ -50,6 +56,163 @@ type TaskIOMetrics struct {
 	NumberOfFiles int    `json:"number_of_files"`
 	OperationType string `json:"operation_type"`
 	DownloadType  string `json:"download_type"`
+	// Bytes per second the port forward direction was limited to, 0 for unlimited
+	RateLimit int64 `json:"rate_limit,omitempty"`
+}
+
+// State transitions reported by TaskIOEvent
+const (
+	InputStarted    string = "input_started"
+	InputMounted    string = "input_mounted"
+	InputDownloaded string = "input_downloaded"
+	InputFailed     string = "input_failed"
+	OutputStarted   string = "output_started"
+	OutputUploaded  string = "output_uploaded"
+	OutputFailed    string = "output_failed"
+)
+
+type TaskIOEvent struct {
+	RetryId         string  `json:"retry_id"`
+	GroupName       string  `json:"group_name"`
+	TaskName        string  `json:"task_name"`
+	Event           string  `json:"event"`
+	Identifier      string  `json:"identifier"`
+	Index           int     `json:"index"`
+	Time            string  `json:"time"`
+	DurationSeconds float64 `json:"duration_seconds"`
+	Reason          string  `json:"reason,omitempty"`
+}
+
+// Time spent enumerating the files of an output before they are uploaded
+type OutputScanMetrics struct {
+	RetryId         string  `json:"retry_id"`
+	GroupName       string  `json:"group_name"`
+	TaskName        string  `json:"task_name"`
+	URL             string  `json:"url"`
+	Pattern         string  `json:"pattern"`
+	NumberOfFiles   int     `json:"number_of_files"`
+	DurationSeconds float64 `json:"duration_seconds"`
+}
+
+// Throughput of a data phase over one sampling window
+type ThroughputWindowMetrics struct {
+	RetryId          string  `json:"retry_id"`
+	GroupName        string  `json:"group_name"`
+	TaskName         string  `json:"task_name"`
+	Phase            string  `json:"phase"`
+	StartTime        string  `json:"start_time"`
+	EndTime          string  `json:"end_time"`
+	BytesTransferred int64   `json:"bytes_transferred"`
+	BytesPerMinute   float64 `json:"bytes_per_minute"`
+}
+
+// Emitted once when the task starts. Runs with the same fingerprint had the same inputs,
+// outputs and data settings.
+type TaskStartedEvent struct {
+	RetryId     string `json:"retry_id"`
+	GroupName   string `json:"group_name"`
+	TaskName    string `json:"task_name"`
+	Time        string `json:"time"`
+	Fingerprint string `json:"fingerprint"`
+	NumInputs   int    `json:"number_of_inputs"`
+	NumOutputs  int    `json:"number_of_outputs"`
+}
+
+// Benchmark files of an input or output that could not be parsed, so its transfer metrics
+// are incomplete
+type BenchmarkFailureMetrics struct {
+	RetryId    string   `json:"retry_id"`
+	GroupName  string   `json:"group_name"`
+	TaskName   string   `json:"task_name"`
+	Identifier string   `json:"identifier"`
+	Files      []string `json:"files"`
+}
+
+// Log records of one stream dropped since the previous report because the log queue was full
+type DroppedLogsMetrics struct {
+	RetryId   string `json:"retry_id"`
+	GroupName string `json:"group_name"`
+	TaskName  string `json:"task_name"`
+	Stream    string `json:"stream"`
+	Count     int    `json:"count"`
+	StartTime string `json:"start_time"`
+	EndTime   string `json:"end_time"`
+}
+
+// Every log record the task dropped so far, emitted once per report of dropped logs
+type DroppedLogsTotalMetrics struct {
+	RetryId    string `json:"retry_id"`
+	GroupName  string `json:"group_name"`
+	TaskName   string `json:"task_name"`
+	Time       string `json:"time"`
+	TotalCount int    `json:"total_count"`
+}
+
+// Emitted each time the user command is restarted
+type TaskRestartEvent struct {
+	RetryId            string  `json:"retry_id"`
+	GroupName          string  `json:"group_name"`
+	TaskName           string  `json:"task_name"`
+	RestartCount       int     `json:"restart_count"`
+	Reason             string  `json:"reason"`
+	Time               string  `json:"time"`
+	BarrierWaitSeconds float64 `json:"barrier_wait_seconds"`
+}
+
+// Time a task waited at a group barrier for the other tasks of its group
+type BarrierWaitMetrics struct {
+	RetryId     string  `json:"retry_id"`
+	GroupName   string  `json:"group_name"`
+	TaskName    string  `json:"task_name"`
+	Barrier     string  `json:"barrier"`
+	StartTime   string  `json:"start_time"`
+	EndTime     string  `json:"end_time"`
+	WaitSeconds float64 `json:"wait_seconds"`
+}
+
+// Security warnings reported by SecurityWarningEvent
+const (
+	InsecureTLSWarning string = "tls_verification_disabled"
+)
+
+// Emitted at startup for each security sensitive setting the task runs with
+type SecurityWarningEvent struct {
+	RetryId   string `json:"retry_id"`
+	GroupName string `json:"group_name"`
+	TaskName  string `json:"task_name"`
+	Time      string `json:"time"`
+	Warning   string `json:"warning"`
+}
+
+// Peak number of goroutines of ctrl over one sampling window
+type GoroutineMetrics struct {
+	RetryId        string `json:"retry_id"`
+	GroupName      string `json:"group_name"`
+	TaskName       string `json:"task_name"`
+	StartTime      string `json:"start_time"`
+	EndTime        string `json:"end_time"`
+	PeakGoroutines int    `json:"peak_goroutines"`
+}
+
+// Start and end of one phase of the task, such as the input download or the user command
+type TaskPhaseMetrics struct {
+	RetryId         string  `json:"retry_id"`
+	GroupName       string  `json:"group_name"`
+	TaskName        string  `json:"task_name"`
+	Phase           string  `json:"phase"`
+	StartTime       string  `json:"start_time"`
+	EndTime         string  `json:"end_time"`
+	DurationSeconds float64 `json:"duration_seconds"`
+}
+
+// Total size of the outputs of the task, measured before they are uploaded
+type OutputSizeMetrics struct {
+	RetryId     string `json:"retry_id"`
+	GroupName   string `json:"group_name"`
+	TaskName    string `json:"task_name"`
+	Time        string `json:"time"`
+	SizeInBytes int64  `json:"size_in_bytes"`
+	MaxBytes    int64  `json:"max_bytes"`
 }
 
 type Metric interface {
@@ -58,6 +221,43 @@ type Metric interface {
 
 func (f GroupMetrics) getMetricType() string  { return "group_metrics" }
 func (f TaskIOMetrics) getMetricType() string { return "task_io_metrics" }
+func (f TaskIOEvent) getMetricType() string   { return "task_io_event" }
+func (f OutputScanMetrics) getMetricType() string {
+	return "output_scan_metrics"
+}
+func (f ThroughputWindowMetrics) getMetricType() string {
+	return "throughput_window_metrics"
+}
+func (f TaskStartedEvent) getMetricType() string {
+	return "task_started_event"
+}
+func (f BenchmarkFailureMetrics) getMetricType() string {
+	return "benchmark_failure_metrics"
+}
+func (f DroppedLogsMetrics) getMetricType() string {
+	return "dropped_logs_metrics"
+}
+func (f DroppedLogsTotalMetrics) getMetricType() string {
+	return "dropped_logs_total_metrics"
+}
+func (f TaskRestartEvent) getMetricType() string {
+	return "task_restart_event"
+}
+func (f SecurityWarningEvent) getMetricType() string {
+	return "security_warning_event"
+}
+func (f BarrierWaitMetrics) getMetricType() string {
+	return "barrier_wait_metrics"
+}
+func (f GoroutineMetrics) getMetricType() string {
+	return "goroutine_metrics"
+}
+func (f TaskPhaseMetrics) getMetricType() string {
+	return "task_phase_metrics"
+}
+func (f OutputSizeMetrics) getMetricType() string {
+	return "output_size_metrics"
+}
 
 type MetricsRequest struct {
 	Source     string
@@ -65,15 +265,62 @@ type MetricsRequest struct {
 	Metric     Metric
 	IOType     IOType
 	MetricType string
+	Hostname   string `json:",omitempty"`
+	Node       string `json:",omitempty"`
+}
+
+// Identity of the host attached to every metric, set once at startup
+var hostname, nodeLabel string
+
+func SetIdentity(host string, node string) {
+	hostname = host
+	nodeLabel = node
+}
+
+// Key used to HMAC-SHA256 sign metric records. Signing is disabled when empty.
+var signingKey []byte
+
+// LoadSigningKey reads the metrics signing key from a file. Surrounding whitespace is ignored.
+func LoadSigningKey(path string) error {
+	key, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read metrics signing key: %w", err)
+	}
+	key = []byte(strings.TrimSpace(string(key)))
+	if len(key) == 0 {
+		return fmt.Errorf("metrics signing key %s is empty", path)
+	}
+	signingKey = key
+	return nil
+}
+
+// signMetrics appends a Signature field to the metric record. The signature is the hex encoded
+// HMAC-SHA256 of the record without the field, so consumers verify it by replacing the trailing
+// `,"Signature":"<hex>"}` with `}` and signing the result.
+func signMetrics(metricsJson []byte) []byte {
+	mac := hmac.New(sha256.New, signingKey)
+	mac.Write(metricsJson)
+	signature := hex.EncodeToString(mac.Sum(nil))
+
+	signed := make([]byte, 0, len(metricsJson)+len(signature)+16)
+	signed = append(signed, metricsJson[:len(metricsJson)-1]...)
+	signed = append(signed, `,"Signature":"`...)
+	signed = append(signed, signature...)
+	signed = append(signed, `"}`...)
+	return signed
 }
 
 func CreateMetrics(source string, metric Metric, ioType IOType) string {
 	currTime := time.Now().UTC()
-	metricsRequest := MetricsRequest{source, currTime, metric, ioType, metric.getMetricType()}
+	metricsRequest := MetricsRequest{source, currTime, metric, ioType, metric.getMetricType(),
+		hostname, nodeLabel}
 	metricsJson, err := json.Marshal(metricsRequest)
 	if err != nil {
 		osmo_errors.SetExitCode(osmo_errors.METRICS_FAILED_CODE)
 		panic(err)
 	}
+	if len(signingKey) > 0 {
+		metricsJson = signMetrics(metricsJson)
+	}
 	return string(metricsJson)
 }
@@ -0,0 +1,115 @@
+/*
+SPDX-FileCopyrightText: Copyright (c) 2025 NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package metrics
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeSigningKey writes a signing key file and returns its path
+func writeSigningKey(t *testing.T, key string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(path, []byte(key), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadSigningKey(t *testing.T) {
+	defer func() { signingKey = nil }()
+
+	if err := LoadSigningKey(writeSigningKey(t, " secret\n")); err != nil {
+		t.Fatal(err)
+	}
+	if string(signingKey) != "secret" {
+		t.Errorf("expected the key without surrounding whitespace, got %q", signingKey)
+	}
+
+	if err := LoadSigningKey(writeSigningKey(t, "\n")); err == nil {
+		t.Error("expected an empty key to be rejected")
+	}
+	if err := LoadSigningKey(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("expected a missing key file to be rejected")
+	}
+	if string(signingKey) != "secret" {
+		t.Errorf("expected a failed load to keep the key, got %q", signingKey)
+	}
+}
+
+func TestSignMetrics(t *testing.T) {
+	defer func() { signingKey = nil }()
+	metric := GroupMetrics{RetryId: "0", StartTime: "start", EndTime: "end"}
+
+	unsigned := CreateMetrics("source", metric, Metrics)
+	if strings.Contains(unsigned, "Signature") {
+		t.Fatalf("expected no signature without a key, got %s", unsigned)
+	}
+
+	signingKey = []byte("secret")
+	record := []byte(`{"Source":"source","MetricType":"group_metrics"}`)
+	signed := signMetrics(record)
+	if string(signMetrics(record)) != string(signed) {
+		t.Error("expected the same record to have the same signature")
+	}
+	// The signature of a fixed record under a fixed key must not change between releases
+	want := `{"Source":"source","MetricType":"group_metrics","Signature":` +
+		`"56fdc4406910a3e4433387005c240842a82b676cec6a650a819d1322b348c41e"}`
+	if string(signed) != want {
+		t.Errorf("expected %s, got %s", want, signed)
+	}
+
+	// Consumers verify the record as documented on signMetrics
+	created := CreateMetrics("source", metric, Metrics)
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(created), &fields); err != nil {
+		t.Fatalf("expected the signed record to be JSON: %v", err)
+	}
+	signature, ok := fields["Signature"].(string)
+	if !ok {
+		t.Fatalf("expected a signature, got %s", created)
+	}
+	suffix := `,"Signature":"` + signature + `"}`
+	if !strings.HasSuffix(created, suffix) {
+		t.Fatalf("expected the signature at the end of %s", created)
+	}
+	original := strings.TrimSuffix(created, suffix) + "}"
+	if signature != hmacHex(t, "secret", original) {
+		t.Error("expected the signature to verify against the record without it")
+	}
+
+	signingKey = []byte("other")
+	if string(signMetrics(record)) == string(signed) {
+		t.Error("expected another key to give another signature")
+	}
+}
+
+func hmacHex(t *testing.T, key string, message string) string {
+	t.Helper()
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(message))
+	return hex.EncodeToString(mac.Sum(nil))
+}
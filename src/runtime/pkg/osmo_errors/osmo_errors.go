@@ -20,8 +20,12 @@ package osmo_errors
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"syscall"
 )
 
 type ExitCode int
@@ -29,6 +33,18 @@ type ExitCode int
 // Exit code for type of ctrl failure
 var exitCode ExitCode
 
+// Optional human readable reason for the exit code, written alongside it
+var exitReason string
+
+// Longest reason written to the termination log, which kubernetes limits to 4096 bytes
+const maxExitReasonLength = 1024
+
+// Optional structured failure detail written alongside the exit code
+var failureDetails interface{}
+
+// Whether the task logs were truncated by the log volume limit
+var logsTruncated bool
+
 const (
 	// Data Failures
 	DOWNLOAD_FAILED_CODE        ExitCode = 10 // Failures regarding download calls
@@ -36,6 +52,7 @@ const (
 	UPLOAD_FAILED_CODE          ExitCode = 12 // Failures regarding upload calls
 	DATA_AUTH_CHECK_FAILED_CODE ExitCode = 13 // Failures regarding data auth
 	DATA_UNAUTHORIZED_CODE      ExitCode = 14 // Failures regarding data unauthorized
+	OUTPUT_SIZE_EXCEEDED_CODE   ExitCode = 15 // Failures regarding the output size limit
 
 	// Connection Failures
 	TOKEN_INVALID_CODE            ExitCode = 20 // Failures regarding token
@@ -49,11 +66,39 @@ const (
 	INVALID_INPUT_CODE ExitCode = 30 // Failures regarding invalid function inputs
 	CMD_FAILED_CODE    ExitCode = 31 // Failures regarding cmd execution
 	FILE_FAILED_CODE   ExitCode = 32 // Failures regarding file operations
+	ENV_FAILED_CODE    ExitCode = 33 // Failures regarding the startup environment self check
 
 	// Miscellaneous Catch All for Rest
 	MISC_FAILED_CODE ExitCode = 40 // Failures in general
 )
 
+// Reasons written for exit codes set without one
+var exitCodeDescriptions = map[ExitCode]string{
+	DOWNLOAD_FAILED_CODE:          "Failed to download inputs",
+	MOUNT_FAILED_CODE:             "Failed to mount inputs",
+	UPLOAD_FAILED_CODE:            "Failed to upload outputs",
+	DATA_AUTH_CHECK_FAILED_CODE:   "Failed to check data access",
+	DATA_UNAUTHORIZED_CODE:        "Data access is not authorized",
+	OUTPUT_SIZE_EXCEEDED_CODE:     "Outputs exceed the size limit",
+	TOKEN_INVALID_CODE:            "Failed to retrieve a valid token",
+	WEBSOCKET_TIMEOUT_CODE:        "Timed out connecting to the OSMO service",
+	WEBSOCKET_MESSAGE_FAILED_CODE: "Failed to send messages to the OSMO service",
+	UNIX_MESSAGE_FAILED_CODE:      "Failed to communicate with the user command",
+	BARRIER_FAILED_CODE:           "Failed to synchronize with the group",
+	METRICS_FAILED_CODE:           "Failed to create metrics",
+	INVALID_INPUT_CODE:            "Invalid task configuration",
+	CMD_FAILED_CODE:               "Failed to run a command",
+	FILE_FAILED_CODE:              "Failed to access a file",
+	ENV_FAILED_CODE:               "Startup environment check failed",
+	MISC_FAILED_CODE:              "Task failed",
+}
+
+// Description returns a short human readable meaning of the exit code, empty for success and
+// unknown codes
+func (code ExitCode) Description() string {
+	return exitCodeDescriptions[code]
+}
+
 type TimeoutError struct {
 	S string
 }
@@ -62,34 +107,193 @@ func (e *TimeoutError) Error() string {
 	return e.S
 }
 
+// OSMOError is an error carrying the exit code the task fails with, so it can be returned up
+// the stack and the exit code set in one place
+type OSMOError struct {
+	Code    ExitCode
+	Message string
+	Cause   error
+}
+
+func (e *OSMOError) Error() string {
+	if e.Cause != nil {
+		return fmt.Sprintf("%s: %s", e.Message, e.Cause)
+	}
+	return e.Message
+}
+
+func (e *OSMOError) Unwrap() error {
+	return e.Cause
+}
+
+// Wrap returns an error failing the task with code. err is the optional cause.
+func Wrap(code ExitCode, message string, err error) error {
+	return &OSMOError{Code: code, Message: message, Cause: err}
+}
+
+// CodeOf returns the exit code of the first OSMOError in the tree of err, MISC_FAILED_CODE when
+// there is none and 0 for a nil error
+func CodeOf(err error) ExitCode {
+	if err == nil {
+		return 0
+	}
+	var osmoError *OSMOError
+	if errors.As(err, &osmoError) {
+		return osmoError.Code
+	}
+	return MISC_FAILED_CODE
+}
+
+// HasCode reports whether any OSMOError in the tree of err has the exit code. Unlike CodeOf, it
+// also looks past the first OSMOError, such as the errors joined after it.
+func HasCode(err error, code ExitCode) bool {
+	switch e := err.(type) {
+	case *OSMOError:
+		return e.Code == code || HasCode(e.Cause, code)
+	case interface{ Unwrap() []error }:
+		for _, inner := range e.Unwrap() {
+			if HasCode(inner, code) {
+				return true
+			}
+		}
+	case interface{ Unwrap() error }:
+		return HasCode(e.Unwrap(), code)
+	}
+	return false
+}
+
 func LogError(stdout string, stderr string, osmoChan chan string, err error, code ExitCode) {
 	if err != nil {
 		log.Println("out:", stdout)
 		log.Println("err:", stderr)
 		osmoChan <- stdout
 		osmoChan <- stderr
-		SetExitCode(code)
+		SetExitCodeWithReason(code, err.Error())
 		panic(err)
 	}
 }
 
 func SetExitCode(code ExitCode) {
 	exitCode = code
+	exitReason = ""
+}
+
+// SetExitCodeWithReason sets the exit code with a human readable reason for the termination log
+func SetExitCodeWithReason(code ExitCode, reason string) {
+	exitCode = code
+	exitReason = reason
+}
+
+// SetDefaultExitReason records the reason for the exit code unless one was set with it
+func SetDefaultExitReason(reason string) {
+	if exitReason == "" {
+		exitReason = reason
+	}
+}
+
+func GetExitCode() ExitCode {
+	return exitCode
+}
+
+// SetFailureDetails attaches a JSON serializable record describing the failure to the
+// termination log
+func SetFailureDetails(details interface{}) {
+	failureDetails = details
+}
+
+// SetLogsTruncated records in the termination log that task logs were truncated
+func SetLogsTruncated() {
+	logsTruncated = true
+}
+
+// Termination log read by kubernetes
+const DefaultTerminationLogPath = "/dev/termination-log"
+
+// Environment variable overriding the termination log path, for environments without kubernetes
+const TerminationLogEnv = "OSMO_TERMINATION_LOG"
+
+// Path the exit code is written to, overridden by OSMO_TERMINATION_LOG or the terminationLog flag
+var TerminationLogPath = terminationLogPathFromEnv()
+
+func terminationLogPathFromEnv() string {
+	if path := os.Getenv(TerminationLogEnv); path != "" {
+		return path
+	}
+	return DefaultTerminationLogPath
+}
+
+// Whether the termination log may be a symlink. When unset, a symlinked termination log is not
+// written so the exit code is never written through a link to an unintended file.
+var FollowTerminationSymlink bool
+
+var errUnsafeTerminationLog = errors.New("unsafe termination log")
+
+// openTerminationLog opens the termination log for writing after checking that it is, or
+// resolves to, a regular file
+func openTerminationLog() (*os.File, error) {
+	path := TerminationLogPath
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		if !FollowTerminationSymlink {
+			return nil, fmt.Errorf("%w: %s is a symlink", errUnsafeTerminationLog, path)
+		}
+		target, err := filepath.EvalSymlinks(path)
+		if err != nil {
+			return nil, fmt.Errorf("%w: failed to resolve %s: %s",
+				errUnsafeTerminationLog, path, err)
+		}
+		log.Printf("Termination log %s resolves to %s", path, target)
+		path = target
+	}
+	if info, err := os.Stat(path); err == nil && !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("%w: %s is not a regular file", errUnsafeTerminationLog, path)
+	}
+	// The path was resolved above, so a link appearing in its place is not followed
+	return os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|syscall.O_NOFOLLOW, 0644)
 }
 
 func SaveExitCode() {
-	// TODO: This file applies to kubernetes. Won't work with slurm
-	file, err := os.Create("/dev/termination-log")
+	log.Printf("Writing failure code %d to termination log", exitCode)
+	terminationLog := map[string]interface{}{"code": int(exitCode)}
+	reason := exitReason
+	if reason == "" {
+		reason = exitCode.Description()
+	}
+	if reason != "" {
+		if len(reason) > maxExitReasonLength {
+			reason = reason[:maxExitReasonLength] + "..."
+		}
+		terminationLog["reason"] = reason
+	}
+	if failureDetails != nil {
+		terminationLog["failure"] = failureDetails
+	}
+	if logsTruncated {
+		terminationLog["logs_truncated"] = true
+	}
+	exitCodeJson, err := json.Marshal(terminationLog)
 	if err != nil {
 		panic(err)
 	}
-	defer file.Close()
 
-	log.Printf("Writing failure code %d to termination log", exitCode)
-	exitCodeJson, err := json.Marshal(map[string]int{"code": int(exitCode)})
+	if _, err := os.Stat(filepath.Dir(TerminationLogPath)); errors.Is(err, os.ErrNotExist) {
+		log.Printf("WARNING: Directory of termination log %s does not exist, skip writing it",
+			TerminationLogPath)
+		log.Printf("Termination log: %s", exitCodeJson)
+		return
+	}
+	file, err := openTerminationLog()
+	if errors.Is(err, errUnsafeTerminationLog) || errors.Is(err, syscall.EROFS) ||
+		errors.Is(err, os.ErrPermission) || errors.Is(err, os.ErrNotExist) {
+		// Keep the content in the logs since it cannot be reported through the file
+		log.Printf("Unable to write termination log: %s", err)
+		log.Printf("Termination log: %s", exitCodeJson)
+		return
+	}
 	if err != nil {
 		panic(err)
 	}
+	defer file.Close()
+
 	_, err = file.Write(exitCodeJson)
 	if err != nil {
 		panic(err)
@@ -0,0 +1,301 @@
+/*
+SPDX-FileCopyrightText: Copyright (c) 2025 NVIDIA CORPORATION & AFFILIATES. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package osmo_errors
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCodeOf(t *testing.T) {
+	unauthorized := Wrap(DATA_UNAUTHORIZED_CODE, "Data access is not authorized", nil)
+	authFailed := Wrap(DATA_AUTH_CHECK_FAILED_CODE, "Failed to check data access",
+		errors.New("timeout"))
+
+	tests := []struct {
+		name string
+		err  error
+		want ExitCode
+	}{
+		{name: "nil", err: nil, want: 0},
+		{name: "without an exit code", err: errors.New("failed"), want: MISC_FAILED_CODE},
+		{name: "OSMOError", err: unauthorized, want: DATA_UNAUTHORIZED_CODE},
+		{
+			name: "wrapped OSMOError",
+			err:  fmt.Errorf("item 1: %w", unauthorized),
+			want: DATA_UNAUTHORIZED_CODE,
+		},
+		{
+			name: "OSMOError wrapping an OSMOError",
+			err:  Wrap(UPLOAD_FAILED_CODE, "Failed to upload", unauthorized),
+			want: UPLOAD_FAILED_CODE,
+		},
+		{
+			name: "joined errors",
+			err:  errors.Join(errors.New("failed"), authFailed, unauthorized),
+			want: DATA_AUTH_CHECK_FAILED_CODE,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if code := CodeOf(test.err); code != test.want {
+				t.Errorf("expected exit code %d, got %d", test.want, code)
+			}
+		})
+	}
+}
+
+func TestOSMOErrorAs(t *testing.T) {
+	cause := errors.New("permission denied")
+	err := fmt.Errorf("item 2: %w", Wrap(DATA_UNAUTHORIZED_CODE, "Data access is not authorized",
+		cause))
+
+	var osmoError *OSMOError
+	if !errors.As(err, &osmoError) {
+		t.Fatal("expected an OSMOError in the tree of the error")
+	}
+	if osmoError.Code != DATA_UNAUTHORIZED_CODE {
+		t.Errorf("expected exit code %d, got %d", DATA_UNAUTHORIZED_CODE, osmoError.Code)
+	}
+	if !errors.Is(err, cause) {
+		t.Error("expected the cause to be unwrapped")
+	}
+	if want := "item 2: Data access is not authorized: permission denied"; err.Error() != want {
+		t.Errorf("expected %q, got %q", want, err.Error())
+	}
+}
+
+func TestHasCode(t *testing.T) {
+	unauthorized := Wrap(DATA_UNAUTHORIZED_CODE, "Data access is not authorized", nil)
+	authFailed := Wrap(DATA_AUTH_CHECK_FAILED_CODE, "Failed to check data access", nil)
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "nil", err: nil, want: false},
+		{name: "without an exit code", err: errors.New("failed"), want: false},
+		{name: "OSMOError", err: unauthorized, want: true},
+		{name: "other exit code", err: authFailed, want: false},
+		{
+			name: "joined after another OSMOError",
+			err:  errors.Join(authFailed, fmt.Errorf("item 3: %w", unauthorized)),
+			want: true,
+		},
+		{
+			name: "cause of another OSMOError",
+			err:  Wrap(UPLOAD_FAILED_CODE, "Failed to upload", unauthorized),
+			want: true,
+		},
+		{
+			name: "joined without the exit code",
+			err:  errors.Join(authFailed, errors.New("failed")),
+			want: false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := HasCode(test.err, DATA_UNAUTHORIZED_CODE); got != test.want {
+				t.Errorf("expected %t, got %t", test.want, got)
+			}
+		})
+	}
+}
+
+func TestSaveExitCode(t *testing.T) {
+	tests := []struct {
+		name string
+		// path returns the termination log path in a temporary directory
+		path        func(t *testing.T, dir string) string
+		wantWritten bool
+	}{
+		{
+			name:        "writable path",
+			path:        func(t *testing.T, dir string) string { return filepath.Join(dir, "log") },
+			wantWritten: true,
+		},
+		{
+			name: "missing directory",
+			path: func(t *testing.T, dir string) string {
+				return filepath.Join(dir, "missing", "log")
+			},
+		},
+		{
+			name: "read-only directory",
+			path: func(t *testing.T, dir string) string {
+				if os.Geteuid() == 0 {
+					t.Skip("permissions are not enforced for root")
+				}
+				if err := os.Chmod(dir, 0555); err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { os.Chmod(dir, 0755) })
+				return filepath.Join(dir, "log")
+			},
+		},
+		{
+			name: "directory in place of the file",
+			path: func(t *testing.T, dir string) string {
+				path := filepath.Join(dir, "log")
+				if err := os.Mkdir(path, 0755); err != nil {
+					t.Fatal(err)
+				}
+				return path
+			},
+		},
+	}
+
+	terminationLogPath := TerminationLogPath
+	defer func() { TerminationLogPath = terminationLogPath }()
+	code, reason := exitCode, exitReason
+	defer SetExitCodeWithReason(code, reason)
+	logOutput := log.Writer()
+	defer log.SetOutput(logOutput)
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			TerminationLogPath = test.path(t, t.TempDir())
+			SetExitCodeWithReason(UPLOAD_FAILED_CODE, "Failed to upload")
+			var logs bytes.Buffer
+			log.SetOutput(&logs)
+			SaveExitCode()
+
+			want := fmt.Sprintf(`{"code":%d,"reason":"Failed to upload"}`, UPLOAD_FAILED_CODE)
+			written, err := os.ReadFile(TerminationLogPath)
+			if !test.wantWritten {
+				if err == nil && len(written) > 0 {
+					t.Errorf("expected the termination log not to be written, got %s", written)
+				}
+				if !strings.Contains(logs.String(), "Termination log: "+want) {
+					t.Errorf("expected the termination log in the logs, got %q", logs.String())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(written) != want {
+				t.Errorf("expected %s, got %s", want, written)
+			}
+		})
+	}
+}
+
+func TestSaveExitCodeSymlink(t *testing.T) {
+	tests := []struct {
+		name   string
+		follow bool
+		// target returns the path the termination log links to in a temporary directory
+		target      func(t *testing.T, dir string) string
+		wantWritten bool
+	}{
+		{
+			name: "not followed by default",
+			target: func(t *testing.T, dir string) string {
+				path := filepath.Join(dir, "target")
+				if err := os.WriteFile(path, []byte("unchanged"), 0644); err != nil {
+					t.Fatal(err)
+				}
+				return path
+			},
+		},
+		{
+			name:   "followed to a file",
+			follow: true,
+			target: func(t *testing.T, dir string) string {
+				path := filepath.Join(dir, "target")
+				if err := os.WriteFile(path, nil, 0644); err != nil {
+					t.Fatal(err)
+				}
+				return path
+			},
+			wantWritten: true,
+		},
+		{
+			name:   "followed to a directory",
+			follow: true,
+			target: func(t *testing.T, dir string) string {
+				path := filepath.Join(dir, "target")
+				if err := os.Mkdir(path, 0755); err != nil {
+					t.Fatal(err)
+				}
+				return path
+			},
+		},
+		{
+			name:   "followed to a missing directory",
+			follow: true,
+			target: func(t *testing.T, dir string) string {
+				return filepath.Join(dir, "missing", "target")
+			},
+		},
+	}
+
+	terminationLogPath := TerminationLogPath
+	defer func() { TerminationLogPath = terminationLogPath }()
+	follow := FollowTerminationSymlink
+	defer func() { FollowTerminationSymlink = follow }()
+	code, reason := exitCode, exitReason
+	defer SetExitCodeWithReason(code, reason)
+	logOutput := log.Writer()
+	defer log.SetOutput(logOutput)
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			target := test.target(t, dir)
+			TerminationLogPath = filepath.Join(dir, "termination-log")
+			if err := os.Symlink(target, TerminationLogPath); err != nil {
+				t.Fatal(err)
+			}
+			FollowTerminationSymlink = test.follow
+			SetExitCodeWithReason(UPLOAD_FAILED_CODE, "Failed to upload")
+			var logs bytes.Buffer
+			log.SetOutput(&logs)
+			SaveExitCode()
+
+			want := fmt.Sprintf(`{"code":%d,"reason":"Failed to upload"}`, UPLOAD_FAILED_CODE)
+			written, err := os.ReadFile(target)
+			if test.wantWritten {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(written) != want {
+					t.Errorf("expected %s, got %s", want, written)
+				}
+				return
+			}
+			if err == nil && string(written) != "unchanged" {
+				t.Errorf("expected the link target not to be written, got %s", written)
+			}
+			if !strings.Contains(logs.String(), "Termination log: "+want) {
+				t.Errorf("expected the termination log in the logs, got %q", logs.String())
+			}
+		})
+	}
+}
@@ -34,39 +34,132 @@ import (
 	"go.corp.nvidia.com/osmo/runtime/pkg/messages"
 )
 
+type RsyncState string
+
+const (
+	RsyncNotStarted RsyncState = "not_started"
+	RsyncStarting   RsyncState = "starting"
+	RsyncRunning    RsyncState = "running"
+	RsyncFailed     RsyncState = "failed"
+	// rsync exited without an error or was stopped with the task
+	RsyncStopped RsyncState = "stopped"
+)
+
 type RsyncStatus struct {
-	mutex   sync.Mutex
-	running bool
+	mutex  sync.Mutex
+	state  RsyncState
+	reason string
+	port   int
 }
 
 func (r *RsyncStatus) IsRunning() bool {
+	state, _ := r.State()
+	return state == RsyncRunning
+}
+
+// State returns the last reported state and, for a failed rsync, why it failed
+func (r *RsyncStatus) State() (RsyncState, string) {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
-	return r.running
+	if r.state == "" {
+		return RsyncNotStarted, ""
+	}
+	return r.state, r.reason
 }
 
-func (r *RsyncStatus) SetRunning(running bool) {
+func (r *RsyncStatus) SetState(state RsyncState, reason string) {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
-	r.running = running
+	r.state = state
+	r.reason = reason
+}
+
+// SetFromRequest updates the status from a UserRsyncStatus request. Requests without a state are
+// from user binaries that only report whether rsync is running.
+func (r *RsyncStatus) SetFromRequest(request messages.Request) {
+	state := RsyncState(request.RsyncState)
+	if state == "" {
+		state = RsyncNotStarted
+		if request.RsyncRunning {
+			state = RsyncRunning
+		}
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.state = state
+	r.reason = request.RsyncReason
+	r.port = request.RsyncPort
+}
+
+// Port returns the port rsync listens on in the task. User binaries that do not report the port
+// always use common.RsyncPort.
+func (r *RsyncStatus) Port() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.port == 0 {
+		return int(common.RsyncPort)
+	}
+	return r.port
+}
+
+// Describe explains the state to someone trying to connect to rsync
+func (r *RsyncStatus) Describe() string {
+	state, reason := r.State()
+	switch state {
+	case RsyncNotStarted:
+		return "rsync has not been started in the task, it is only available when enabled"
+	case RsyncStarting:
+		return "rsync is starting, retry shortly"
+	case RsyncFailed:
+		return fmt.Sprintf("rsync failed and will not become available: %s", reason)
+	case RsyncStopped:
+		return fmt.Sprintf("rsync has stopped and will not become available: %s", reason)
+	}
+	return string(state)
+}
+
+func sendStatus(unixConn net.Conn, port int, state RsyncState, reason string) {
+	request := messages.UserRsyncStatusRequest(state == RsyncRunning)
+	request.RsyncState = string(state)
+	request.RsyncReason = reason
+	request.RsyncPort = port
+	if err := json.NewEncoder(unixConn).Encode(request); err != nil {
+		log.Printf("Failed to send request: %v\n", err)
+	}
 }
 
 func RunRsync(
 	ctx context.Context,
 	userBinPath string,
 	runLocation string,
+	rsyncPort int,
 	rsyncReadLimit int,
 	rsyncWriteLimit int,
 	rsyncPathAllowList string,
 	unixConn net.Conn,
 ) error {
+	taskCtx := ctx
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
+	if rsyncPort == 0 {
+		port, err := selectFreePort()
+		if err != nil {
+			log.Printf("Failed to select a port for rsync: %v", err)
+			sendStatus(unixConn, 0, RsyncFailed, fmt.Sprintf("failed to select a port: %v", err))
+			return err
+		}
+		rsyncPort = port
+		log.Printf("Selected port %d for rsync", rsyncPort)
+	}
+	report := func(state RsyncState, reason string) {
+		sendStatus(unixConn, rsyncPort, state, reason)
+	}
+
 	rsyncCmd := exec.CommandContext(
 		ctx,
 		fmt.Sprintf("%s/rsync", userBinPath),
-		"-port", fmt.Sprintf("%d", common.RsyncPort),
+		"-port", fmt.Sprintf("%d", rsyncPort),
 		"-runLocation", runLocation,
 		"-readLimit", fmt.Sprintf("%d", rsyncReadLimit),
 		"-writeLimit", fmt.Sprintf("%d", rsyncWriteLimit),
@@ -77,59 +170,71 @@ func RunRsync(
 	rsyncCmd.Stdout = os.Stdout
 	rsyncCmd.Stderr = os.Stderr
 
+	report(RsyncStarting, "")
 	if err := rsyncCmd.Start(); err != nil {
 		log.Printf("Failed to start rsync: %v", err)
+		report(RsyncFailed, fmt.Sprintf("failed to start: %v", err))
 		return err
 	}
 
-	go monitorRsync(ctx, rsyncCmd, unixConn)
-
-	if err := rsyncCmd.Wait(); err != nil {
+	monitorDone := make(chan struct{})
+	go func() {
+		defer close(monitorDone)
+		monitorRsync(ctx, rsyncCmd, report)
+	}()
+
+	err := rsyncCmd.Wait()
+	// Stop the monitor first so the final state is not overwritten
+	cancel()
+	<-monitorDone
+	if taskCtx.Err() != nil {
+		log.Printf("Rsync command stopped with the task")
+		report(RsyncStopped, "stopped with the task")
+		return nil
+	}
+	if err != nil {
 		log.Printf("Rsync command exited with error: %v", err)
+		report(RsyncFailed, fmt.Sprintf("exited: %v", err))
 		return err
 	}
+	log.Printf("Rsync command exited")
+	report(RsyncStopped, "exited")
 
 	return nil
 }
 
-func monitorRsync(ctx context.Context, rsyncCmd *exec.Cmd, unixConn net.Conn) {
+// selectFreePort asks the kernel for a free port on the interface the rsync server listens on. The
+// port may be taken again before rsync listens on it, which then fails rsync.
+func selectFreePort() (int, error) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		return 0, err
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port, nil
+}
+
+func monitorRsync(ctx context.Context, rsyncCmd *exec.Cmd, report func(RsyncState, string)) {
 	ticker := time.NewTicker(5 * time.Second)
 	defer ticker.Stop()
 
 	for {
 		select {
 		case <-ctx.Done():
-			// Context was cancelled, send status update and exit
-			if err := json.NewEncoder(unixConn).Encode(
-				messages.UserRsyncStatusRequest(false),
-			); err != nil {
-				log.Printf("Failed to send request: %v\n", err)
-			}
+			// Context was cancelled, RunRsync reports the final state
 			return
 		case <-ticker.C:
 			if rsyncCmd.Process == nil {
-				if err := json.NewEncoder(unixConn).Encode(
-					messages.UserRsyncStatusRequest(false),
-				); err != nil {
-					log.Printf("Failed to send request: %v\n", err)
-				}
+				report(RsyncStarting, "")
 				continue
 			}
 
 			if err := rsyncCmd.Process.Signal(syscall.Signal(0)); err != nil {
-				if err := json.NewEncoder(unixConn).Encode(
-					messages.UserRsyncStatusRequest(false),
-				); err != nil {
-					log.Printf("Failed to send request: %v\n", err)
-				}
+				report(RsyncFailed, fmt.Sprintf("process is not alive: %v", err))
 				continue
 			}
 
-			if err := json.NewEncoder(unixConn).Encode(
-				messages.UserRsyncStatusRequest(true),
-			); err != nil {
-				log.Printf("Failed to send request: %v\n", err)
-			}
+			report(RsyncRunning, "")
 		}
 	}
 }
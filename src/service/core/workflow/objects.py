@@ -727,6 +727,8 @@ class RouterResponse(pydantic.BaseModel):
     router_address: str
     key: str
     cookie: str
+    # Whether the task expects UDP datagrams prefixed with the address family of the client
+    udp_address_family: bool = False
 
 
 class WorkflowSubmitInfo(pydantic.BaseModel):
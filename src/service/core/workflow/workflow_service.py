@@ -1129,6 +1129,7 @@ def exec_into_task(name: str, task_name: str, entry_command: str,
 def port_forward_task(name: str, task_name: str,
                       task_ports: List[int] | None = fastapi.Query(default=None),
                       use_udp: bool = False,
+                      udp_address_family: bool = False,
                       user_header: Optional[str] =
                         fastapi.Header(alias=login.OSMO_USER_HEADER, default=None),
                       roles_header: Optional[str] =
@@ -1151,12 +1152,25 @@ def port_forward_task(name: str, task_name: str,
             f'exceeds the maximum number of ports per call'
             f'({workflow_config.max_num_ports_per_task})!')
 
+    # Clients that do not send udp_address_family frame datagrams without it, and so do tasks
+    # whose ctrl does not report the feature
+    udp_address_family = use_udp and udp_address_family
+    if udp_address_family:
+        task_obj = helpers.get_running_task(workflow_response, task_name)
+        redis_client = connectors.RedisConnector.get_instance().client
+        udp_address_family = bool(redis_client.sismember(
+            workflow.ctrl_features_key(workflow_response.name, task_name, task_obj.retry_id),
+            workflow.CTRL_FEATURE_UDP_ADDRESS_FAMILY))
+
     router_infos = []
     for port in task_ports:
-        payload = {'task_port': port, 'use_udp': use_udp}
-        router_infos.append(action_request_helper(
+        payload = {'task_port': port, 'use_udp': use_udp,
+                   'udp_address_family': udp_address_family}
+        router_info = action_request_helper(
             ActionType.PORTFORWARD, payload, name, task_name=task_name,
-            cached_workflow_response=workflow_response)[task_name])
+            cached_workflow_response=workflow_response)[task_name]
+        router_info.udp_address_family = payload['udp_address_family']
+        router_infos.append(router_info)
 
     return router_infos
 
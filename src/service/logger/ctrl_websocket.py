@@ -138,6 +138,14 @@ async def run_websocket(websocket: fastapi.WebSocket, name: str, task_name: str,
                 workflow_obj.timeout.queue_timeout, workflow_obj.timeout.exec_timeout)
 
             async with redis.asyncio.from_url(workflow_obj.logs) as redis_client:
+                # Older ctrl versions report no features
+                features = websocket.query_params.getlist('feature')
+                if features:
+                    features_key = workflow.ctrl_features_key(
+                        workflow_obj.workflow_id, task_name, retry_id)
+                    await redis_client.sadd(features_key, *features)
+                    await redis_client.expire(features_key, total_timeout, nx=True)
+
                 # Continue receiving logs until connection is closed
                 async def get_logs(websocket):
                     first_run = True
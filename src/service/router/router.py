@@ -181,6 +181,8 @@ async def run_connect_client(
     """Websocket for client to connect."""
     await client_ws.accept()
     close = None
+    # Close code and reason of the backend, such as why ctrl did not forward the connection
+    close_code, close_reason = 1000, None
 
     try:
         if key in connections:
@@ -201,6 +203,8 @@ async def run_connect_client(
             await common.gather_cancel(*coroutines)
     except fastapi.WebSocketDisconnect as err:
         logging.info('Websocket disconnection for workflow %s with key %s: %s', name, key, err)
+        if err.reason:
+            close_code, close_reason = err.code, err.reason
     except asyncio.TimeoutError:
         logging.info('Client connection for workflow %s with key %s is timeout', name, key)
         del connections[key]
@@ -209,16 +213,23 @@ async def run_connect_client(
         close.set()
     # Make close faster
     try:
-        await client_ws.close()
+        await client_ws.close(close_code, close_reason)
     except:  # pylint: disable=bare-except
         pass
     logging.info('Client API finished: %s, %s', name, key)
 
 
 async def copy_data(src_ws: fastapi.WebSocket, dst_ws: fastapi.WebSocket):
-    """Forwards data from src_ws to dst_ws."""
+    """Forwards data from src_ws to dst_ws. Text messages, such as the end of the input of an exec
+    session, are forwarded as text."""
     while True:
-        data = await src_ws.receive_bytes()
+        message = await src_ws.receive()
+        if message['type'] == 'websocket.disconnect':
+            raise fastapi.WebSocketDisconnect(message.get('code', 1000), message.get('reason'))
+        if message.get('text') is not None:
+            await dst_ws.send_text(message['text'])
+            continue
+        data = message.get('bytes')
         if not data:
             break
         await dst_ws.send_bytes(data)
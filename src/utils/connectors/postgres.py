@@ -2721,6 +2721,12 @@ class RsyncConfig(ExtraArgBaseModel):
         ge=0,
     )
     allowed_paths: Dict[str, RsyncAllowedPath] = {}
+    port: int = pydantic.Field(
+        16000,
+        description='Port the rsync server of the user pod listens on, zero selects a free port',
+        ge=0,
+        le=65535,
+    )
     daemon_debounce_delay: float = pydantic.Field(
         30.0,
         description='Daemon debounce delay for rsync in seconds',
@@ -2425,6 +2425,7 @@ class TaskGroup(pydantic.BaseModel):
             user_args += ['-enableRsync']
             rsync_config = workflow_config.plugins_config.rsync
             user_args += [
+                '-rsyncPort', str(rsync_config.port),
                 '-rsyncReadLimit', str(rsync_config.read_bandwidth_limit),
                 '-rsyncWriteLimit', str(rsync_config.write_bandwidth_limit),
             ]
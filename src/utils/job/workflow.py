@@ -47,6 +47,15 @@ def action_queue_name(workflow_id: str, task_name: str, retry_id: int) -> str:
     return f'client-connections:{workflow_id}:{task_name}:{retry_id}'
 
 
+# Reported by ctrl versions that accept UDP datagrams prefixed with the address family
+CTRL_FEATURE_UDP_ADDRESS_FAMILY = 'udp_address_family'
+
+
+def ctrl_features_key(workflow_id: str, task_name: str, retry_id: int) -> str:
+    """ Redis set of the features the ctrl of a task reported when it connected. """
+    return f'ctrl-features:{workflow_id}:{task_name}:{retry_id}'
+
+
 class WorkflowStatus(str, enum.Enum):
     """ Represents the status of a workflow. """
     # No task has started for the workflow yet